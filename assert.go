@@ -0,0 +1,147 @@
+package starbox
+
+import (
+	"fmt"
+	"regexp"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+const (
+	assertModuleName = "assert"
+)
+
+// loadAssertModule loads the assert module for test scripts, it can be added by AddNamedModules("assert").
+// Each function raises an error with a descriptive message on failure, so the run fails with the message and the location of the call:
+//
+//	eq(actual, expected, msg="")  # fails if actual != expected
+//	ne(actual, unexpected, msg="")  # fails if actual == unexpected
+//	true(cond, msg="")  # fails if cond is falsy
+//	contains(container, item, msg="")  # fails if item not in container
+//	fails(fn, pattern="")  # fails if fn() succeeds, or the error doesn't match the regular expression pattern, returns the error message
+func loadAssertModule() (starlark.StringDict, error) {
+	return starlark.StringDict{
+		assertModuleName: &starlarkstruct.Module{
+			Name: assertModuleName,
+			Members: starlark.StringDict{
+				"eq":       starlark.NewBuiltin("eq", assertEqual),
+				"ne":       starlark.NewBuiltin("ne", assertNotEqual),
+				"true":     starlark.NewBuiltin("true", assertTrue),
+				"contains": starlark.NewBuiltin("contains", assertContains),
+				"fails":    starlark.NewBuiltin("fails", assertFails),
+			},
+		},
+	}, nil
+}
+
+// assertError returns the error of a failed assertion with the optional message from the script.
+func assertError(b *starlark.Builtin, msg string, format string, args ...interface{}) error {
+	detail := fmt.Sprintf(format, args...)
+	if msg != "" {
+		return fmt.Errorf("%s.%s: %s: %s", assertModuleName, b.Name(), msg, detail)
+	}
+	return fmt.Errorf("%s.%s: %s", assertModuleName, b.Name(), detail)
+}
+
+// assertEqual implements assert.eq(actual, expected, msg="").
+func assertEqual(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		x, y starlark.Value
+		msg  string
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "actual", &x, "expected", &y, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	ok, err := starlark.Equal(x, y)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, assertError(b, msg, "%s != %s", x.String(), y.String())
+	}
+	return starlark.None, nil
+}
+
+// assertNotEqual implements assert.ne(actual, unexpected, msg="").
+func assertNotEqual(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		x, y starlark.Value
+		msg  string
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "actual", &x, "unexpected", &y, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	ok, err := starlark.Equal(x, y)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, assertError(b, msg, "%s == %s", x.String(), y.String())
+	}
+	return starlark.None, nil
+}
+
+// assertTrue implements assert.true(cond, msg="").
+func assertTrue(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		cond starlark.Value
+		msg  string
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "cond", &cond, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	if !cond.Truth() {
+		return nil, assertError(b, msg, "%s is not truthy", cond.String())
+	}
+	return starlark.None, nil
+}
+
+// assertContains implements assert.contains(container, item, msg="").
+func assertContains(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		container, item starlark.Value
+		msg             string
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "container", &container, "item", &item, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	found, err := starlark.Binary(syntax.IN, item, container)
+	if err != nil {
+		return nil, err
+	}
+	if !found.Truth() {
+		return nil, assertError(b, msg, "%s not in %s", item.String(), container.String())
+	}
+	return starlark.None, nil
+}
+
+// assertFails implements assert.fails(fn, pattern=""), and returns the error message of the call.
+func assertFails(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		fn      starlark.Callable
+		pattern string
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "fn", &fn, "pattern?", &pattern); err != nil {
+		return nil, err
+	}
+	_, err := starlark.Call(thread, fn, nil, nil)
+	if err == nil {
+		return nil, assertError(b, "", "evaluation of %s succeeded unexpectedly", fn.Name())
+	}
+	msg := err.Error()
+	if ee, ok := err.(*starlark.EvalError); ok {
+		msg = ee.Msg
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern: %w", b.Name(), err)
+		}
+		if !re.MatchString(msg) {
+			return nil, assertError(b, "", "error %q does not match pattern %q", msg, pattern)
+		}
+	}
+	return starlark.String(msg), nil
+}
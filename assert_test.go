@@ -0,0 +1,82 @@
+package starbox_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/1set/starbox"
+)
+
+// TestAssertModule tests the following:
+// 1. Create a new Starbox instance with the assert module added by name.
+// 2. Run scripts with passing and failing assertions.
+// 3. Check the failing assertions return errors with the message and location.
+func TestAssertModule(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{"eq", `assert.eq(1 + 1, 2)`, ""},
+		{"eq fail", `assert.eq(1 + 1, 3)`, "assert.eq: 2 != 3"},
+		{"eq fail msg", `assert.eq("a", "b", "letters")`, `assert.eq: letters: "a" != "b"`},
+		{"ne", `assert.ne([1], [2])`, ""},
+		{"ne fail", `assert.ne(None, None)`, "assert.ne: None == None"},
+		{"true", `assert.true(len("abc"))`, ""},
+		{"true fail", `assert.true([], msg="empty")`, "assert.true: empty: [] is not truthy"},
+		{"contains list", `assert.contains([1, 2, 3], 2)`, ""},
+		{"contains dict", `assert.contains({"a": 1}, "a")`, ""},
+		{"contains string", `assert.contains("aloha", "loh")`, ""},
+		{"contains fail", `assert.contains([1, 2], 3)`, "assert.contains: 3 not in [1, 2]"},
+		{"fails", hereDoc(`
+			msg = assert.fails(lambda: 1 // 0, "division by zero")
+			assert.eq(msg, "floored division by zero")
+		`), ""},
+		{"fails unexpected", `assert.fails(lambda: 1)`, "assert.fails: evaluation of lambda succeeded unexpectedly"},
+		{"fails mismatch", `assert.fails(lambda: 1 // 0, "^overflow")`, `assert.fails: error "floored division by zero" does not match pattern "^overflow"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := starbox.New("test")
+			b.AddNamedModules("assert")
+			_, err := b.Run(tt.script)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("expect nil, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Errorf("expect error %q, got nil", tt.wantErr)
+				return
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expect error %q, got %v", tt.wantErr, err)
+			}
+			if !strings.Contains(err.Error(), "box.star:1:") {
+				t.Errorf("expect error with location, got %v", err)
+			}
+		})
+	}
+}
+
+// TestAssertModule_Load tests the assert module is only available when added, and can be loaded lazily.
+func TestAssertModule_Load(t *testing.T) {
+	b := starbox.New("test")
+	if _, err := b.Run(`assert.true(True)`); err == nil {
+		t.Error("expect error for missing assert module, got nil")
+	}
+
+	b2 := starbox.New("test")
+	b2.AddNamedModules("assert")
+	if _, err := b2.Run(hereDoc(`
+		load("assert", "eq")
+		eq(1, 1)
+	`)); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+	if es := []string{"assert"}; !reflect.DeepEqual(es, b2.GetModuleNames()) {
+		t.Errorf("expect %v, got %v", es, b2.GetModuleNames())
+	}
+}
@@ -0,0 +1,268 @@
+package starbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/1set/starlet"
+	"github.com/1set/starlight/convert"
+	"go.starlark.net/starlark"
+)
+
+// emitter sends values from Starlark scripts to a Go channel, the lock guards the closed flag against the sends, so it's never sent to once closed.
+type emitter struct {
+	mu     sync.Mutex
+	ch     chan<- interface{}
+	closed bool
+}
+
+// builtin returns the Starlark builtin function emit(value) which sends the converted value to the channel.
+// It blocks until the value is received, or the context of the run is done.
+func (e *emitter) builtin() *starlark.Builtin {
+	return starlark.NewBuiltin("emit", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var val starlark.Value
+		if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &val); err != nil {
+			return nil, err
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.closed {
+			return nil, fmt.Errorf("%s: channel is closed", fn.Name())
+		}
+
+		ctx, ok := thread.Local("context").(context.Context)
+		if !ok || ctx == nil {
+			ctx = context.Background()
+		}
+		select {
+		case e.ch <- convert.FromValue(val):
+			return starlark.None, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s: %w", fn.Name(), ctx.Err())
+		}
+	})
+}
+
+// close closes the channel once.
+func (e *emitter) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.closed {
+		e.closed = true
+		close(e.ch)
+	}
+}
+
+// AddEmitChannel adds a builtin function emit(value) for scripts to push converted values onto the given channel during execution.
+// The channel is closed when the run finishes, so consumers can range over it while the script is running, and later calls of emit() fail.
+// It's not shared with the boxes cloned by RunParallel().
+// It panics if called after execution.
+func (s *Starbox) AddEmitChannel(ch chan<- interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add emit channel") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add emit channel after execution")
+	}
+	s.markChanged()
+	if ch == nil {
+		s.emitter = nil
+		return
+	}
+	s.emitter = &emitter{ch: ch}
+}
+
+// printer sends messages printed by Starlark scripts to a Go channel, the lock guards the closed flag against the sends, so it's never sent to once closed.
+type printer struct {
+	mu       sync.Mutex
+	ch       chan string
+	drop     bool
+	closed   bool
+	fallback starlet.PrintFunc
+}
+
+// print sends the message to the channel, it's used as the print function of the machine.
+// It drops the message if the channel is full and dropping is enabled, otherwise it blocks until the message is received, or the context of the run is done.
+// Once the channel is closed, the message goes to the fallback print function instead.
+func (p *printer) print(thread *starlark.Thread, msg string) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		if p.fallback != nil {
+			p.fallback(thread, msg)
+		}
+		return
+	}
+	defer p.mu.Unlock()
+
+	if p.drop {
+		select {
+		case p.ch <- msg:
+		default:
+		}
+		return
+	}
+
+	ctx, ok := thread.Local("context").(context.Context)
+	if !ok || ctx == nil {
+		ctx = context.Background()
+	}
+	select {
+	case p.ch <- msg:
+	case <-ctx.Done():
+	}
+}
+
+// close closes the channel once.
+func (p *printer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.ch)
+	}
+}
+
+// PrintChannel installs a print function that pushes each message printed by scripts onto the returned channel as it happens, with the given buffer size.
+// The channel is closed when the first run finishes, so consumers can range over it while the script is running, and the prints of the later runs fall back to the print function set by SetPrintFunc() or the default one, instead of being lost silently.
+// If the channel is full, print() blocks until the message is received or the run is cancelled, or drops the message if SetPrintChannelDrop(true) is set.
+// It overrides the print function set by SetPrintFunc() while the channel is open, and it's not shared with the boxes cloned by RunParallel().
+// It panics if called after execution.
+func (s *Starbox) PrintChannel(buffer int) <-chan string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set print channel") {
+		return nil
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set print channel after execution")
+	}
+	s.markChanged()
+	if buffer < 0 {
+		buffer = 0
+	}
+	s.printer = &printer{ch: make(chan string, buffer), drop: s.printDrop}
+	return s.printer.ch
+}
+
+// SetPrintChannelDrop sets whether to drop the messages instead of blocking when the channel of PrintChannel() is full.
+// It panics if called after execution.
+func (s *Starbox) SetPrintChannelDrop(drop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set print channel drop") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set print channel drop after execution")
+	}
+	s.markChanged()
+	s.printDrop = drop
+	if s.printer != nil {
+		s.printer.drop = drop
+	}
+}
+
+// chanIterable is a Starlark iterable draining a Go channel, each received value is converted like AddKeyValue.
+// It's bound to the box, so the iteration can be aborted by the context of the run.
+type chanIterable struct {
+	name string
+	ch   <-chan interface{}
+	box  *Starbox
+}
+
+var (
+	_ starlark.Iterable = (*chanIterable)(nil)
+)
+
+func (c *chanIterable) String() string        { return fmt.Sprintf("<channel %q>", c.name) }
+func (c *chanIterable) Type() string          { return "channel" }
+func (c *chanIterable) Freeze()               {}
+func (c *chanIterable) Truth() starlark.Bool  { return starlark.True }
+func (c *chanIterable) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", c.Type()) }
+
+// Iterate returns an iterator receiving values from the channel.
+func (c *chanIterable) Iterate() starlark.Iterator {
+	return &chanIterator{c}
+}
+
+// chanIterator receives values from the channel until it's closed, or the run is cancelled.
+type chanIterator struct {
+	*chanIterable
+}
+
+// Next blocks until a value is received from the channel, it returns false if the channel is closed or the context of the run is done.
+// If the context is done or the value can't be converted, it cancels the thread with the error, so the run fails.
+func (it *chanIterator) Next(p *starlark.Value) bool {
+	thread := it.box.runThread
+	ctx := context.Background()
+	if thread != nil {
+		if c, ok := thread.Local("context").(context.Context); ok && c != nil {
+			ctx = c
+		}
+	}
+
+	select {
+	case v, ok := <-it.ch:
+		if !ok {
+			return false
+		}
+		sv, err := it.box.ToStarlark(v)
+		if err != nil {
+			if thread != nil {
+				thread.Cancel(fmt.Sprintf("channel %s: %v", it.name, err))
+			}
+			return false
+		}
+		*p = sv
+		return true
+	case <-ctx.Done():
+		// cancel the thread as well, so the run fails instead of going on after the loop
+		if thread != nil {
+			thread.Cancel(fmt.Sprintf("channel %s: %v", it.name, ctx.Err()))
+		}
+		return false
+	}
+}
+
+// Done does nothing, since the channel is owned by the sender.
+func (it *chanIterator) Done() {}
+
+// AddChannel exposes the given Go channel as a Starlark iterable with the given name, so scripts can drain it via `for x in name:`, and each value is converted like AddKeyValue.
+// The iteration blocks while waiting for values, and ends when the channel is closed. If the context of the run is cancelled, e.g. by timeout, the iteration is aborted and the run fails.
+// It returns an error if the name is empty or the channel is nil, ErrClosed if the box is closed, or an error wrapping ErrFrozen if the box is frozen.
+// It panics if called after execution.
+func (s *Starbox) AddChannel(name string, ch <-chan interface{}) error {
+	if name == "" {
+		return errors.New("empty channel name")
+	}
+	if ch == nil {
+		return fmt.Errorf("nil channel: %s", name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkChange("add channel"); err != nil {
+		return err
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add channel after execution")
+	}
+	s.markChanged()
+	if s.chans == nil {
+		s.chans = make(map[string]<-chan interface{})
+	}
+	s.chans[name] = ch
+	return nil
+}
@@ -0,0 +1,215 @@
+package starbox_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1set/starbox"
+	"go.starlark.net/starlark"
+)
+
+// TestAddEmitChannel tests the following:
+// 1. Create a new Starbox instance with an emit channel.
+// 2. Consume the values while the script is running.
+// 3. Check the channel is closed after the run, and emit fails in later runs.
+func TestAddEmitChannel(t *testing.T) {
+	ch := make(chan interface{})
+	b := starbox.New("test")
+	b.AddEmitChannel(ch)
+
+	var got []interface{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := range ch {
+			got = append(got, v)
+		}
+	}()
+
+	out, err := b.Run(hereDoc(`
+		for i in range(3):
+			emit(i * 10)
+		emit("end")
+		emit([1, 2])
+		x = 1
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["x"] != int64(1) {
+		t.Errorf("expect x=1, got %v", out["x"])
+	}
+
+	<-done
+	if es := []interface{}{int64(0), int64(10), int64(20), "end", []interface{}{int64(1), int64(2)}}; !reflect.DeepEqual(got, es) {
+		t.Errorf("expect %v, got %v", es, got)
+	}
+
+	if _, err := b.Run(`emit(1)`); err == nil {
+		t.Error("expect error for closed channel, got nil")
+	}
+}
+
+// TestAddEmitChannel_Timeout tests the emit function does not block forever if no one receives.
+func TestAddEmitChannel_Timeout(t *testing.T) {
+	ch := make(chan interface{})
+	b := starbox.New("test")
+	b.AddEmitChannel(ch)
+	_, err := b.CreateRunConfig().Script(`emit(1)`).Timeout(50 * time.Millisecond).Execute()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Error("expect channel closed")
+	}
+}
+
+// TestPrintChannel tests the following:
+// 1. Create a new Starbox instance with a print channel.
+// 2. Consume the printed messages while the script is running.
+// 3. Check the channel is closed after the run, and later prints fall back to the print function.
+func TestPrintChannel(t *testing.T) {
+	var printed []string
+	b := starbox.New("test")
+	b.SetPrintFunc(func(_ *starlark.Thread, msg string) {
+		printed = append(printed, msg)
+	})
+	ch := b.PrintChannel(1)
+
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for s := range ch {
+			got = append(got, s)
+		}
+	}()
+
+	if _, err := b.Run(hereDoc(`
+		for i in range(3):
+			print("line", i)
+		print("end")
+	`)); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+
+	<-done
+	if es := []string{"line 0", "line 1", "line 2", "end"}; !reflect.DeepEqual(got, es) {
+		t.Errorf("expect %v, got %v", es, got)
+	}
+
+	if _, err := b.Run(`print("again")`); err != nil {
+		t.Errorf("expect nil for later prints, got %v", err)
+	}
+	if es := []string{"again"}; !reflect.DeepEqual(printed, es) {
+		t.Errorf("expect later prints %v, got %v", es, printed)
+	}
+}
+
+// TestPrintChannel_Drop tests the messages are dropped instead of blocking if the channel is full and dropping is enabled.
+func TestPrintChannel_Drop(t *testing.T) {
+	b := starbox.New("test")
+	b.SetPrintChannelDrop(true)
+	ch := b.PrintChannel(2)
+	if _, err := b.Run(hereDoc(`
+		for i in range(10):
+			print(i)
+	`)); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+
+	var got []string
+	for s := range ch {
+		got = append(got, s)
+	}
+	if es := []string{"0", "1"}; !reflect.DeepEqual(got, es) {
+		t.Errorf("expect %v, got %v", es, got)
+	}
+}
+
+// TestPrintChannel_Timeout tests the print function does not block forever if no one receives.
+func TestPrintChannel_Timeout(t *testing.T) {
+	b := starbox.New("test")
+	ch := b.PrintChannel(0)
+	_, err := b.CreateRunConfig().Script(hereDoc(`
+		print("blocked")
+		for i in range(1000000000):
+			pass
+	`)).Timeout(50 * time.Millisecond).Execute()
+	if err == nil {
+		t.Error("expect error for timeout, got nil")
+	}
+	if _, ok := <-ch; ok {
+		t.Error("expect channel closed")
+	}
+}
+
+// TestAddChannel tests the following:
+// 1. Create a new Starbox instance with a channel fed from Go.
+// 2. Run a script iterating over the channel until it's closed.
+// 3. Check the values are converted and received in order.
+func TestAddChannel(t *testing.T) {
+	ch := make(chan interface{})
+	b := starbox.New("test")
+	if err := b.AddChannel("", ch); err == nil {
+		t.Error("expect error for empty name, got nil")
+	}
+	if err := b.AddChannel("source", nil); err == nil {
+		t.Error("expect error for nil channel, got nil")
+	}
+	if err := b.AddChannel("source", ch); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+
+	go func() {
+		defer close(ch)
+		for _, v := range []interface{}{1, "two", []byte("3"), 4.5} {
+			ch <- v
+		}
+	}()
+	out, err := b.Run(hereDoc(`
+		got = []
+		for x in source:
+			got.append(type(x))
+		kind = type(source)
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := []interface{}{"int", "string", "bytes", "float"}; !reflect.DeepEqual(out["got"], es) {
+		t.Errorf("expect %v, got %v", es, out["got"])
+	}
+	if out["kind"] != "channel" {
+		t.Errorf("expect channel type, got %v", out["kind"])
+	}
+}
+
+// TestAddChannel_Timeout tests the iteration is aborted when the context of the run is done.
+func TestAddChannel_Timeout(t *testing.T) {
+	ch := make(chan interface{})
+	b := starbox.New("test")
+	if err := b.AddChannel("source", ch); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	start := time.Now()
+	_, err := b.CreateRunConfig().Script(hereDoc(`
+		for x in source:
+			pass
+		done = True
+	`)).Timeout(50 * time.Millisecond).Execute()
+	if err == nil {
+		t.Error("expect error for timeout, got nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect prompt return, took %v", elapsed)
+	}
+}
@@ -0,0 +1,382 @@
+package starbox
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"time"
+
+	"github.com/1set/starlet"
+	"github.com/1set/starlet/dataconv"
+	"github.com/1set/starlight/convert"
+	"go.starlark.net/starlark"
+)
+
+// ToStarlark converts the given Go value into a Starlark value, in the same way as AddKeyValue does, i.e. with the configured struct tag for struct fields.
+// It doesn't acquire the lock of the box, so it's safe to call in custom builtins or module functions during execution.
+func (s *Starbox) ToStarlark(v interface{}) (starlark.Value, error) {
+	return convert.ToValueWithTag(convertInput(v, s.timeMode), s.structTag)
+}
+
+// FromStarlark converts the given Starlark value into a Go value like the output of Run is converted, including the big integers by SetBigIntOutput().
+// It's stricter than Run, which passes the values it can't convert through as is: it returns an error if the value or any of its elements can't be converted into a Go value, e.g. functions, modules or other custom types.
+// Like ToStarlark, it doesn't acquire the lock of the box, so it's safe to call in custom builtins or module functions during execution.
+func (s *Starbox) FromStarlark(v starlark.Value) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	r := convert.FromValue(v)
+	if err := checkConverted(r); err != nil {
+		return nil, err
+	}
+	if s.bigOut {
+		r = convertBigOutput(r)
+	}
+	return r, nil
+}
+
+// convertInput converts the given Go value into a value the machine can convert into the expected Starlark value, or returns it as is.
+// It converts []byte into starlark.Bytes instead of a list of integers, and big numbers into Starlark numbers instead of Go structs:
+// *big.Int becomes an arbitrary-precision starlark.Int, *big.Rat becomes starlark.Int if it's an integer, or starlark.Float otherwise.
+// Time values are converted according to the given time mode.
+func convertInput(v interface{}, tm TimeMode) interface{} {
+	if tv, ok := convertTime(v, tm); ok {
+		return tv
+	}
+	switch t := v.(type) {
+	case []byte:
+		return starlark.Bytes(t)
+	case *big.Int:
+		if t == nil {
+			return starlark.None
+		}
+		return starlark.MakeBigInt(t)
+	case big.Int:
+		return starlark.MakeBigInt(&t)
+	case *big.Rat:
+		if t == nil {
+			return starlark.None
+		}
+		return convertBigRat(t)
+	case big.Rat:
+		return convertBigRat(&t)
+	default:
+		return v
+	}
+}
+
+// convertInputs returns a copy of the given key-value pairs with values converted by convertInput, or nil if the map is nil.
+func convertInputs(m starlet.StringAnyMap, tm TimeMode) starlet.StringAnyMap {
+	if m == nil {
+		return nil
+	}
+	n := make(starlet.StringAnyMap, len(m))
+	for k, v := range m {
+		n[k] = convertInput(v, tm)
+	}
+	return n
+}
+
+// TimeMode defines how time.Time and time.Duration values are converted into Starlark values on input.
+type TimeMode uint8
+
+const (
+	// TimeModeNative converts time.Time into the Time value of the time module, and keeps time.Duration as a wrapped Go value, it's the default.
+	TimeModeNative TimeMode = iota
+	// TimeModeISO8601 converts time.Time into an ISO-8601 string in RFC 3339 format with nanoseconds, and time.Duration into a string like "1h30m0s".
+	TimeModeISO8601
+	// TimeModeUnix converts time.Time into an int of Unix seconds, and time.Duration into a float of seconds.
+	TimeModeUnix
+)
+
+// SetTimeConversion sets how time.Time and time.Duration values are converted on input, i.e. the values added by AddKeyValue() and the extras of RunnerConfig.
+// It applies to the values themselves and their pointers, but not to the fields of structs or elements of maps and slices, which are converted lazily when accessed.
+// It panics if called after execution.
+func (s *Starbox) SetTimeConversion(mode TimeMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set time conversion") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set time conversion after execution")
+	}
+	s.markChanged()
+	s.timeMode = mode
+}
+
+// convertTime converts the time.Time or time.Duration value according to the time mode, it returns false if the value is not converted.
+func convertTime(v interface{}, tm TimeMode) (interface{}, bool) {
+	if tm == TimeModeNative {
+		return nil, false
+	}
+	switch t := v.(type) {
+	case *time.Time:
+		if t == nil {
+			return starlark.None, true
+		}
+		return convertTime(*t, tm)
+	case *time.Duration:
+		if t == nil {
+			return starlark.None, true
+		}
+		return convertTime(*t, tm)
+	case time.Time:
+		if tm == TimeModeUnix {
+			return starlark.MakeInt64(t.Unix()), true
+		}
+		return starlark.String(t.Format(time.RFC3339Nano)), true
+	case time.Duration:
+		if tm == TimeModeUnix {
+			return starlark.Float(t.Seconds()), true
+		}
+		return starlark.String(t.String()), true
+	}
+	return nil, false
+}
+
+// SetBigIntOutput sets whether the integers of the output beyond the range of int64 are always converted into *big.Int.
+// By default, the integers that fit int64 become int64, the ones that fit uint64 become uint64, and larger ones become *big.Int, so the type depends on the magnitude.
+// If it's enabled, the uint64 ones become *big.Int as well, including the elements of lists and the values of dicts, while the integers that fit int64 still become int64.
+// It panics if called after execution.
+func (s *Starbox) SetBigIntOutput(asBig bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set big int output") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set big int output after execution")
+	}
+	s.markChanged()
+	s.bigOut = asBig
+}
+
+// convertBigOutputs converts the uint64 values of the output into *big.Int in place, including the nested ones.
+func convertBigOutputs(m starlet.StringAnyMap) {
+	for k, v := range m {
+		m[k] = convertBigOutput(v)
+	}
+}
+
+// convertBigOutput converts the uint64 value into *big.Int, and the elements of slices and the values of maps in place.
+func convertBigOutput(v interface{}) interface{} {
+	switch t := v.(type) {
+	case uint64:
+		return new(big.Int).SetUint64(t)
+	case []interface{}:
+		for i, e := range t {
+			t[i] = convertBigOutput(e)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range t {
+			t[k] = convertBigOutput(e)
+		}
+	}
+	return v
+}
+
+// convertBigRat converts a big.Rat into starlark.Int if it's an integer, or the nearest starlark.Float otherwise.
+func convertBigRat(r *big.Rat) starlark.Value {
+	if r.IsInt() {
+		return starlark.MakeBigInt(r.Num())
+	}
+	f, _ := r.Float64()
+	return starlark.Float(f)
+}
+
+// checkConverted returns an error if the given converted value still contains any Starlark values which convert.FromValue can't convert.
+func checkConverted(v interface{}) error {
+	switch t := v.(type) {
+	case starlark.Value:
+		return fmt.Errorf("cannot convert %s into Go value", t.Type())
+	case []interface{}:
+		for _, e := range t {
+			if err := checkConverted(e); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]interface{}:
+		for k, e := range t {
+			if err := checkConverted(k); err != nil {
+				return err
+			}
+			if err := checkConverted(e); err != nil {
+				return err
+			}
+		}
+	case map[interface{}]bool:
+		for k := range t {
+			if err := checkConverted(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	valueType = reflect.TypeOf((*starlark.Value)(nil)).Elem()
+)
+
+// typedBuiltin adapts the given Go function into a Starlark builtin with reflection, it returns false if fn is not a function.
+// The arguments are converted into the types of parameters via dataconv.Unmarshal(), and the results are converted via dataconv.Marshal() or like ToStarlark() if it fails.
+func (s *Starbox) typedBuiltin(name string, fn interface{}) (*starlark.Builtin, bool) {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return nil, false
+	}
+	ft := fv.Type()
+	numIn := ft.NumIn()
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		// check arity
+		if len(kwargs) > 0 {
+			return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+		}
+		if ft.IsVariadic() {
+			if len(args) < numIn-1 {
+				return nil, fmt.Errorf("%s: got %d arguments, want at least %d", b.Name(), len(args), numIn-1)
+			}
+		} else if len(args) != numIn {
+			return nil, fmt.Errorf("%s: got %d arguments, want %d", b.Name(), len(args), numIn)
+		}
+
+		// convert arguments
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var pt reflect.Type
+			if ft.IsVariadic() && i >= numIn-1 {
+				pt = ft.In(numIn - 1).Elem()
+			} else {
+				pt = ft.In(i)
+			}
+			av, err := funcArg(arg, pt)
+			if err != nil {
+				return nil, fmt.Errorf("%s: for parameter %d: %w", b.Name(), i+1, err)
+			}
+			in[i] = av
+		}
+
+		// call and convert results
+		out := fv.Call(in)
+		if n := len(out); n > 0 && ft.Out(n-1) == errorType {
+			if err, _ := out[n-1].Interface().(error); err != nil {
+				return nil, fmt.Errorf("%s: %w", b.Name(), err)
+			}
+			out = out[:n-1]
+		}
+		res := make(starlark.Tuple, len(out))
+		for i, ov := range out {
+			v := ov.Interface()
+			if sv, ok := v.(starlark.Value); ok && sv != nil {
+				res[i] = sv
+				continue
+			}
+			sv, err := dataconv.Marshal(v)
+			if err != nil {
+				if sv, err = s.ToStarlark(v); err != nil {
+					return nil, fmt.Errorf("%s: for result %d: %w", b.Name(), i+1, err)
+				}
+			}
+			res[i] = sv
+		}
+		switch len(res) {
+		case 0:
+			return starlark.None, nil
+		case 1:
+			return res[0], nil
+		default:
+			return res, nil
+		}
+	}), true
+}
+
+// funcArg converts the given Starlark value into a Go value of the given type, the Starlark values are passed as is if the type accepts them except interface{}.
+func funcArg(arg starlark.Value, t reflect.Type) (reflect.Value, error) {
+	if isEmptyIface := t.Kind() == reflect.Interface && t.NumMethod() == 0; !isEmptyIface && reflect.TypeOf(arg).AssignableTo(t) {
+		return reflect.ValueOf(arg), nil
+	}
+	if t.Implements(valueType) {
+		return reflect.Value{}, fmt.Errorf("got %s, want %s", arg.Type(), t)
+	}
+	v, err := dataconv.Unmarshal(arg)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("got %s, want %s: %w", arg.Type(), t, err)
+	}
+	rv, ok := funcArgValue(v, t)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("got %s, want %s", arg.Type(), t)
+	}
+	return rv, nil
+}
+
+// funcArgValue converts the given Go value from dataconv.Unmarshal() into a value of the given type, it returns false if it can't be converted losslessly.
+func funcArgValue(v interface{}, t reflect.Type) (reflect.Value, bool) {
+	if v == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map:
+			return reflect.Zero(t), true
+		}
+		return reflect.Value{}, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type().AssignableTo(t) {
+		return rv, true
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String:
+		if rv.Kind() == t.Kind() {
+			return rv.Convert(t), true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Kind() == reflect.Int && !reflect.Zero(t).OverflowInt(rv.Int()) {
+			return rv.Convert(t), true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Kind() == reflect.Int && rv.Int() >= 0 && !reflect.Zero(t).OverflowUint(uint64(rv.Int())) {
+			return rv.Convert(t), true
+		}
+	case reflect.Float32, reflect.Float64:
+		if rv.Kind() == reflect.Int || rv.Kind() == reflect.Float64 {
+			return rv.Convert(t), true
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && rv.Kind() == reflect.String {
+			return rv.Convert(t), true
+		}
+		if rv.Kind() != reflect.Slice {
+			break
+		}
+		sv := reflect.MakeSlice(t, rv.Len(), rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			ev, ok := funcArgValue(rv.Index(i).Interface(), t.Elem())
+			if !ok {
+				return reflect.Value{}, false
+			}
+			sv.Index(i).Set(ev)
+		}
+		return sv, true
+	case reflect.Map:
+		if rv.Kind() != reflect.Map {
+			break
+		}
+		mv := reflect.MakeMapWithSize(t, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			kv, ok := funcArgValue(iter.Key().Interface(), t.Key())
+			if !ok {
+				return reflect.Value{}, false
+			}
+			ev, ok := funcArgValue(iter.Value().Interface(), t.Elem())
+			if !ok {
+				return reflect.Value{}, false
+			}
+			mv.SetMapIndex(kv, ev)
+		}
+		return mv, true
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,301 @@
+package starbox_test
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1set/starbox"
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+// TestConvertBytes tests the following:
+// 1. Add []byte values as key-value pairs and run config extras.
+// 2. Check they are bytes in Starlark.
+// 3. Check the bytes results are converted back into []byte.
+func TestConvertBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{"empty", []byte{}},
+		{"ascii", []byte("Aloha")},
+		{"non-ascii", []byte{0x00, 0x7f, 0x80, 0xe4, 0xbd, 0xa0, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := starbox.New("test")
+			b.AddKeyValue("data", tt.value)
+			out, err := b.CreateRunConfig().KeyValue("extra", tt.value).Script(hereDoc(`
+				t1 = type(data)
+				t2 = type(extra)
+				n = len(data)
+				same = data == extra
+				back = extra
+				copied = data[:]
+			`)).Execute()
+			if err != nil {
+				t.Errorf("expect nil, got %v", err)
+				return
+			}
+			if out["t1"] != "bytes" || out["t2"] != "bytes" {
+				t.Errorf("expect bytes type, got %v and %v", out["t1"], out["t2"])
+				return
+			}
+			if out["n"] != int64(len(tt.value)) {
+				t.Errorf("expect length %d, got %v", len(tt.value), out["n"])
+			}
+			if out["same"] != true {
+				t.Errorf("expect same bytes, got %v", out["same"])
+			}
+			for _, k := range []string{"back", "copied"} {
+				if bs, ok := out[k].([]byte); !ok || !bytes.Equal(bs, tt.value) {
+					t.Errorf("expect %s=%v, got %T(%v)", k, tt.value, out[k], out[k])
+				}
+			}
+		})
+	}
+}
+
+// TestConvertBigNumbers tests the following:
+// 1. Add big.Int and big.Rat values as key-value pairs.
+// 2. Check they are numbers in Starlark.
+// 3. Check the large integers survive the round trip without overflow.
+func TestConvertBigNumbers(t *testing.T) {
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	beyond := new(big.Int).Add(big.NewInt(math.MaxInt64), big.NewInt(1))
+	b := starbox.New("test")
+	b.AddKeyValues(starlet.StringAnyMap{
+		"huge":   huge,
+		"beyond": beyond,
+		"small":  big.NewInt(-42),
+		"whole":  big.NewRat(84, 2),
+		"half":   big.NewRat(1, 2),
+		"none":   (*big.Int)(nil),
+	})
+	out, err := b.Run(hereDoc(`
+		types = [type(huge), type(beyond), type(small), type(whole), type(half)]
+		h = huge + 1
+		b = beyond
+		s = small * 2
+		w = whole
+		f = half * 3
+		n = none
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := []interface{}{"int", "int", "int", "int", "float"}; !reflect.DeepEqual(out["types"], es) {
+		t.Errorf("expect %v, got %v", es, out["types"])
+	}
+	if h, ok := out["h"].(*big.Int); !ok || h.Cmp(new(big.Int).Add(huge, big.NewInt(1))) != 0 {
+		t.Errorf("expect h=%v+1, got %T(%v)", huge, out["h"], out["h"])
+	}
+	if es := uint64(math.MaxInt64) + 1; out["b"] != es {
+		t.Errorf("expect b=%d, got %T(%v)", es, out["b"], out["b"])
+	}
+	if es := int64(-84); out["s"] != es {
+		t.Errorf("expect s=%d, got %v", es, out["s"])
+	}
+	if es := int64(42); out["w"] != es {
+		t.Errorf("expect w=%d, got %v", es, out["w"])
+	}
+	if es := 1.5; out["f"] != es {
+		t.Errorf("expect f=%v, got %v", es, out["f"])
+	}
+	if out["n"] != nil {
+		t.Errorf("expect n=nil, got %v", out["n"])
+	}
+}
+
+// TestSetBigIntOutput tests the following:
+// 1. Run a script with integers of different magnitudes, with and without big int output.
+// 2. Check the integers beyond int64 are *big.Int when enabled, and uint64 for the ones fitting uint64 by default.
+func TestSetBigIntOutput(t *testing.T) {
+	script := hereDoc(`
+		small = 42
+		beyond = 1 << 63
+		huge = 1 << 100
+		nested = [(1 << 64) - 1, {"k": 1 << 63}]
+	`)
+	b := starbox.New("test")
+	out, err := b.Run(script)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := uint64(1) << 63; out["beyond"] != es {
+		t.Errorf("expect uint64 by default, got %T(%v)", out["beyond"], out["beyond"])
+	}
+
+	b = starbox.New("test")
+	b.SetBigIntOutput(true)
+	out, err = b.Run(script)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["small"] != int64(42) {
+		t.Errorf("expect int64 for small int, got %T(%v)", out["small"], out["small"])
+	}
+	isBig := func(v interface{}, es string) {
+		if bi, ok := v.(*big.Int); !ok || bi.String() != es {
+			t.Errorf("expect *big.Int %s, got %T(%v)", es, v, v)
+		}
+	}
+	isBig(out["beyond"], "9223372036854775808")
+	isBig(out["huge"], "1267650600228229401496703205376")
+	nested, ok := out["nested"].([]interface{})
+	if !ok || len(nested) != 2 {
+		t.Errorf("unexpected nested: %v", out["nested"])
+		return
+	}
+	isBig(nested[0], "18446744073709551615")
+	if m, ok := nested[1].(map[interface{}]interface{}); ok {
+		isBig(m["k"], "9223372036854775808")
+	} else {
+		t.Errorf("unexpected nested dict: %v", nested[1])
+	}
+}
+
+// TestToStarlark tests the following:
+// 1. Convert Go values into Starlark values with the struct tag of the box.
+// 2. Check the converted struct is accessed with the tagged field names in Starlark.
+// 3. Check bytes and big numbers are converted like AddKeyValue.
+func TestToStarlark(t *testing.T) {
+	type point struct {
+		X int `star:"x"`
+		Y int `star:"y"`
+	}
+	b := starbox.New("test")
+	b.SetStructTag("star")
+
+	pv, err := b.ToStarlark(&point{X: 1, Y: 2})
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	bv, err := b.ToStarlark([]byte("Aloha"))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if bv.Type() != "bytes" {
+		t.Errorf("expect bytes, got %s", bv.Type())
+	}
+	iv, err := b.ToStarlark(new(big.Int).Lsh(big.NewInt(1), 100))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if iv.String() != "1267650600228229401496703205376" {
+		t.Errorf("expect 2**100, got %s", iv.String())
+	}
+
+	b.AddKeyStarlarkValue("pt", pv)
+	out, err := b.Run(hereDoc(`
+		s = pt.x + pt.y
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := int64(3); out["s"] != es {
+		t.Errorf("expect %v, got %v", es, out["s"])
+	}
+}
+
+// TestFromStarlark tests the following:
+// 1. Convert Starlark values into Go values like the output of Run.
+// 2. Check the values with non-convertible elements return an error.
+func TestFromStarlark(t *testing.T) {
+	b := starbox.New("test")
+	tests := []struct {
+		name    string
+		value   starlark.Value
+		want    interface{}
+		wantErr bool
+	}{
+		{"nil", nil, nil, false},
+		{"none", starlark.None, nil, false},
+		{"int", starlark.MakeInt(42), int64(42), false},
+		{"string", starlark.String("Aloha"), "Aloha", false},
+		{"bytes", starlark.Bytes("mahalo"), []byte("mahalo"), false},
+		{"list", starlark.NewList([]starlark.Value{starlark.MakeInt(1), starlark.String("two")}), []interface{}{int64(1), "two"}, false},
+		{"builtin", starlark.NewBuiltin("f", nil), nil, true},
+		{"nested builtin", starlark.Tuple{starlark.MakeInt(1), starlark.NewBuiltin("f", nil)}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.FromStarlark(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expect error %v, got %v", tt.wantErr, err)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expect %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	// big integers as the output of Run
+	big1 := new(big.Int).Lsh(big.NewInt(1), 63)
+	b2 := starbox.New("test")
+	b2.SetBigIntOutput(true)
+	got, err := b2.FromStarlark(starlark.NewList([]starlark.Value{starlark.MakeBigInt(big1)}))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if l, ok := got.([]interface{}); !ok || len(l) != 1 {
+		t.Errorf("expect list of one, got %v", got)
+	} else if bi, ok := l[0].(*big.Int); !ok || bi.Cmp(big1) != 0 {
+		t.Errorf("expect %v, got %T %v", big1, l[0], l[0])
+	}
+}
+
+// TestSetTimeConversion tests the following:
+// 1. Create new Starbox instances with different time conversion modes.
+// 2. Add time.Time and time.Duration values as key-value pairs and run config extras.
+// 3. Check the types and values in Starlark.
+func TestSetTimeConversion(t *testing.T) {
+	ts := time.Date(2024, 3, 15, 8, 30, 0, 500, time.UTC)
+	dur := 90 * time.Minute
+	tests := []struct {
+		name  string
+		mode  starbox.TimeMode
+		want  []interface{}
+		value []interface{}
+	}{
+		{"native", starbox.TimeModeNative, []interface{}{"time.time", "starlight_struct<*time.Time>", "starlight_interface<*time.Duration>"}, nil},
+		{"iso8601", starbox.TimeModeISO8601, []interface{}{"string", "string", "string"}, []interface{}{"2024-03-15T08:30:00.0000005Z", "2024-03-15T08:30:00.0000005Z", "1h30m0s"}},
+		{"unix", starbox.TimeModeUnix, []interface{}{"int", "int", "float"}, []interface{}{int64(1710491400), int64(1710491400), float64(5400)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := starbox.New("test")
+			b.SetTimeConversion(tt.mode)
+			b.AddKeyValue("ts", ts)
+			b.AddKeyValue("dur", &dur)
+			out, err := b.CreateRunConfig().KeyValue("tp", &ts).Script(hereDoc(`
+				types = [type(ts), type(tp), type(dur)]
+				values = [ts, tp, dur]
+			`)).Execute()
+			if err != nil {
+				t.Errorf("expect nil, got %v", err)
+				return
+			}
+			if !reflect.DeepEqual(out["types"], tt.want) {
+				t.Errorf("expect types %v, got %v", tt.want, out["types"])
+			}
+			if tt.value != nil && !reflect.DeepEqual(out["values"], tt.value) {
+				t.Errorf("expect values %v, got %v", tt.value, out["values"])
+			}
+		})
+	}
+}
@@ -1,9 +1,17 @@
 package starbox
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,7 +19,9 @@ import (
 	"github.com/1set/starlet"
 	"github.com/1set/starlet/dataconv"
 	libhttp "github.com/1set/starlet/lib/http"
+	"github.com/1set/starlight/convert"
 	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
 	"go.uber.org/zap"
 )
 
@@ -31,58 +41,417 @@ type FuncMap map[string]StarlarkFunc
 // For non-existent modules, it should return (nil, nil) or (nil, error).
 type DynamicModuleLoader func(string) (starlet.ModuleLoader, error)
 
+// BulkDynamicModuleLoader is a function type that takes all the unresolved module names as input and returns the corresponding module loaders by name.
+// It works like DynamicModuleLoader, but is called only once before execution, so related modules can be looked up together.
+// The names missing from the returned map are treated as non-existent modules.
+type BulkDynamicModuleLoader func(names []string) (map[string]starlet.ModuleLoader, error)
+
 // Starbox is a wrapper of starlet.Machine with additional features.
 type Starbox struct {
-	_          DoNotCompare
-	mac        *starlet.Machine
-	mu         sync.RWMutex
-	hasExec    bool
-	execTimes  uint
-	name       string
-	structTag  string
-	printFunc  starlet.PrintFunc
-	globals    starlet.StringAnyMap
-	modSet     ModuleSetName
-	namedMods  []string
-	loadMods   starlet.ModuleLoaderMap
-	scriptMods map[string]string
-	modFS      fs.FS
-	modNames   []string
-	dynMods    DynamicModuleLoader
-	userLog    *zap.SugaredLogger
+	_           DoNotCompare
+	mac         *starlet.Machine
+	mu          sync.RWMutex
+	hasExec     bool
+	frozen      bool
+	closed      bool
+	envReady    bool
+	lastMods    *extractedMods
+	keptMods    *extractedMods
+	scriptName  string
+	scriptSrc   []byte
+	scriptFS    fs.FS
+	execTimes   uint
+	name        string
+	structTag   string
+	globals     starlet.StringAnyMap
+	frozenKeys  map[string]struct{}
+	frozenVals  starlark.StringDict
+	modSet      ModuleSetName
+	modSetMods  []string
+	namedMods   []string
+	globMods    []string
+	loadMods    starlet.ModuleLoaderMap
+	scriptMods  map[string]string
+	modFS       fs.FS
+	prefixFS    map[string]fs.FS
+	modsFS      fs.FS
+	scCache     starlet.ByteCache
+	modNames    []string
+	modValues   []starlark.Value
+	dynMods     DynamicModuleLoader
+	bulkMods    BulkDynamicModuleLoader
+	loadTimeout time.Duration
+	parMods     bool
+	modPrior    ModulePriority
+	modIntro    bool
+	include     bool
+	noReassign  bool
+	modsVar     string
+	userLog     *zap.SugaredLogger
+	boxLog      *zap.SugaredLogger
+	runOptions
+	emitter   *emitter
+	printer   *printer
+	warnings  []string
+	chans     map[string]<-chan interface{}
+	argv      []string
+	runCtx    context.Context
+	runThread *starlark.Thread
+	exitCode  int
+	exited    bool
+	lastOut   starlet.StringAnyMap
+	lastRes   starlark.StringDict
+	preEnv    starlark.StringDict
+	lastStats RunStats
+	version   uint64
+	leased    *poolLease
+}
+
+// runOptions are the settings of the box applied to the thread, the script and the output of each run, they're copied as a whole by clone().
+type runOptions struct {
+	thName    string
+	thLocals  map[string]interface{}
+	thConfig  func(*starlark.Thread)
+	ctxBinds  map[string]interface{}
+	scFilter  func(name string, src []byte) ([]byte, error)
+	maxDepth  int
+	withTrace bool
+	printFunc starlet.PrintFunc
+	printFmt  *printFormat
+	printDrop bool
+	printWarn bool
+	timeMode  TimeMode
+	bigOut    bool
+	globalFn  func(name string, value interface{})
+	outFn     func(starlet.StringAnyMap) starlet.StringAnyMap
+	exitFn    func(code int)
+	randSeed  int64
+	seeded    bool
+	clock     time.Time
+	fixClock  bool
+}
+
+// clone returns a copy of the options, the maps are copied and the other values are shared.
+func (o runOptions) clone() runOptions {
+	if o.thLocals != nil {
+		m := make(map[string]interface{}, len(o.thLocals))
+		for k, v := range o.thLocals {
+			m[k] = v
+		}
+		o.thLocals = m
+	}
+	if o.ctxBinds != nil {
+		m := make(map[string]interface{}, len(o.ctxBinds))
+		for k, v := range o.ctxBinds {
+			m[k] = v
+		}
+		o.ctxBinds = m
+	}
+	return o
 }
 
 // New creates a new Starbox instance with default settings.
 func New(name string) *Starbox {
-	return &Starbox{mac: newStarMachine(name), name: name}
+	cache := starlet.NewMemoryCache()
+	return &Starbox{mac: newStarMachine(name, cache), name: name, modSet: getDefaultModuleSet(), scCache: cache, modsVar: defaultModulesVarName}
+}
+
+// clone creates a new Starbox instance with a new machine and a copy of the settings, it's not frozen and has never been executed.
+func (s *Starbox) clone() *Starbox {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := New(s.name)
+	n.scCache = s.scCache
+	n.mac.SetScriptCache(s.scCache)
+	n.structTag = s.structTag
+	n.globals = s.globals.Clone()
+	n.modSet = s.modSet
+	n.modSetMods = append([]string(nil), s.modSetMods...)
+	n.namedMods = append([]string(nil), s.namedMods...)
+	n.globMods = append([]string(nil), s.globMods...)
+	n.loadMods = s.loadMods.Clone()
+	if s.scriptMods != nil {
+		n.scriptMods = make(map[string]string, len(s.scriptMods))
+		for k, v := range s.scriptMods {
+			n.scriptMods[k] = v
+		}
+	}
+	n.modFS = s.modFS
+	n.modsFS = s.modsFS
+	if s.frozenKeys != nil {
+		n.frozenKeys = make(map[string]struct{}, len(s.frozenKeys))
+		for k := range s.frozenKeys {
+			n.frozenKeys[k] = struct{}{}
+		}
+	}
+	if s.prefixFS != nil {
+		n.prefixFS = make(map[string]fs.FS, len(s.prefixFS))
+		for k, v := range s.prefixFS {
+			n.prefixFS[k] = v
+		}
+	}
+	n.dynMods = s.dynMods
+	n.bulkMods = s.bulkMods
+	n.loadTimeout = s.loadTimeout
+	n.parMods = s.parMods
+	n.modPrior = s.modPrior
+	n.modIntro = s.modIntro
+	n.include = s.include
+	n.noReassign = s.noReassign
+	n.modsVar = s.modsVar
+	n.userLog = s.userLog
+	n.boxLog = s.boxLog
+	n.runOptions = s.runOptions.clone()
+	if s.argv != nil {
+		n.argv = append([]string{}, s.argv...)
+	}
+	if s.chans != nil {
+		n.chans = make(map[string]<-chan interface{}, len(s.chans))
+		for k, v := range s.chans {
+			n.chans[k] = v
+		}
+	}
+	return n
 }
 
-func newStarMachine(name string) *starlet.Machine {
+const (
+	// defaultPrintLayout is the default time layout of the prefix of the default print function.
+	defaultPrintLayout = `15:04:05.000`
+)
+
+func newStarMachine(name string, cache starlet.ByteCache) *starlet.Machine {
 	m := starlet.NewDefault()
 	m.EnableGlobalReassign()
-	m.SetScriptCacheEnabled(true)
+	m.SetScriptCache(cache)
 	// m.SetInputConversionEnabled(false)
 	// m.SetOutputConversionEnabled(true)
-	m.SetPrintFunc(func(thread *starlark.Thread, msg string) {
-		prefix := fmt.Sprintf("[⭐|%s](%s)", name, time.Now().UTC().Format(`15:04:05.000`))
-		eprintln(prefix, msg)
-	})
+	m.SetPrintFunc(defaultPrintFunc(name, defaultPrintLayout, true))
 	return m
 }
 
+// defaultPrintFunc returns the default print function writing to stderr, with a prefix of the decoration and the UTC time in the given layout, e.g. "[⭐|name](15:04:05.000)".
+func defaultPrintFunc(name, layout string, decorate bool) starlet.PrintFunc {
+	return func(_ *starlark.Thread, msg string) {
+		var prefix string
+		if decorate {
+			prefix = fmt.Sprintf("[⭐|%s]", name)
+		}
+		if layout != "" {
+			ts := time.Now().UTC().Format(layout)
+			if decorate {
+				prefix += "(" + ts + ")"
+			} else {
+				prefix = ts
+			}
+		}
+		if prefix == "" {
+			eprintln(msg)
+			return
+		}
+		eprintln(prefix, msg)
+	}
+}
+
 // String returns the name of the Starbox instance.
 func (s *Starbox) String() string {
 	return fmt.Sprintf("🥡Box{name:%s,run:%d}", s.name, s.execTimes)
 }
 
-// Reset creates an new Starlet machine and keeps the settings.
+// Debug returns a multi-line human-readable dump of the settings and status of the box for troubleshooting, it doesn't execute anything.
+// Only the names of the globals are included, their values are never shown.
+func (s *Starbox) Debug() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	loaders := make([]string, 0, len(s.loadMods))
+	for k := range s.loadMods {
+		loaders = append(loaders, k)
+	}
+	scripts := make([]string, 0, len(s.scriptMods))
+	for k := range s.scriptMods {
+		scripts = append(scripts, k)
+	}
+	mounts := make([]string, 0, len(s.prefixFS))
+	for k := range s.prefixFS {
+		mounts = append(mounts, k)
+	}
+	globals := make([]string, 0, len(s.globals))
+	for k := range s.globals {
+		globals = append(globals, k)
+	}
+	for _, ss := range [][]string{loaders, scripts, mounts, globals} {
+		sort.Strings(ss)
+	}
+
+	var sb strings.Builder
+	line := func(key string, value interface{}) {
+		fmt.Fprintf(&sb, "  %-17s %v\n", key+":", value)
+	}
+	sb.WriteString(fmt.Sprintf("🥡Box{name:%s,run:%d}", s.name, s.execTimes))
+	sb.WriteString("\n")
+	line("name", s.name)
+	line("runs", s.execTimes)
+	line("executed", s.hasExec)
+	line("frozen", s.frozen)
+	line("closed", s.closed)
+	line("module set", s.modSet)
+	line("named modules", s.namedMods)
+	line("loader modules", loaders)
+	line("script modules", scripts)
+	line("module fs", mounts)
+	line("globals", globals)
+	line("struct tag", strconv.Quote(s.structTag))
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// Reset creates an new Starlet machine and keeps the settings, including the script cache, while the warnings of the last run are cleared.
+// It panics if the box is frozen, and it does nothing if the box is closed.
 func (s *Starbox) Reset() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("reset") {
+		return
+	}
 	//s.mac.Reset()
-	s.mac = newStarMachine(s.name)
+	s.reset()
+}
+
+// reset creates a new machine for the box and clears the runtime state, the kept modules are dropped as well.
+func (s *Starbox) reset() {
+	s.mac = newStarMachine(s.name, s.scCache)
+	s.hasExec = false
+	s.warnings = nil
+	s.discardEnv()
+	s.recordScript("", nil, nil)
+	s.keptMods = nil
+}
+
+// extractedMods holds the module loaders extracted for a machine, which can be reused by the next machine.
+type extractedMods struct {
+	preMods  starlet.ModuleLoaderList
+	lazyMods starlet.ModuleLoaderMap
+	modNames []string
+}
+
+// ResetPreserveModules creates a new Starlet machine like Reset(), but keeps the module loaders extracted for the current machine, so the next run skips extracting them again, e.g. resolving the dynamic modules.
+// It's useful for the boxes reset for each request with expensive module setups. The modules added or changed after the first run of the current machine are not picked up, except the module scripts which are not extracted as loaders, call Reset() to extract them again.
+// It works like Reset() if the box has not been executed yet, and the kept modules are dropped as well.
+// It panics if the box is frozen, and it does nothing if the box is closed.
+func (s *Starbox) ResetPreserveModules() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("reset") {
+		return
+	}
+	if s.closed {
+		return
+	}
+	if s.hasExec {
+		s.keptMods = s.lastMods
+	} else {
+		s.keptMods = nil
+	}
+	s.mac = newStarMachine(s.name, s.scCache)
 	s.hasExec = false
+	s.warnings = nil
+	s.discardEnv()
+	s.recordScript("", nil, nil)
+}
+
+// Close releases the underlying machine with its caches, and marks the box unusable, all the following Run*() will fail with ErrClosed, and the following setters and adders are ignored.
+// The emit channel is closed if it's not closed yet. It's safe to call Close() multiple times, and it always returns nil.
+func (s *Starbox) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.mac = nil
+	s.scCache = nil
+	s.lastOut, s.lastRes = nil, nil
+	if s.emitter != nil {
+		s.emitter.close()
+	}
+	if s.printer != nil {
+		s.printer.close()
+	}
+	return nil
+}
+
+// IsClosed returns true if the box is closed by Close().
+func (s *Starbox) IsClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.closed
+}
+
+var (
+	// ErrFrozen is the error for the setters returning errors when the box is frozen by Freeze().
+	ErrFrozen = errors.New("starbox is frozen")
+)
+
+// Freeze makes the box read-only, all the following setters, adders and Reset() will be rejected with a panic, while Run*() still works.
+// The setters returning errors return an error wrapping ErrFrozen as well if the panic is recovered, e.g. by the production logger.
+// Unlike the check for execution, it takes effect even before the first run, and it cannot be undone.
+func (s *Starbox) Freeze() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frozen = true
+}
+
+// IsFrozen returns true if the box is frozen by Freeze().
+func (s *Starbox) IsFrozen() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.frozen
+}
+
+// rejectChange checks if the box can be changed for the given action, it logs a DPanic message and returns true if the change should be rejected.
+// The changes on the closed box are rejected silently, since the machine is released.
+func (s *Starbox) rejectChange(action string) bool {
+	return s.checkChange(action) != nil
+}
+
+// checkChange is like rejectChange() for the setters returning errors, it returns ErrClosed for the closed box, and an error wrapping ErrFrozen for the frozen box.
+func (s *Starbox) checkChange(action string) error {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.frozen {
+		s.logger().DPanicf("cannot %s on frozen box", action)
+		return fmt.Errorf("cannot %s: %w", action, ErrFrozen)
+	}
+	return nil
+}
+
+// markChanged records an accepted change of the settings by bumping the version of them, and the environment prepared by Warmup() before execution is discarded, since it's going to be outdated.
+func (s *Starbox) markChanged() {
+	s.version++
+	if s.envReady && !s.hasExec && s.mac != nil {
+		s.mac = newStarMachine(s.name, s.scCache)
+		s.discardEnv()
+	}
+}
+
+// discardEnv clears the state derived from the settings by prepareEnv(), so the next preparation derives it again with the latest settings.
+// The filesystem of module scripts built by the preparation is dropped, while the one set by SetFS() is kept.
+func (s *Starbox) discardEnv() {
+	s.envReady = false
+	if s.modsFS != nil && s.modFS == s.modsFS {
+		s.modFS = nil
+	}
+	s.modsFS = nil
+	s.modNames = nil
+	s.frozenVals = nil
+	s.preEnv = nil
 }
 
 // GetMachine returns the underlying starlet.Machine instance.
@@ -106,6 +475,22 @@ func (s *Starbox) GetSteps() uint64 {
 	return 0
 }
 
+// GetThreadName returns the thread name set by SetThreadName(), it defaults to the name of the box, which is used in the prefix of the default print function.
+func (s *Starbox) GetThreadName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.threadName()
+}
+
+// threadName returns the configured thread name or the name of the box.
+func (s *Starbox) threadName() string {
+	if s.thName != "" {
+		return s.thName
+	}
+	return s.name
+}
+
 // GetModuleNames returns the names of the modules loaded after execution.
 func (s *Starbox) GetModuleNames() []string {
 	s.mu.RLock()
@@ -119,21 +504,46 @@ func (s *Starbox) SetLogger(sl *zap.SugaredLogger) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("set logger") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot set logger after execution")
+		s.logger().DPanic("cannot set logger after execution")
 	}
+	s.markChanged()
 	s.userLog = sl
 }
 
+// SetAllowGlobalReassign sets whether scripts can reassign the global variables defined at the top level, and use if and for statements at the top level, it's allowed by default for compatibility.
+// If disallowed, assigning a global variable twice like "a = 1; a = 2" fails before execution. Note that Starlark always allows a script to define a global once with the same name as a predeclared one, which shadows it.
+// It panics if called after execution.
+func (s *Starbox) SetAllowGlobalReassign(allowed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set allow global reassign") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set allow global reassign after execution")
+	}
+	s.markChanged()
+	s.noReassign = !allowed
+}
+
 // SetStructTag sets the custom tag of Go struct fields for Starlark.
 // It panics if called after execution.
 func (s *Starbox) SetStructTag(tag string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("set tag") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot set tag after execution")
+		s.logger().DPanic("cannot set tag after execution")
 	}
+	s.markChanged()
 	s.structTag = tag
 }
 
@@ -143,40 +553,158 @@ func (s *Starbox) SetPrintFunc(printFunc starlet.PrintFunc) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("set print function") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot set print function after execution")
+		s.logger().DPanic("cannot set print function after execution")
 	}
+	s.markChanged()
 	s.printFunc = printFunc
 }
 
+// printFormat is the format of the prefix of the default print function.
+type printFormat struct {
+	layout   string
+	decorate bool
+}
+
+// SetPrintFormat sets the format of the prefix of the default print function, which is "[⭐|name](15:04:05.000)" with the name of the thread or box and the UTC time by default.
+// The layout is the time layout of the time package for the UTC time, and an empty layout disables the timestamp. The emoji and name decoration is included only if includeEmoji is true, so an empty layout without the decoration prints the plain messages.
+// It only affects the default print function, not the ones set by SetPrintFunc() or SetJSONPrint().
+// It panics if called after execution.
+func (s *Starbox) SetPrintFormat(layout string, includeEmoji bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set print format") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set print format after execution")
+	}
+	s.markChanged()
+	s.printFmt = &printFormat{layout: layout, decorate: includeEmoji}
+}
+
+// SetJSONPrint sets the print function for Starlark to write each print call as a line of JSON object to the given writer, with the name of the box as "name", the time in UTC and RFC3339Nano as "ts", which follows SetClock() if it's set, and the message as "msg".
+// It's a structured alternative to SetPrintFunc() and overrides it, the writes are serialized, and the write errors are ignored.
+// It panics if called after execution.
+func (s *Starbox) SetJSONPrint(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set print function") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set print function after execution")
+	}
+	s.markChanged()
+	var (
+		mu  sync.Mutex
+		enc = json.NewEncoder(w)
+	)
+	name := s.name
+	s.printFunc = func(thread *starlark.Thread, msg string) {
+		line := struct {
+			Name string `json:"name"`
+			TS   string `json:"ts"`
+			Msg  string `json:"msg"`
+		}{name, threadNow(thread).Format(time.RFC3339Nano), msg}
+
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(line)
+	}
+}
+
+// SetPrintAsWarnings sets whether to collect the print messages of scripts as warnings instead of printing them, which is a lightweight diagnostics channel without a custom logging module.
+// The warnings of the last run are returned by GetWarnings(), and RunStrict() fails if any warning is collected. It overrides SetPrintFunc(), SetJSONPrint() and the print channel.
+// It panics if called after execution.
+func (s *Starbox) SetPrintAsWarnings(collect bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set print as warnings") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set print as warnings after execution")
+	}
+	s.markChanged()
+	s.printWarn = collect
+}
+
+// SetOutputTransform sets the function to transform the converted output of each run before it's returned to the caller, e.g. to drop nil values or rename keys, and a nil function disables it.
+// It applies to all the Run*() methods and RunnerConfig, including the partial output of failed runs, but the typed getters like GetInt() and the global callback still see the output before transform.
+// It's called synchronously with the lock of the box held, so it must not call methods of the box.
+// It panics if called after execution.
+func (s *Starbox) SetOutputTransform(fn func(starlet.StringAnyMap) starlet.StringAnyMap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set output transform") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set output transform after execution")
+	}
+	s.markChanged()
+	s.outFn = fn
+}
+
+// SetGlobalCallback sets the function to call for each top-level global of the output after each run, with the converted Go value.
+// The globals are passed in the order of names, since the assignment order is not kept by Starlark, and a nil callback disables it.
+// It's called synchronously with the lock of the box held, so it must not call methods of the box.
+// It panics if called after execution.
+func (s *Starbox) SetGlobalCallback(fn func(name string, value interface{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set global callback") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set global callback after execution")
+	}
+	s.markChanged()
+	s.globalFn = fn
+}
+
 // SetFS sets the virtual filesystem for module scripts.
-// If it's not nil, it'll override all the scripts added by AddModuleScript().
+// If it's not nil, it'll override all the scripts added by AddModuleScript() and the filesystems added by AddModuleFS().
 // It panics if called after execution.
 func (s *Starbox) SetFS(hfs fs.FS) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("set filesystem") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot set filesystem after execution")
+		s.logger().DPanic("cannot set filesystem after execution")
 	}
+	s.markChanged()
 	s.modFS = hfs
 }
 
-// SetScriptCache sets custom cache provider for script content.
+// SetScriptCache sets custom cache provider for script content, and the cache is kept across Reset().
 // nil cache provider will disable script cache.
 // It panics if called after execution.
 func (s *Starbox) SetScriptCache(cache starlet.ByteCache) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.hasExec {
-		log.DPanic("cannot set script cache after execution")
+	if s.rejectChange("set script cache") {
+		return
 	}
-	if cache == nil {
-		s.mac.SetScriptCacheEnabled(false)
-	} else {
-		s.mac.SetScriptCache(cache)
+	if s.hasExec {
+		s.logger().DPanic("cannot set script cache after execution")
 	}
+	s.markChanged()
+	s.scCache = cache
+	s.mac.SetScriptCache(cache)
 }
 
 // SetDynamicModuleLoader sets the dynamic module loader for preload and lazyload modules.
@@ -185,22 +713,221 @@ func (s *Starbox) SetDynamicModuleLoader(loader DynamicModuleLoader) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("set dynamic module loader") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot set dynamic module loader after execution")
+		s.logger().DPanic("cannot set dynamic module loader after execution")
 	}
+	s.markChanged()
 	s.dynMods = loader
 }
 
+// SetBulkDynamicModuleLoader sets the dynamic module loader which resolves all the unknown module names in one lookup before execution.
+// If it's set, it's used instead of the loader set by SetDynamicModuleLoader(), and SetModuleLoadTimeout() and SetParallelModuleLoading() don't apply to it.
+// It panics if called after execution.
+func (s *Starbox) SetBulkDynamicModuleLoader(loader BulkDynamicModuleLoader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set bulk dynamic module loader") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set bulk dynamic module loader after execution")
+	}
+	s.markChanged()
+	s.bulkMods = loader
+}
+
+// SetModuleLoadTimeout sets the timeout for each lookup of the dynamic module loader, and the preparation fails with ErrModuleLoadTimeout naming the module if a lookup doesn't return in time.
+// The timeout applies to each module separately, not the whole resolution. Zero means no timeout, and it's the default.
+// It panics if called after execution.
+func (s *Starbox) SetModuleLoadTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set module load timeout") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set module load timeout after execution")
+	}
+	s.markChanged()
+	s.loadTimeout = d
+}
+
+// SetThreadName sets the name of the underlying Starlark thread for each run, it's shown in the prefix of the default print function and in the Thread field of the errors normalized by NormalizeError().
+// It's useful to distinguish interleaved output of concurrent boxes, and an empty name resets it to the name of the box, which is only used for the prints, and the thread keeps the default name of the machine.
+// It panics if called after execution.
+func (s *Starbox) SetThreadName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set thread name") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set thread name after execution")
+	}
+	s.markChanged()
+	s.thName = name
+}
+
+// SetThreadConfigurator sets the function to configure the underlying Starlark thread just before each run, e.g. to set the hook OnMaxSteps or the counter of execution steps, and a nil function disables it.
+// It's an escape hatch for the capabilities not wrapped by Starbox, and it runs last after all the thread settings of Starbox, so it can override them like the name and locals.
+// The print function and the "context" local are still set by the machine on each run.
+// It panics if called after execution.
+func (s *Starbox) SetThreadConfigurator(fn func(*starlark.Thread)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set thread configurator") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set thread configurator after execution")
+	}
+	s.markChanged()
+	s.thConfig = fn
+}
+
+// SetScriptFilter sets the function to inspect or rewrite each script before it's set for execution, and a nil function disables it.
+// It applies to all the entry points, e.g. Run(), RunTimeout(), RunFile() and the runner, and the content of script files is read from the filesystem for it, but not to the module scripts loaded by load().
+// The returned bytes replace the source of the script, and a returned error blocks the execution and is returned by the run method.
+// It panics if called after execution.
+func (s *Starbox) SetScriptFilter(fn func(name string, src []byte) ([]byte, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set script filter") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set script filter after execution")
+	}
+	s.markChanged()
+	s.scFilter = fn
+}
+
+// SetThreadLocal sets a thread-local value on the underlying Starlark thread before execution, so custom builtins can retrieve it via thread.Local(key).
+// If the key already exists, it will be overwritten. Keys used by the machine itself like "context" will be overridden by the machine on each run.
+// It panics if called after execution.
+func (s *Starbox) SetThreadLocal(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set thread local") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set thread local after execution")
+	}
+	s.markChanged()
+	if s.thLocals == nil {
+		s.thLocals = make(map[string]interface{})
+	}
+	s.thLocals[key] = value
+}
+
+// SetParallelModuleLoading enables or disables resolving the dynamic modules concurrently before execution, it's useful for dynamic module loaders that do I/O.
+// The dynamic module loader should be safe for concurrent use if enabled, and the order of the resolved modules remains the same. It's disabled by default.
+// It panics if called after execution.
+func (s *Starbox) SetParallelModuleLoading(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set parallel module loading") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set parallel module loading after execution")
+	}
+	s.markChanged()
+	s.parMods = enabled
+}
+
+// SetModulePriority sets the policy to resolve the name conflicts between starlet builtin modules and custom modules, the default is PriorityBuiltinWins.
+// It panics if called after execution.
+func (s *Starbox) SetModulePriority(policy ModulePriority) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set module priority") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set module priority after execution")
+	}
+	s.markChanged()
+	s.modPrior = policy
+}
+
 // SetModuleSet sets the module set to be loaded before execution.
 // It panics if called after execution.
 func (s *Starbox) SetModuleSet(modSet ModuleSetName) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("set module set") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set module set after execution")
+	}
+	s.markChanged()
+	s.modSet = modSet
+	s.modSetMods = nil
+}
+
+// SetModuleSetExcept sets the module set to be loaded before execution, but without the excluded module names.
+// Excluded names that are not in the module set are ignored. If the module set is unknown, it works like SetModuleSet() and fails on execution.
+// It panics if called after execution.
+func (s *Starbox) SetModuleSetExcept(modSet ModuleSetName, exclude ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set module set") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set module set after execution")
+	}
+	s.markChanged()
+	s.modSet = modSet
+	s.modSetMods = nil
+	if mods, err := getModuleSet(modSet); err == nil {
+		s.modSetMods = removeUniques(mods, exclude...)
+	}
+}
+
+// SetModuleSetWith sets the module set to be loaded before execution, with the additional starlet builtin modules.
+// It returns an error and changes nothing if the module set is unknown, or any of the included names is not a builtin module, and ErrClosed or an error wrapping ErrFrozen if the box is closed or frozen.
+// It panics if called after execution.
+func (s *Starbox) SetModuleSetWith(modSet ModuleSetName, include ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkChange("set module set"); err != nil {
+		return err
+	}
 	if s.hasExec {
-		log.DPanic("cannot set module set after execution")
+		s.logger().DPanic("cannot set module set after execution")
+	}
+	s.markChanged()
+	mods, err := getModuleSet(modSet)
+	if err != nil {
+		return err
+	}
+	builtins := stringsMapSet(fullModuleNames)
+	for _, name := range include {
+		if _, ok := builtins[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+		}
 	}
 	s.modSet = modSet
+	s.modSetMods = appendUniques(mods, include...)
+	return nil
 }
 
 // AddKeyValue adds a key-value pair to the global environment before execution.
@@ -210,13 +937,43 @@ func (s *Starbox) AddKeyValue(key string, value interface{}) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add key-value pair") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add key-value pair after execution")
+	}
+	s.markChanged()
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap)
+	}
+	s.globals[key] = value
+}
+
+// AddFrozenKeyValue adds a key-value pair to the global environment before execution like AddKeyValue(), and marks the key as read-only for scripts.
+// The converted value is frozen so it can't be mutated in place, and the run fails if the script assigns the key at the top level, even if global reassignment is allowed for other names.
+// The script assigning the key is rejected before execution by parsing and resolving it, and as a backstop, the assignment detected when the script finishes fails the run, restores the value for the following runs and removes the key from the output.
+// The key stays read-only if it's overwritten by other methods later.
+// It panics if called after execution.
+func (s *Starbox) AddFrozenKeyValue(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add frozen key-value pair") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add key-value pair after execution")
+		s.logger().DPanic("cannot add frozen key-value pair after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
+	if s.frozenKeys == nil {
+		s.frozenKeys = make(map[string]struct{})
+	}
 	s.globals[key] = value
+	s.frozenKeys[key] = struct{}{}
 }
 
 // AddKeyStarlarkValue adds a key-value pair to the global environment before execution, the value is a Starlark value.
@@ -226,15 +983,57 @@ func (s *Starbox) AddKeyStarlarkValue(key string, value starlark.Value) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add key-value pair") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add key-value pair after execution")
+		s.logger().DPanic("cannot add key-value pair after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
 	s.globals[key] = value
 }
 
+// SetArgs sets the command-line arguments for the script, they're injected as the global list of strings "argv" and its length "argc" before execution.
+// The globals are not injected unless it's called, and nil args means an empty list.
+// It panics if called after execution.
+func (s *Starbox) SetArgs(args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set args") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set args after execution")
+	}
+	s.markChanged()
+	s.argv = append([]string{}, args...)
+}
+
+// BindContextValue binds the value of the given key in the context of each run to the global variable with the given name, i.e. ctx.Value(ctxKey) is converted and injected as the global before the run.
+// The global is None if the context of the run lacks the key, or the run has no context, e.g. Run().
+// If the global name is already bound, the binding will be overwritten.
+// It panics if called after execution.
+func (s *Starbox) BindContextValue(ctxKey interface{}, globalName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("bind context value") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot bind context value after execution")
+	}
+	s.markChanged()
+	if s.ctxBinds == nil {
+		s.ctxBinds = make(map[string]interface{})
+	}
+	s.ctxBinds[globalName] = ctxKey
+}
+
 // AddKeyValues adds key-value pairs to the global environment before execution. Usually for output of Run()*.
 // For each key-value pair, if the key already exists, it will be overwritten.
 // It panics if called after execution.
@@ -242,9 +1041,13 @@ func (s *Starbox) AddKeyValues(keyValues starlet.StringAnyMap) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add key-value pairs") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add key-value pairs after execution")
+		s.logger().DPanic("cannot add key-value pairs after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
@@ -258,9 +1061,13 @@ func (s *Starbox) AddStarlarkValues(keyValues starlark.StringDict) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add key-value pairs") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add key-value pairs after execution")
+		s.logger().DPanic("cannot add key-value pairs after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
@@ -276,9 +1083,13 @@ func (s *Starbox) AddBuiltin(name string, starFunc StarlarkFunc) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add builtin") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add builtin after execution")
+		s.logger().DPanic("cannot add builtin after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
@@ -286,16 +1097,83 @@ func (s *Starbox) AddBuiltin(name string, starFunc StarlarkFunc) {
 	s.globals[name] = sb
 }
 
+// AddTypedFunc adds an ordinary Go function with name as a builtin to the global environment before execution, e.g. func(a int, b string) (float64, error), without writing the boilerplate of unpacking arguments.
+// The arguments are converted into the types of parameters via dataconv, including numbers, strings, bools, and slices and maps of them, and the Starlark values are passed as is for the parameters of Starlark types. Variadic functions are supported, but keyword arguments are not.
+// The results are converted back into Starlark values, a trailing error result is returned as the error of the call, no result means None and multiple results mean a tuple.
+// It logs a DPanic message and does nothing if fn is not a function. It panics if called after execution.
+func (s *Starbox) AddTypedFunc(name string, fn interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add typed func") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add typed func after execution")
+	}
+	s.markChanged()
+	sb, ok := s.typedBuiltin(name, fn)
+	if !ok {
+		s.logger().DPanicf("invalid typed func %s: %T", name, fn)
+		return
+	}
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap)
+	}
+	s.globals[name] = sb
+}
+
+// AddType adds a constructor of custom Starlark type with name to the global environment before execution, i.e. name(...) in scripts calls the constructor with the arguments converted to Go values, and returns the custom value.
+// The values of custom types implementing starlark.Value are kept as-is in the output, so they survive without conversion. Keyword arguments are not supported.
+// It panics if called after execution.
+func (s *Starbox) AddType(name string, constructor func(args ...interface{}) (starlark.Value, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add type") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add type after execution")
+	}
+	s.markChanged()
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap)
+	}
+	s.globals[name] = starlark.NewBuiltin(name, func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if len(kwargs) > 0 {
+			return nil, fmt.Errorf("%s: unexpected keyword arguments", fn.Name())
+		}
+		goArgs := make([]interface{}, len(args))
+		for i, arg := range args {
+			goArgs[i] = convert.FromValue(arg)
+		}
+		v, err := constructor(goArgs...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+		}
+		if v == nil {
+			return starlark.None, nil
+		}
+		return v, nil
+	})
+}
+
 // AddNamedModules adds builtin and custom modules by name to the preload and lazyload registry.
+// Besides the starlet builtin modules, it also accepts the modules shipped with starbox, i.e. "assert" for test scripts, and "meta" for the metadata of the box at run time.
 // It will not load the modules until the first run.
 // It panics if called after execution.
 func (s *Starbox) AddNamedModules(moduleNames ...string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add named modules") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add named modules after execution")
+		s.logger().DPanic("cannot add named modules after execution")
 	}
+	s.markChanged()
 	s.namedMods = append(s.namedMods, moduleNames...)
 }
 
@@ -304,6 +1182,29 @@ func (s *Starbox) AddModulesByName(moduleNames ...string) {
 	s.AddNamedModules(moduleNames...)
 }
 
+// AddNamedModulesGlob adds starlet builtin modules by glob patterns like "*" or "re*", which works like AddNamedModules() with the names matched.
+// The patterns are expanded against all starlet builtin module names in the preparation before execution, and the preparation fails with ErrModuleNotFound if any pattern matches nothing.
+// It logs a DPanic message and ignores the malformed patterns. It panics if called after execution.
+func (s *Starbox) AddNamedModulesGlob(patterns ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add named modules glob") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add named modules glob after execution")
+	}
+	s.markChanged()
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			s.logger().DPanicf("invalid module pattern %q: %v", p, err)
+			continue
+		}
+		s.globMods = append(s.globMods, p)
+	}
+}
+
 // AddModuleLoader adds a custom module loader to the preload and lazyload registry.
 // It will not load the module until the first run, and load result can be accessed in script via load("module_name", "key1") or key1 directly.
 // It panics if called after execution.
@@ -311,9 +1212,13 @@ func (s *Starbox) AddModuleLoader(moduleName string, moduleLoader starlet.Module
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add module loader") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add module loader after execution")
+		s.logger().DPanic("cannot add module loader after execution")
 	}
+	s.markChanged()
 	if s.loadMods == nil {
 		s.loadMods = make(map[string]starlet.ModuleLoader)
 	}
@@ -328,9 +1233,13 @@ func (s *Starbox) AddModuleFunctions(name string, funcs FuncMap) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add module function") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add module function after execution")
+		s.logger().DPanic("cannot add module function after execution")
 	}
+	s.markChanged()
 	if s.loadMods == nil {
 		s.loadMods = make(map[string]starlet.ModuleLoader)
 	}
@@ -348,15 +1257,40 @@ func (s *Starbox) AddModuleData(moduleName string, moduleData starlark.StringDic
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add module data") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add module data after execution")
+		s.logger().DPanic("cannot add module data after execution")
 	}
+	s.markChanged()
 	if s.loadMods == nil {
 		s.loadMods = make(map[string]starlet.ModuleLoader)
 	}
 	s.loadMods[moduleName] = dataconv.WrapModuleData(moduleName, moduleData)
 }
 
+// AddModuleDataJSON creates a module for the given JSON object along with a module loader, and adds it to the preload and lazyload registry like AddModuleData().
+// JSON objects are converted into dicts, arrays into lists, and numbers into ints or floats, and the keys of the top-level object become the members of the module.
+// It returns an error if the JSON data is invalid or not an object at the top level.
+// It panics if called after execution.
+func (s *Starbox) AddModuleDataJSON(moduleName string, jsonData []byte) error {
+	v, err := dataconv.DecodeStarlarkJSON(jsonData)
+	if err != nil {
+		return fmt.Errorf("invalid json for module %s: %w", moduleName, err)
+	}
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return fmt.Errorf("invalid json for module %s: top-level value is %s, not object", moduleName, v.Type())
+	}
+	moduleData := make(starlark.StringDict, d.Len())
+	for _, item := range d.Items() {
+		moduleData[dataconv.StarString(item[0])] = item[1]
+	}
+	s.AddModuleData(moduleName, moduleData)
+	return nil
+}
+
 // AddStructFunctions adds a module with the given struct functions along with a module loader, and adds it to the preload and lazyload registry.
 // The given struct function can be accessed in script via load("struct_name", "func1") or struct_name.func1.
 // It works like AddStructData() but allows only functions as values.
@@ -365,9 +1299,13 @@ func (s *Starbox) AddStructFunctions(name string, funcs FuncMap) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add struct function") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add struct function after execution")
+		s.logger().DPanic("cannot add struct function after execution")
 	}
+	s.markChanged()
 	if s.loadMods == nil {
 		s.loadMods = make(map[string]starlet.ModuleLoader)
 	}
@@ -385,9 +1323,13 @@ func (s *Starbox) AddStructData(structName string, structData starlark.StringDic
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add struct data") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add struct data after execution")
+		s.logger().DPanic("cannot add struct data after execution")
 	}
+	s.markChanged()
 	if s.loadMods == nil {
 		s.loadMods = make(map[string]starlet.ModuleLoader)
 	}
@@ -396,25 +1338,59 @@ func (s *Starbox) AddStructData(structName string, structData starlark.StringDic
 
 // AddModuleScript creates a module with given module script in virtual filesystem, and adds it to the preload and lazyload registry.
 // The given module script can be accessed in script via load("module_name", "key1") or load("module_name.star", "key1") if module name has no ".star" suffix.
+// The module name can be a path with slashes like "sub/util", the script is placed in the nested directory and loaded via load("sub/util.star", "key1"), and the ".star" suffix applies to the last component.
 // All the module scripts added by this method would be overridden by SetFS() if it's not nil.
 // It panics if called after execution.
 func (s *Starbox) AddModuleScript(moduleName, moduleScript string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add module script") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add module script after execution")
+		s.logger().DPanic("cannot add module script after execution")
 	}
+	s.markChanged()
 	if s.scriptMods == nil {
 		s.scriptMods = make(map[string]string)
 	}
 	name := strings.TrimSpace(moduleName)
+	if strings.Contains(name, "/") {
+		name = path.Clean(name)
+	}
 	if !strings.HasSuffix(name, ".star") {
 		name += ".star"
 	}
 	s.scriptMods[name] = moduleScript
 }
 
+// AddModuleFS mounts the given filesystem under the prefix of module paths, so the script files in it can be accessed in script via load("prefix/foo.star", "key1").
+// The prefix is a slash-separated path like "lib" or "vendor/util", and the filesystems with different prefixes coexist with the scripts added by AddModuleScript(), while a later call with the same prefix replaces the previous one.
+// All the filesystems added by this method would be overridden by SetFS() if it's not nil.
+// It panics if called after execution or the prefix is invalid, i.e. empty, absolute or escaping with "..", or the filesystem is nil, while it's ignored if the logger doesn't panic.
+func (s *Starbox) AddModuleFS(prefix string, fsys fs.FS) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add module filesystem") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add module filesystem after execution")
+	}
+	s.markChanged()
+	name := path.Clean(strings.TrimSpace(prefix))
+	if !fs.ValidPath(name) || name == "." || fsys == nil {
+		s.logger().DPanicf("invalid module filesystem: %q", prefix)
+		return
+	}
+	if s.prefixFS == nil {
+		s.prefixFS = make(map[string]fs.FS)
+	}
+	s.prefixFS[name] = fsys
+}
+
 // AddHTTPContext adds HTTP request and response data wrapper to the global environment before execution.
 // It takes an HTTP request and returns the response data wrapper for setting response headers and body.
 // It panics if called after execution.
@@ -422,9 +1398,13 @@ func (s *Starbox) AddHTTPContext(req *http.Request) *libhttp.ServerResponse {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add HTTP context") {
+		return nil
+	}
 	if s.hasExec {
-		log.DPanic("cannot add HTTP context after execution")
+		s.logger().DPanic("cannot add HTTP context after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
@@ -441,3 +1421,124 @@ func (s *Starbox) AddHTTPContext(req *http.Request) *libhttp.ServerResponse {
 	s.globals["response"] = resp.Struct()
 	return resp
 }
+
+var (
+	// ErrHTTPBodyTooLarge is the error for AddHTTPContextOpts() when the request body exceeds the limit with ErrorOnOversize.
+	ErrHTTPBodyTooLarge = errors.New("http request body too large")
+)
+
+// HTTPContextOptions defines the options for converting the HTTP request by AddHTTPContextOpts().
+type HTTPContextOptions struct {
+	// MaxBodyBytes is the maximum bytes of the request body visible to scripts, zero or negative means no limit.
+	MaxBodyBytes int64
+	// ErrorOnOversize returns ErrHTTPBodyTooLarge for the body exceeding MaxBodyBytes instead of truncating it.
+	ErrorOnOversize bool
+	// ParseForm adds the "form" field to the request for scripts, which is a dict mapping each form field to the list of its values, parsed from the query and the URL-encoded body.
+	ParseForm bool
+}
+
+// AddHTTPContextOpts adds HTTP request and response data wrapper to the global environment before execution like AddHTTPContext(), with the given options for the request.
+// The request body visible to scripts is truncated to MaxBodyBytes, so the JSON and form of an oversized body are parsed from the truncated part, or it returns an error wrapping ErrHTTPBodyTooLarge with ErrorOnOversize, and nothing is added in that case.
+// The request body is still fully readable in Go afterward, since only the visible part is read and then restored in front of the rest.
+// It returns ErrClosed if the box is closed, or an error wrapping ErrFrozen if the box is frozen.
+// It panics if called after execution.
+func (s *Starbox) AddHTTPContextOpts(req *http.Request, opts HTTPContextOptions) (*libhttp.ServerResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkChange("add HTTP context"); err != nil {
+		return nil, err
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add HTTP context after execution")
+	}
+	s.markChanged()
+
+	// convert request before changing globals
+	var sr starlark.Value = starlark.None
+	if req != nil {
+		st, err := convertHTTPRequest(req, opts)
+		if err != nil {
+			return nil, err
+		}
+		sr = st
+	}
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap)
+	}
+	s.globals["request"] = sr
+
+	// add response to globals
+	resp := libhttp.NewServerResponse()
+	s.globals["response"] = resp.Struct()
+	return resp, nil
+}
+
+// convertHTTPRequest converts the HTTP request into a Starlark struct like libhttp.ConvertServerRequest() with the given options.
+func convertHTTPRequest(req *http.Request, opts HTTPContextOptions) (*starlarkstruct.Struct, error) {
+	// read the visible part of body, and restore it for later reads
+	var body []byte
+	if req.Body != nil {
+		var rd io.Reader = req.Body
+		if opts.MaxBodyBytes > 0 {
+			rd = io.LimitReader(req.Body, opts.MaxBodyBytes+1)
+		}
+		bs, err := io.ReadAll(rd)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(bs), req.Body), req.Body}
+		body = bs
+		if opts.MaxBodyBytes > 0 && int64(len(body)) > opts.MaxBodyBytes {
+			if opts.ErrorOnOversize {
+				return nil, fmt.Errorf("%w: limit %d bytes", ErrHTTPBodyTooLarge, opts.MaxBodyBytes)
+			}
+			body = body[:opts.MaxBodyBytes]
+		}
+	}
+	withBody := func() *http.Request {
+		r := req.WithContext(req.Context())
+		if req.Body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		return r
+	}
+
+	// convert the request with the visible body
+	er, err := libhttp.NewExportedServerRequest(withBody())
+	if err != nil {
+		return nil, err
+	}
+	st := er.Struct()
+	if !opts.ParseForm {
+		return st, nil
+	}
+
+	// parse form and add it to the struct
+	fr := withBody()
+	fr.Form, fr.PostForm = nil, nil
+	if err := fr.ParseForm(); err != nil {
+		return nil, fmt.Errorf("parse form: %w", err)
+	}
+	keys := make([]string, 0, len(fr.Form))
+	for k := range fr.Form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	form := starlark.NewDict(len(keys))
+	for _, k := range keys {
+		if err := form.SetKey(starlark.String(k), starlarkStringList(fr.Form[k])); err != nil {
+			return nil, err
+		}
+	}
+	sd := make(starlark.StringDict)
+	st.ToStringDict(sd)
+	sd["form"] = form
+	return starlarkstruct.FromStringDict(st.Constructor(), sd), nil
+}
+
+// readCloser combines a reader and a closer into an io.ReadCloser.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
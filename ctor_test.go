@@ -1,12 +1,21 @@
 package starbox_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"reflect"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"bitbucket.org/neiku/hlog"
 	"github.com/1set/starbox"
@@ -14,6 +23,8 @@ import (
 	"github.com/1set/starlet/dataconv"
 	"github.com/psanford/memfs"
 	"go.starlark.net/starlark"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var (
@@ -46,6 +57,51 @@ func TestNew(t *testing.T) {
 	}
 }
 
+// TestDebug tests the following:
+// 1. Create a new Starbox instance with various settings.
+// 2. Check the debug dump before and after execution.
+// 3. Check the values of the globals are not included.
+func TestDebug(t *testing.T) {
+	b := starbox.New("test")
+	b.SetStructTag("json")
+	b.SetModuleSet(starbox.SafeModuleSet)
+	b.AddNamedModules("base64")
+	b.AddModuleData("data", starlark.StringDict{"x": starlark.MakeInt(1)})
+	b.AddModuleScript("util", `y = 2`)
+	b.AddKeyValue("secret", "p@ssw0rd")
+	b.AddKeyValue("api", 1)
+
+	d := b.Debug()
+	for _, s := range []string{
+		"🥡Box{name:test,run:0}",
+		"executed:         false",
+		"module set:       safe",
+		"named modules:    [base64]",
+		"loader modules:   [data]",
+		"script modules:   [util.star]",
+		"globals:          [api secret]",
+		`struct tag:       "json"`,
+	} {
+		if !strings.Contains(d, s) {
+			t.Errorf("expect %q in debug dump, got:\n%s", s, d)
+		}
+	}
+	if strings.Contains(d, "p@ssw0rd") {
+		t.Errorf("expect no global values in debug dump, got:\n%s", d)
+	}
+
+	if _, err := b.Run(`z = 3`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	d = b.Debug()
+	for _, s := range []string{"🥡Box{name:test,run:1}", "runs:             1", "executed:         true"} {
+		if !strings.Contains(d, s) {
+			t.Errorf("expect %q in debug dump, got:\n%s", s, d)
+		}
+	}
+}
+
 // TestSetStructTag tests the following:
 // 1. Create a new Starbox instance.
 // 2. Set the struct tag.
@@ -130,6 +186,111 @@ func TestSetPrintFunc(t *testing.T) {
 	}
 }
 
+func TestSetJSONPrint(t *testing.T) {
+	var buf bytes.Buffer
+	b := starbox.New("logger")
+	b.SetJSONPrint(&buf)
+	if _, err := b.Run(hereDoc(`
+		print('Aloha!')
+		print("say \"hi\"", 2)
+	`)); err != nil {
+		t.Error(err)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Errorf("expect 2 lines, got %q", buf.String())
+		return
+	}
+	for i, em := range []string{"Aloha!", `say "hi" 2`} {
+		var rec map[string]string
+		if err := json.Unmarshal([]byte(lines[i]), &rec); err != nil {
+			t.Errorf("unexpected error for line %q: %v", lines[i], err)
+			continue
+		}
+		if rec["name"] != "logger" || rec["msg"] != em {
+			t.Errorf("unexpected record: %v", rec)
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, rec["ts"]); err != nil {
+			t.Errorf("unexpected timestamp %q: %v", rec["ts"], err)
+		} else if ts.Location() != time.UTC {
+			t.Errorf("expect timestamp in UTC, got %q", rec["ts"])
+		}
+	}
+}
+
+func TestSetJSONPrint_Clock(t *testing.T) {
+	var buf bytes.Buffer
+	b := starbox.New("logger")
+	b.SetJSONPrint(&buf)
+	b.SetClock(time.Date(2024, 1, 2, 11, 4, 5, 0, time.FixedZone("X", 3600)))
+	if _, err := b.Run(`print('Aloha!')`); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var rec map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Errorf("unexpected error for %q: %v", buf.String(), err)
+		return
+	}
+	if es := "2024-01-02T10:04:05Z"; rec["ts"] != es {
+		t.Errorf("expect ts %q, got %q", es, rec["ts"])
+	}
+}
+
+func TestSetPrintFormat(t *testing.T) {
+	capture := func(setup func(b *starbox.Starbox)) string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatalf("pipe: %v", err)
+		}
+		stderr := os.Stderr
+		os.Stderr = w
+		defer func() { os.Stderr = stderr }()
+
+		b := starbox.New("fmt")
+		setup(b)
+		if _, err := b.Run(`print("hi", 1)`); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		_ = w.Close()
+		bs, _ := io.ReadAll(r)
+		return string(bs)
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(b *starbox.Starbox)
+		expect string
+	}{
+		{"default", func(b *starbox.Starbox) {}, `^\[⭐\|fmt\]\(\d{2}:\d{2}:\d{2}\.\d{3}\) hi 1\n$`},
+		{"layout with emoji", func(b *starbox.Starbox) { b.SetPrintFormat(time.RFC3339, true) }, `^\[⭐\|fmt\]\(\d{4}-\d{2}-\d{2}T[\d:]+Z\) hi 1\n$`},
+		{"layout only", func(b *starbox.Starbox) { b.SetPrintFormat("2006-01-02", false) }, `^\d{4}-\d{2}-\d{2} hi 1\n$`},
+		{"emoji only", func(b *starbox.Starbox) { b.SetPrintFormat("", true) }, `^\[⭐\|fmt\] hi 1\n$`},
+		{"plain", func(b *starbox.Starbox) { b.SetPrintFormat("", false) }, `^hi 1\n$`},
+		{"thread name", func(b *starbox.Starbox) { b.SetPrintFormat("", true); b.SetThreadName("worker") }, `^\[⭐\|worker\] hi 1\n$`},
+	}
+	for _, tt := range tests {
+		if got := capture(tt.setup); !regexp.MustCompile(tt.expect).MatchString(got) {
+			t.Errorf("[%s] expect %s, got %q", tt.name, tt.expect, got)
+		}
+	}
+
+	// the custom print function is not affected
+	var sb strings.Builder
+	got := capture(func(b *starbox.Starbox) {
+		b.SetPrintFormat("", false)
+		b.SetPrintFunc(func(_ *starlark.Thread, msg string) {
+			sb.WriteString(msg)
+		})
+	})
+	if got != "" || sb.String() != "hi 1" {
+		t.Errorf("expect custom print function, got %q and %q", got, sb.String())
+	}
+}
+
 // TestSetFS tests the following:
 // 1. Create a virtual filesystem.
 // 2. Create a new Starbox instance.
@@ -291,6 +452,131 @@ func TestSetModuleSet(t *testing.T) {
 	}
 }
 
+// TestSetDefaultModuleSet tests the following:
+// 1. Set the default module set, and reject the unknown one.
+// 2. Create new Starbox instances and check the default module set is used.
+// 3. Override the default module set for an individual box.
+func TestSetDefaultModuleSet(t *testing.T) {
+	defer starbox.SetDefaultModuleSet(starbox.EmptyModuleSet)
+
+	if err := starbox.SetDefaultModuleSet(starbox.NetworkModuleSet); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if err := starbox.SetDefaultModuleSet(starbox.ModuleSetName("unknown")); err == nil {
+		t.Error("expect error for unknown module set, got nil")
+		return
+	}
+
+	b := starbox.New("test")
+	if _, err := b.Run(`t = type(http)`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+
+	b2 := starbox.New("test2")
+	b2.SetModuleSet(starbox.SafeModuleSet)
+	if _, err := b2.Run(`t = type(http)`); err == nil {
+		t.Error("expect error for overridden module set, got nil")
+	}
+}
+
+// TestDiffModuleSet tests the following:
+// 1. Diff module names against various base module sets.
+// 2. Check the unknown module names are ignored.
+// 3. Diff against an unknown base module set, and expect an error.
+func TestDiffModuleSet(t *testing.T) {
+	tests := []struct {
+		base    starbox.ModuleSetName
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{starbox.SafeModuleSet, []string{"json", "http", "file", "http", "not_exists"}, []string{"file", "http"}, false},
+		{starbox.NetworkModuleSet, []string{"json", "http", "runtime"}, []string{"runtime"}, false},
+		{starbox.FullModuleSet, []string{"json", "http", "runtime"}, []string{}, false},
+		{starbox.EmptyModuleSet, []string{"re", "base64"}, []string{"base64", "re"}, false},
+		{starbox.SafeModuleSet, nil, []string{}, false},
+		{"unknown", []string{"json"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := starbox.DiffModuleSet(tt.base, tt.names)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("DiffModuleSet(%q) error = %v, wantErr %v", tt.base, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DiffModuleSet(%q) = %v, want %v", tt.base, got, tt.want)
+		}
+	}
+}
+
+// TestSetModuleSetExcept tests the following:
+// 1. Create a new Starbox instance.
+// 2. Set a module set with excluded module names.
+// 3. Check the excluded modules are not loaded, and the unknown module set still fails.
+func TestSetModuleSetExcept(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.FullModuleSet)
+	b.SetModuleSetExcept(starbox.SafeModuleSet, "json", "random", "not_exists")
+	if _, err := b.Run(`m = __modules__`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	es := []string{"atom", "base64", "csv", "go_idiomatic", "hashlib", "math", "re", "string", "struct", "time"}
+	if !reflect.DeepEqual(es, b.GetModuleNames()) {
+		t.Errorf("expect %v, got %v", es, b.GetModuleNames())
+	}
+	if _, err := b.Run(`json.encode(1)`); err == nil {
+		t.Error("expect error for excluded module, got nil")
+	}
+
+	// set module set again to drop the exclusion
+	b2 := starbox.New("test2")
+	b2.SetModuleSetExcept(starbox.SafeModuleSet, "json")
+	b2.SetModuleSet(starbox.SafeModuleSet)
+	if _, err := b2.Run(`s = json.encode(1)`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+
+	// unknown module set
+	b3 := starbox.New("test3")
+	b3.SetModuleSetExcept(starbox.ModuleSetName("unknown"), "json")
+	if _, err := b3.Run(`a = 1`); err == nil {
+		t.Error("expect error for unknown module set, got nil")
+	}
+}
+
+// TestSetModuleSetWith tests the following:
+// 1. Create a new Starbox instance.
+// 2. Set a module set with additional builtin modules.
+// 3. Check the modules are loaded, and invalid names or sets are rejected.
+func TestSetModuleSetWith(t *testing.T) {
+	b := starbox.New("test")
+	if err := b.SetModuleSetWith(starbox.EmptyModuleSet, "math", "json", "math"); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if err := b.SetModuleSetWith(starbox.EmptyModuleSet, "json", "not_exists"); !errors.Is(err, starbox.ErrModuleNotFound) {
+		t.Errorf("expect module not found error, got %v", err)
+		return
+	}
+	if err := b.SetModuleSetWith(starbox.ModuleSetName("unknown"), "json"); err == nil {
+		t.Error("expect error for unknown module set, got nil")
+		return
+	}
+	out, err := b.Run(`s = json.encode(math.floor(1.5))`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["s"] != "1" {
+		t.Errorf("expect s=1, got %v", out["s"])
+	}
+	if es := []string{"json", "math"}; !reflect.DeepEqual(es, b.GetModuleNames()) {
+		t.Errorf("expect %v, got %v", es, b.GetModuleNames())
+	}
+}
+
 // TestAddKeyValue tests the following:
 // 1. Create a new Starbox instance.
 // 2. Add a key-value pair.
@@ -339,6 +625,59 @@ func TestAddKeyStarlarkValue(t *testing.T) {
 	}
 }
 
+// TestAddFrozenKeyValue tests the following:
+// 1. Add a frozen key and a normal key to the global environment.
+// 2. Run a script that reassigns the normal key, and check it succeeds.
+// 3. Run a script that reassigns or mutates the frozen key, and check it fails and the value is kept.
+func TestAddFrozenKeyValue(t *testing.T) {
+	b := starbox.New("test")
+	b.AddFrozenKeyValue("config", map[string]interface{}{"mode": "safe"})
+	b.AddKeyValue("count", 1)
+
+	out, err := b.Run(`count = count + 1; mode = config["mode"]`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["count"] != int64(2) || out["mode"] != "safe" {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	// the script is rejected before execution
+	var leaked []string
+	b2 := starbox.New("test")
+	b2.AddFrozenKeyValue("config", "safe")
+	b2.AddBuiltin("leak", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		leaked = append(leaked, args.String())
+		return starlark.None, nil
+	})
+	for _, script := range []string{
+		`config = "evil"; leak(config)`,
+		"def f():\n    leak(config)\nf()\nconfig = 'evil'",
+		"for config in ['evil']:\n    leak(config)",
+	} {
+		out, err = b2.Run(script)
+		if err == nil || !strings.Contains(err.Error(), "cannot reassign frozen globals: config") {
+			t.Errorf("expect frozen error for %q, got %v", script, err)
+		}
+		if out != nil {
+			t.Errorf("expect no output for %q, got %v", script, out)
+		}
+	}
+	if len(leaked) > 0 {
+		t.Errorf("expect script not executed, got %v", leaked)
+	}
+
+	if _, err := b.Run(`config["mode"] = "unsafe"`); err == nil {
+		t.Errorf("expect error for mutating frozen value, got nil")
+	}
+
+	out, err = b.Run(`mode = config["mode"]`)
+	if err != nil || out["mode"] != "safe" {
+		t.Errorf("expect frozen value kept, got %v, %v", out, err)
+	}
+}
+
 // TestAddKeyValues tests the following:
 // 1. Create a new Starbox instance.
 // 2. Add key-value pairs.
@@ -463,6 +802,31 @@ func TestAddNamedModules(t *testing.T) {
 	}
 }
 
+// TestAddNamedModulesGlob tests the following:
+// 1. Add named modules by glob patterns, and check the matched modules are loaded.
+// 2. Add a pattern matching nothing, and expect ErrModuleNotFound.
+// 3. Add a malformed pattern, and expect it to be ignored.
+func TestAddNamedModulesGlob(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.EmptyModuleSet)
+	b.AddNamedModules("json")
+	b.AddNamedModulesGlob("r*", "base6?", "[")
+	out, err := b.Run(`m = __modules__`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{"base64", "json", "random", "re", "runtime"}; !reflect.DeepEqual(out["m"], es) {
+		t.Errorf("expect %v, got %v", es, out["m"])
+	}
+
+	b = starbox.New("test")
+	b.AddNamedModulesGlob("*", "nope*")
+	if _, err := b.Run(`a = 1`); !errors.Is(err, starbox.ErrModuleNotFound) || !strings.Contains(err.Error(), "nope*") {
+		t.Errorf("expect ErrModuleNotFound for nope*, got %v", err)
+	}
+}
+
 // TestAddModuleLoader tests the following:
 // 1. Create a new Starbox instance.
 // 2. Add a module loader.
@@ -565,6 +929,49 @@ func TestAddModuleData(t *testing.T) {
 	}
 }
 
+// TestAddModuleDataJSON tests the following:
+// 1. Create a new Starbox instance.
+// 2. Add module data from JSON, and check the errors of invalid JSON.
+// 3. Run a script that uses values from the module data.
+// 4. Check the output to see if the JSON values are converted.
+func TestAddModuleDataJSON(t *testing.T) {
+	b := starbox.New("test")
+	if err := b.AddModuleDataJSON("bad", []byte(`{"a": 1`)); err == nil {
+		t.Error("expect error for invalid json, got nil")
+	}
+	if err := b.AddModuleDataJSON("bad", []byte(`[1, 2]`)); err == nil {
+		t.Error("expect error for top-level array, got nil")
+	}
+	if err := b.AddModuleDataJSON("config", []byte(`{"timeout": 30, "ratio": 0.5, "name": "box", "tags": ["a", "b"], "db": {"port": 5432}, "debug": false, "extra": null}`)); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	tests := []struct {
+		script string
+		want   interface{}
+	}{
+		{`c = __modules__`, []interface{}{"config"}},
+		{`c = config.timeout * 2`, int64(60)},
+		{`load("config", "timeout", "ratio"); c = timeout * ratio`, float64(15)},
+		{`c = config.name + config.tags[1]`, "boxb"},
+		{`c = config.db["port"]`, int64(5432)},
+		{`c = [config.debug, config.extra]`, []interface{}{false, nil}},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			b.Reset()
+			out, err := b.Run(hereDoc(tt.script))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if es := tt.want; !reflect.DeepEqual(out["c"], es) {
+				t.Errorf("expect %v, got %v", es, out["c"])
+			}
+		})
+	}
+}
+
 // TestAddModuleFunctions tests the following:
 // 1. Create a new Starbox instance.
 // 2. Add module functions.
@@ -751,6 +1158,98 @@ func TestAddModuleScript(t *testing.T) {
 	}
 }
 
+// TestAddModuleScript_Nested tests the following:
+// 1. Add module scripts with paths of subdirectories.
+// 2. Run a script that loads the nested module scripts, and one nested module loads another.
+// 3. Check the module names.
+func TestAddModuleScript_Nested(t *testing.T) {
+	b := starbox.New("test")
+	b.AddModuleScript("sub/util", hereDoc(`
+		def double(x):
+			return x * 2
+	`))
+	b.AddModuleScript("lib//deep/calc.star", hereDoc(`
+		load("sub/util.star", "double")
+		def quad(x):
+			return double(double(x))
+	`))
+	b.AddModuleScript("top", `name = "top"`)
+	out, err := b.Run(hereDoc(`
+		load("sub/util.star", "double")
+		load("lib/deep/calc", "quad")
+		load("top", "name")
+		c = [double(3), quad(3), name]
+		m = sorted(__modules__)
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{int64(6), int64(12), "top"}; !reflect.DeepEqual(out["c"], es) {
+		t.Errorf("expect %v, got %v", es, out["c"])
+	}
+	if es := []interface{}{"lib/deep/calc.star", "sub/util.star", "top.star"}; !reflect.DeepEqual(out["m"], es) {
+		t.Errorf("expect %v, got %v", es, out["m"])
+	}
+}
+
+// TestAddModuleFS tests the following:
+// 1. Mount filesystems under different prefixes along with module scripts.
+// 2. Load the scripts from the mounted filesystems, including nested loads across them.
+// 3. Check SetFS overrides the mounted filesystems, and invalid prefixes are ignored.
+func TestAddModuleFS(t *testing.T) {
+	lib := fstest.MapFS{
+		"math.star":     {Data: []byte(`def inc(x): return x + 1`)},
+		"sub/more.star": {Data: []byte("load(\"util/text.star\", \"greet\")\nmsg = greet(\"lib\")")},
+	}
+	util := fstest.MapFS{
+		"text.star": {Data: []byte(`def greet(n): return "hi " + n`)},
+	}
+
+	b := starbox.New("test")
+	b.AddModuleFS("lib", lib)
+	b.AddModuleFS(" util/ ", util)
+	b.AddModuleScript("top", `name = "top"`)
+	out, err := b.Run(hereDoc(`
+		load("lib/math.star", "inc")
+		load("lib/sub/more.star", "msg")
+		load("top", "name")
+		c = [inc(1), msg, name]
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{int64(2), "hi lib", "top"}; !reflect.DeepEqual(out["c"], es) {
+		t.Errorf("expect %v, got %v", es, out["c"])
+	}
+
+	// missing file in the mounted filesystem
+	b = starbox.New("test")
+	b.AddModuleFS("lib", lib)
+	if _, err := b.Run(`load("lib/none.star", "x")`); err == nil {
+		t.Errorf("expect error for missing module, got nil")
+	}
+
+	// SetFS overrides everything
+	b = starbox.New("test")
+	b.AddModuleFS("lib", lib)
+	b.SetFS(fstest.MapFS{"lib/math.star": {Data: []byte(`def inc(x): return x + 10`)}})
+	if out, err := b.Run(`load("lib/math.star", "inc"); v = inc(1)`); err != nil || out["v"] != int64(11) {
+		t.Errorf("expect v=11 from SetFS, got %v, %v", out, err)
+	}
+
+	// invalid prefixes are ignored
+	b = starbox.New("test")
+	for _, prefix := range []string{"", ".", "/abs", "../up"} {
+		b.AddModuleFS(prefix, lib)
+	}
+	b.AddModuleFS("nil", nil)
+	if _, err := b.Run(`load("nil/math.star", "inc")`); err == nil {
+		t.Errorf("expect error for ignored module filesystem, got nil")
+	}
+}
+
 // TestAddNamedModuleAndModuleScript tests the following:
 // 1. Create a new Starbox instance.
 // 2. Add named modules and module script.
@@ -883,6 +1382,105 @@ func TestSetScriptCache(t *testing.T) {
 		// modify file content, and run the script again -- cache
 		fs.WriteFile(mn, []byte(s2), 0644)
 		testRun(b, 6, 30)
+
+		// reset the box, and run the script again -- cache kept
+		b.Reset()
+		testRun(b, 7, 30)
+	}
+
+	{
+		// create a new Starbox instance with the default cache, and reset it
+		b := starbox.New("test")
+		fs := memfs.New()
+		b.SetFS(fs)
+		fs.WriteFile(mn, []byte(s1), 0644)
+		testRun(b, 8, 30)
+
+		// modify file content, reset and run the script again -- cache kept
+		fs.WriteFile(mn, []byte(s2), 0644)
+		b.Reset()
+		testRun(b, 9, 30)
+	}
+
+	{
+		// create a new Starbox instance without cache, and reset it
+		b := starbox.New("test")
+		fs := memfs.New()
+		b.SetFS(fs)
+		b.SetScriptCache(nil)
+		fs.WriteFile(mn, []byte(s1), 0644)
+		testRun(b, 10, 30)
+
+		// modify file content, reset and run the script again -- still no cache
+		fs.WriteFile(mn, []byte(s2), 0644)
+		b.Reset()
+		testRun(b, 11, 300)
+	}
+}
+
+// TestResetPreserveModules tests the following:
+// 1. Run a box with dynamic modules, and reset it with the modules preserved.
+// 2. Check the globals are cleared, and the dynamic modules are not resolved again.
+// 3. Check the modules added after the first run are not picked up until Reset().
+func TestResetPreserveModules(t *testing.T) {
+	var resolved int
+	b := starbox.New("test")
+	b.AddNamedModules("dyn")
+	b.SetDynamicModuleLoader(func(name string) (starlet.ModuleLoader, error) {
+		resolved++
+		return func() (starlark.StringDict, error) {
+			return starlark.StringDict{"v": starlark.MakeInt(1)}, nil
+		}, nil
+	})
+
+	// works like Reset() before execution
+	b.ResetPreserveModules()
+	if out, err := b.Run(`load("dyn", "v"); a = v`); err != nil || out["a"] != int64(1) {
+		t.Errorf("expect a=1, got %v, %v", out, err)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		b.ResetPreserveModules()
+		out, err := b.Run(`load("dyn", "v"); b = v + 1`)
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", i, err)
+			return
+		}
+		if _, ok := out["a"]; ok || out["b"] != int64(2) {
+			t.Errorf("[%d] unexpected output: %v", i, out)
+		}
+	}
+	if resolved != 1 {
+		t.Errorf("expect modules resolved once, got %d", resolved)
+	}
+
+	// the modules added after the first run are not picked up
+	b.ResetPreserveModules()
+	b.AddModuleLoader("extra", func() (starlark.StringDict, error) {
+		return starlark.StringDict{"x": starlark.MakeInt(1)}, nil
+	})
+	if _, err := b.Run(`load("extra", "x")`); err == nil {
+		t.Errorf("expect error for module added after the first run, got nil")
+	}
+	b.Reset()
+	if _, err := b.Run(`load("dyn", "v"); load("extra", "x")`); err != nil {
+		t.Errorf("unexpected error after reset: %v", err)
+	}
+	if resolved != 2 {
+		t.Errorf("expect modules resolved again after reset, got %d", resolved)
+	}
+
+	// the kept modules are dropped if reset again before execution
+	b.ResetPreserveModules()
+	b.ResetPreserveModules()
+	b.AddModuleLoader("more", func() (starlark.StringDict, error) {
+		return starlark.StringDict{"y": starlark.MakeInt(2)}, nil
+	})
+	if _, err := b.Run(`load("more", "y")`); err != nil {
+		t.Errorf("unexpected error after reset twice: %v", err)
+	}
+	if resolved != 3 {
+		t.Errorf("expect modules resolved again after reset twice, got %d", resolved)
 	}
 }
 
@@ -1099,3 +1697,952 @@ func TestUserLoggerModuleLoader(t *testing.T) {
 		t.Error("expect not nil, got nil")
 	}
 }
+
+// TestFreeze tests the following:
+// 1. Create a new Starbox instance and configure it.
+// 2. Freeze the box before the first run.
+// 3. Check that all the setters, adders and Reset panic.
+// 4. Run a script on the frozen box and check the output.
+func TestFreeze(t *testing.T) {
+	starbox.SetLog(hlog.NewSimpleLogger().SugaredLogger)
+	b := starbox.New("test")
+	b.AddKeyValue("a", 10)
+	b.AddNamedModules("base64")
+	if b.IsFrozen() {
+		t.Error("expect not frozen, got frozen")
+		return
+	}
+	b.Freeze()
+	if !b.IsFrozen() {
+		t.Error("expect frozen, got not frozen")
+		return
+	}
+
+	tests := []struct {
+		name string
+		fn   func()
+	}{
+		{"set struct tag", func() { b.SetStructTag("json") }},
+		{"set module set", func() { b.SetModuleSet(starbox.FullModuleSet) }},
+		{"add key value", func() { b.AddKeyValue("a", 20) }},
+		{"add named modules", func() { b.AddNamedModules("runtime") }},
+		{"add module script", func() { b.AddModuleScript("data", `x = 1`) }},
+		{"create memory", func() { b.CreateMemory("mem") }},
+		{"reset", func() { b.Reset() }},
+		{"reset preserve modules", func() { b.ResetPreserveModules() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("expected panic but not")
+				}
+			}()
+			tt.fn()
+		})
+	}
+
+	out, err := b.Run(`c = a * 2; e = base64.encode("hi"); print(__modules__)`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := int64(20); out["c"] != es {
+		t.Errorf("expect %d, got %v", es, out["c"])
+	}
+	if es := "aGk="; out["e"] != es {
+		t.Errorf("expect %q, got %v", es, out["e"])
+	}
+}
+
+// TestFreeze_Errors tests the setters returning errors return ErrFrozen for the frozen box if the panic is not raised by the logger.
+func TestFreeze_Errors(t *testing.T) {
+	starbox.SetLog(hlog.NewNoopLogger().SugaredLogger)
+	b := starbox.New("test")
+	b.Freeze()
+	if err := b.SetModuleSetWith(starbox.SafeModuleSet, "json"); !errors.Is(err, starbox.ErrFrozen) {
+		t.Errorf("expect frozen error for setting module set, got %v", err)
+	}
+	if err := b.AddChannel("ch", make(chan interface{})); !errors.Is(err, starbox.ErrFrozen) {
+		t.Errorf("expect frozen error for adding channel, got %v", err)
+	}
+	if resp, err := b.AddHTTPContextOpts(nil, starbox.HTTPContextOptions{}); resp != nil || !errors.Is(err, starbox.ErrFrozen) {
+		t.Errorf("expect frozen error for adding HTTP context, got %v, %v", resp, err)
+	}
+}
+
+// TestSetThreadLocal tests the following:
+// 1. Create a new Starbox instance with thread-local values.
+// 2. Add a builtin to read the thread-local values.
+// 3. Run the script twice and check the values are available in both runs.
+func TestSetThreadLocal(t *testing.T) {
+	b := starbox.New("test")
+	b.SetThreadLocal("trace_id", "abc-123")
+	b.SetThreadLocal("tenant", 42)
+	b.SetThreadLocal("tenant", 100)
+	b.AddBuiltin("local", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var key string
+		if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "key", &key); err != nil {
+			return nil, err
+		}
+		return starlark.String(fmt.Sprint(thread.Local(key))), nil
+	})
+
+	out, err := b.Run(`a = local("trace_id"); b = local("tenant"); c = local("missing")`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := "abc-123"; out["a"] != es {
+		t.Errorf("expect %q, got %v", es, out["a"])
+	}
+	if es := "100"; out["b"] != es {
+		t.Errorf("expect %q, got %v", es, out["b"])
+	}
+	if es := "<nil>"; out["c"] != es {
+		t.Errorf("expect %q, got %v", es, out["c"])
+	}
+
+	out, err = b.CreateRunConfig().Script(`d = local("trace_id")`).Execute()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := "abc-123"; out["d"] != es {
+		t.Errorf("expect %q, got %v", es, out["d"])
+	}
+}
+
+// TestThreadPreparation tests the following:
+// 1. Run a box without thread-related settings, and check no empty script is run in advance.
+// 2. Run a box with thread locals, and check the empty script is run once in advance.
+func TestThreadPreparation(t *testing.T) {
+	b := starbox.New("plain")
+	if _, err := b.Run(`a = 1`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if s := b.GetMachine().String(); !strings.Contains(s, "run:1,") {
+		t.Errorf("expect 1 run of the machine, got %s", s)
+	}
+
+	b2 := starbox.New("local")
+	b2.SetThreadLocal("key", "value")
+	if _, err := b2.Run(`a = 1`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if s := b2.GetMachine().String(); !strings.Contains(s, "run:2,") {
+		t.Errorf("expect 2 runs of the machine, got %s", s)
+	}
+}
+
+// TestSetThreadName tests the following:
+// 1. Create a new Starbox instance and check the default thread name.
+// 2. Set the thread name and check it's used by the thread.
+// 3. Check the custom print function receives the thread with the name, and the normalized errors of the script have the name.
+func TestSetThreadName(t *testing.T) {
+	b := starbox.New("test")
+	if es := "test"; b.GetThreadName() != es {
+		t.Errorf("expect %q, got %q", es, b.GetThreadName())
+	}
+	b.SetThreadName("req-42")
+	if es := "req-42"; b.GetThreadName() != es {
+		t.Errorf("expect %q, got %q", es, b.GetThreadName())
+	}
+
+	var names []string
+	b.SetPrintFunc(func(thread *starlark.Thread, msg string) {
+		names = append(names, thread.Name)
+	})
+	b.AddBuiltin("thread_name", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.String(thread.Name), nil
+	})
+	out, err := b.Run(`print("hi"); n = thread_name()`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := "req-42"; out["n"] != es {
+		t.Errorf("expect %q, got %v", es, out["n"])
+	}
+	if es := []string{"req-42"}; !reflect.DeepEqual(names, es) {
+		t.Errorf("expect %v, got %v", es, names)
+	}
+	_, err = b.Run(`fail("oops")`)
+	if err == nil || strings.Contains(err.Error(), "req-42") || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("expect error message unchanged, got %v", err)
+	}
+	if re := starbox.NormalizeError(err); re == nil || re.Thread != "req-42" {
+		t.Errorf("expect normalized error with thread name, got %+v", re)
+	}
+	var ee *starlark.EvalError
+	if !errors.As(err, &ee) {
+		t.Errorf("expect EvalError unwrapped, got %T", err)
+	}
+
+	// reset to the box name
+	b2 := starbox.New("box")
+	b2.SetThreadName("temp")
+	b2.SetThreadName("")
+	b2.AddBuiltin("thread_name", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.String(thread.Name), nil
+	})
+	out, err = b2.Run(`print("hi"); n = thread_name()`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if n := out["n"]; n == "temp" || n == "" {
+		t.Errorf("expect the default thread name, got %v", n)
+	}
+	if es := "box"; b2.GetThreadName() != es {
+		t.Errorf("expect %q, got %q", es, b2.GetThreadName())
+	}
+	if _, err = b2.Run(`fail("oops")`); err == nil {
+		t.Errorf("expect error, got nil")
+	} else if re := starbox.NormalizeError(err); re.Thread != "" {
+		t.Errorf("expect normalized error without thread name, got %q", re.Thread)
+	}
+}
+
+func TestSetThreadConfigurator(t *testing.T) {
+	var (
+		calls int
+		names []string
+	)
+	b := starbox.New("test")
+	b.SetThreadName("worker")
+	b.SetThreadConfigurator(func(thread *starlark.Thread) {
+		calls++
+		names = append(names, thread.Name)
+		thread.Name = "configured"
+		thread.SetMaxExecutionSteps(thread.ExecutionSteps() + 1000)
+	})
+	b.AddBuiltin("thread_name", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		return starlark.String(thread.Name), nil
+	})
+
+	// it runs last and overrides the settings of the box
+	out, err := b.Run(`n = thread_name()`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := "configured"; out["n"] != es {
+		t.Errorf("expect %q, got %v", es, out["n"])
+	}
+	if es := []string{"worker"}; !reflect.DeepEqual(names, es) {
+		t.Errorf("expect %v, got %v", es, names)
+	}
+
+	// it's called before each run
+	if _, err := b.Run(hereDoc(`
+		def loop():
+			for i in range(100000):
+				pass
+		loop()
+	`)); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("expect too many steps, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expect 2 calls, got %d", calls)
+	}
+}
+
+// TestSetScriptFilter tests the following:
+// 1. Set a script filter that rewrites and rejects scripts.
+// 2. Run scripts via various entry points, and check the scripts are rewritten or rejected.
+// 3. Check the error of the filter is returned and the script is not run.
+func TestSetScriptFilter(t *testing.T) {
+	errForbidden := errors.New("forbidden")
+	var names []string
+	filter := func(name string, src []byte) ([]byte, error) {
+		names = append(names, name)
+		if bytes.Contains(src, []byte("forbidden")) {
+			return nil, errForbidden
+		}
+		return bytes.ReplaceAll(src, []byte("MAGIC"), []byte("42")), nil
+	}
+
+	b := starbox.New("test")
+	b.SetFS(fstest.MapFS{
+		"main.star":  {Data: []byte(`m = MAGIC`)},
+		"bad.star":   {Data: []byte(`forbidden = 1`)},
+		"dir/a.star": {Data: []byte(`a = MAGIC + 1`)},
+	})
+	b.SetScriptFilter(filter)
+
+	// rejected before the first run
+	if _, err := b.Run(`forbidden = 1`); !errors.Is(err, errForbidden) {
+		t.Errorf("expect forbidden error, got %v", err)
+	}
+	if s := b.String(); !strings.Contains(s, "run:0") {
+		t.Errorf("expect no run for rejected script, got %s", s)
+	}
+
+	// rewritten scripts
+	if out, err := b.Run(`x = MAGIC`); err != nil || out["x"] != int64(42) {
+		t.Errorf("expect x=42, got %v, %v", out, err)
+	}
+	if out, err := b.RunTimeout(`y = MAGIC`, time.Second); err != nil || out["y"] != int64(42) {
+		t.Errorf("expect y=42, got %v, %v", out, err)
+	}
+	if out, err := b.RunFile("main.star"); err != nil || out["m"] != int64(42) {
+		t.Errorf("expect m=42, got %v, %v", out, err)
+	}
+	if out, err := b.RunDir("dir"); err != nil || out["a"] != int64(43) {
+		t.Errorf("expect a=43, got %v, %v", out, err)
+	}
+	if out, err := b.CreateRunConfig().FileName("runner.star").Script(`z = MAGIC`).Execute(); err != nil || out["z"] != int64(42) {
+		t.Errorf("expect z=42, got %v, %v", out, err)
+	}
+	if es := []string{"box.star", "box.star", "box.star", "main.star", "dir/a.star", "runner.star"}; !reflect.DeepEqual(names, es) {
+		t.Errorf("expect filtered names %v, got %v", es, names)
+	}
+
+	// rejected after the first run
+	for name, run := range map[string]func() error{
+		"run":    func() error { _, err := b.Run(`forbidden = 1`); return err },
+		"file":   func() error { _, err := b.RunFile("bad.star"); return err },
+		"runner": func() error { _, err := b.CreateRunConfig().Script(`forbidden = 1`).Execute(); return err },
+	} {
+		if err := run(); !errors.Is(err, errForbidden) {
+			t.Errorf("expect forbidden error for %s, got %v", name, err)
+		}
+	}
+}
+
+// TestClose tests the following:
+// 1. Create a new Starbox instance and run a script.
+// 2. Close the box and check all the runs fail with ErrClosed.
+// 3. Check closing twice is a no-op.
+// 4. Check the setters are ignored after close.
+func TestClose(t *testing.T) {
+	ch := make(chan interface{}, 1)
+	b := starbox.New("test")
+	b.AddEmitChannel(ch)
+	if b.IsClosed() {
+		t.Error("expect not closed, got closed")
+		return
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if !b.IsClosed() {
+		t.Error("expect closed, got not closed")
+		return
+	}
+	if _, ok := <-ch; ok {
+		t.Error("expect emit channel closed")
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("expect nil for double close, got %v", err)
+	}
+	if b.GetMachine() != nil {
+		t.Error("expect nil machine after close")
+	}
+
+	b2 := starbox.New("test2")
+	if _, err := b2.Run(`def f(): return 1`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	_ = b2.Close()
+	b2.Reset()
+
+	tests := []struct {
+		name string
+		fn   func(b *starbox.Starbox) error
+	}{
+		{"run", func(b *starbox.Starbox) error { _, e := b.Run(`a = 1`); return e }},
+		{"run file", func(b *starbox.Starbox) error { _, e := b.RunFile("a.star"); return e }},
+		{"run timeout", func(b *starbox.Starbox) error { _, e := b.RunTimeout(`a = 1`, time.Second); return e }},
+		{"run peek", func(b *starbox.Starbox) error { _, _, e := b.RunPeek(`a = 1`); return e }},
+		{"eval", func(b *starbox.Starbox) error { _, e := b.Eval(`1`); return e }},
+		{"execute", func(b *starbox.Starbox) error { _, e := b.CreateRunConfig().Script(`a = 1`).Execute(); return e }},
+		{"call", func(b *starbox.Starbox) error { _, e := b.CallStarlarkFunc("f"); return e }},
+		{"parallel", func(b *starbox.Starbox) error {
+			_, es := b.RunParallel(`a = 1`, []starlet.StringAnyMap{{}}, 1)
+			return es[0]
+		}},
+	}
+	for _, tt := range tests {
+		for i, box := range []*starbox.Starbox{b, b2} {
+			if err := tt.fn(box); !errors.Is(err, starbox.ErrClosed) {
+				t.Errorf("%s #%d: expect closed error, got %v", tt.name, i, err)
+			}
+		}
+	}
+
+	// setters are ignored after close
+	for _, box := range []*starbox.Starbox{b, b2} {
+		box.SetScriptCache(nil)
+		box.SetModuleSet(starbox.FullModuleSet)
+		box.AddKeyValue("a", 1)
+		box.AddModuleScript("mod", `a = 1`)
+		if _, err := box.Run(`a = 1`); !errors.Is(err, starbox.ErrClosed) {
+			t.Errorf("expect closed error after setters, got %v", err)
+		}
+		if err := box.SetModuleSetWith(starbox.SafeModuleSet, "json"); !errors.Is(err, starbox.ErrClosed) {
+			t.Errorf("expect closed error for setting module set, got %v", err)
+		}
+		if err := box.AddChannel("ch", make(chan interface{})); !errors.Is(err, starbox.ErrClosed) {
+			t.Errorf("expect closed error for adding channel, got %v", err)
+		}
+		if resp, err := box.AddHTTPContextOpts(nil, starbox.HTTPContextOptions{}); resp != nil || !errors.Is(err, starbox.ErrClosed) {
+			t.Errorf("expect closed error for adding HTTP context, got %v, %v", resp, err)
+		}
+	}
+}
+
+// TestSetBoxLogger tests the following:
+// 1. Create two Starbox instances, and set a box logger for one of them.
+// 2. Trigger internal messages on both boxes.
+// 3. Check only the messages of the box with the logger are routed to it.
+func TestSetBoxLogger(t *testing.T) {
+	starbox.SetLog(hlog.NewNoopLogger().SugaredLogger)
+	core, logs := observer.New(zap.DebugLevel)
+	tenant := zap.New(core).Sugar().With("tenant", "aloha")
+
+	b1 := starbox.New("test1")
+	b1.SetBoxLogger(tenant)
+	b2 := starbox.New("test2")
+	for _, b := range []*starbox.Starbox{b1, b2} {
+		if _, err := b.Run(`a = 1`); err != nil {
+			t.Errorf("expect nil, got %v", err)
+			return
+		}
+		b.AddKeyValue("b", 2)
+	}
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Errorf("expect 1 log entry, got %d", len(entries))
+		return
+	}
+	if es := "cannot add key-value pair after execution"; entries[0].Message != es {
+		t.Errorf("expect %q, got %q", es, entries[0].Message)
+	}
+	if es := "aloha"; entries[0].ContextMap()["tenant"] != es {
+		t.Errorf("expect tenant=%q, got %v", es, entries[0].ContextMap())
+	}
+
+	// reset to the package logger
+	b1.SetBoxLogger(nil)
+	b1.AddKeyValue("c", 3)
+	if n := logs.Len(); n != 1 {
+		t.Errorf("expect 1 log entry, got %d", n)
+	}
+}
+
+// TestSetParallelModuleLoading tests the following:
+// 1. Create a new Starbox instance with a slow dynamic module loader.
+// 2. Enable parallel module loading and run a script using the modules.
+// 3. Check the modules are resolved concurrently, and the module names are stable.
+// 4. Check the first error in the order of names is returned.
+func TestSetParallelModuleLoading(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		running int
+		maxRun  int
+	)
+	loader := func(name string) (starlet.ModuleLoader, error) {
+		mu.Lock()
+		running++
+		if running > maxRun {
+			maxRun = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		if strings.HasPrefix(name, "bad") {
+			return nil, fmt.Errorf("fail to load %s", name)
+		}
+		return starlet.ModuleLoader(func() (starlark.StringDict, error) {
+			return starlark.StringDict{name + "_id": starlark.String(name)}, nil
+		}), nil
+	}
+
+	names := []string{"m5", "m1", "m4", "m2", "m3", "m0"}
+	b := starbox.New("test")
+	b.SetDynamicModuleLoader(loader)
+	b.SetParallelModuleLoading(true)
+	b.AddNamedModules(names...)
+	out, err := b.Run(`s = m0_id + m1_id + m2_id + m3_id + m4_id + m5_id`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := "m0m1m2m3m4m5"; out["s"] != es {
+		t.Errorf("expect %q, got %v", es, out["s"])
+	}
+	if es := []string{"m0", "m1", "m2", "m3", "m4", "m5"}; !reflect.DeepEqual(es, b.GetModuleNames()) {
+		t.Errorf("expect %v, got %v", es, b.GetModuleNames())
+	}
+	if runtime.NumCPU() > 1 && maxRun < 2 {
+		t.Errorf("expect concurrent loading, got max %d", maxRun)
+	}
+
+	// the first error in order
+	b2 := starbox.New("test2")
+	b2.SetDynamicModuleLoader(loader)
+	b2.SetParallelModuleLoading(true)
+	b2.AddNamedModules("m1", "bad1", "m2", "bad2")
+	if _, err := b2.Run(`a = 1`); err == nil || err.Error() != "fail to load bad1" {
+		t.Errorf("expect error for bad1, got %v", err)
+	}
+}
+
+// TestSetModuleLoadTimeout tests the following:
+// 1. Create a new Starbox instance with a slow dynamic module loader and a timeout for each module.
+// 2. Check the fast modules are loaded, and the slow module fails with the timeout error naming it.
+func TestSetModuleLoadTimeout(t *testing.T) {
+	loader := func(name string) (starlet.ModuleLoader, error) {
+		if strings.HasPrefix(name, "slow") {
+			time.Sleep(200 * time.Millisecond)
+		} else {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return starlet.ModuleLoader(func() (starlark.StringDict, error) {
+			return starlark.StringDict{name + "_id": starlark.String(name)}, nil
+		}), nil
+	}
+
+	// each module has its own timeout
+	b := starbox.New("test")
+	b.SetDynamicModuleLoader(loader)
+	b.SetModuleLoadTimeout(50 * time.Millisecond)
+	b.AddNamedModules("m1", "m2", "m3", "m4", "m5", "m6")
+	out, err := b.Run(`s = m1_id + m6_id`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := "m1m6"; out["s"] != es {
+		t.Errorf("expect %q, got %v", es, out["s"])
+	}
+
+	// the slow module times out
+	b2 := starbox.New("test2")
+	b2.SetDynamicModuleLoader(loader)
+	b2.SetModuleLoadTimeout(50 * time.Millisecond)
+	b2.AddNamedModules("m1", "slow1")
+	_, err = b2.Run(`a = 1`)
+	if !errors.Is(err, starbox.ErrModuleLoadTimeout) {
+		t.Errorf("expect module load timeout, got %v", err)
+	} else if !strings.Contains(err.Error(), "slow1") {
+		t.Errorf("expect error naming slow1, got %v", err)
+	}
+
+	// no timeout by default
+	b3 := starbox.New("test3")
+	b3.SetDynamicModuleLoader(loader)
+	b3.AddNamedModules("slow2")
+	if _, err := b3.Run(`a = slow2_id`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+}
+
+// TestSetBulkDynamicModuleLoader tests the following:
+// 1. Create a new Starbox instance with a bulk dynamic module loader.
+// 2. Check it's called once with all the unresolved names, and takes precedence over the per-name loader.
+// 3. Check the missing names and the errors of the lookup.
+func TestSetBulkDynamicModuleLoader(t *testing.T) {
+	var calls [][]string
+	bulk := func(names []string) (map[string]starlet.ModuleLoader, error) {
+		calls = append(calls, names)
+		res := make(map[string]starlet.ModuleLoader, len(names))
+		for _, name := range names {
+			if name == "bad" {
+				return nil, errors.New("registry is down")
+			}
+			if strings.HasPrefix(name, "missing") {
+				continue
+			}
+			n := name
+			res[n] = func() (starlark.StringDict, error) {
+				return starlark.StringDict{n + "_id": starlark.String(n)}, nil
+			}
+		}
+		return res, nil
+	}
+	single := func(name string) (starlet.ModuleLoader, error) {
+		t.Errorf("unexpected call of the per-name loader for %s", name)
+		return nil, nil
+	}
+
+	b := starbox.New("test")
+	b.SetDynamicModuleLoader(single)
+	b.SetBulkDynamicModuleLoader(bulk)
+	b.AddNamedModules("m2", "math", "m1", "m3")
+	out, err := b.Run(`s = m1_id + m2_id + m3_id`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := "m1m2m3"; out["s"] != es {
+		t.Errorf("expect %q, got %v", es, out["s"])
+	}
+	if es := [][]string{{"m2", "m1", "m3"}}; !reflect.DeepEqual(es, calls) {
+		t.Errorf("expect calls %v, got %v", es, calls)
+	}
+
+	// missing names
+	b2 := starbox.New("test2")
+	b2.SetBulkDynamicModuleLoader(bulk)
+	b2.AddNamedModules("m1", "missing1")
+	if _, err := b2.Run(`a = 1`); !errors.Is(err, starbox.ErrModuleNotFound) || !strings.Contains(err.Error(), "missing1") {
+		t.Errorf("expect module not found for missing1, got %v", err)
+	}
+
+	// error of the lookup
+	b3 := starbox.New("test3")
+	b3.SetBulkDynamicModuleLoader(bulk)
+	b3.AddNamedModules("m1", "bad")
+	if _, err := b3.Run(`a = 1`); err == nil || err.Error() != "registry is down" {
+		t.Errorf("expect registry error, got %v", err)
+	}
+}
+
+// TestEnableModuleIntrospection tests the following:
+// 1. Create a new Starbox instance with builtin and custom modules, and enable module introspection.
+// 2. Run a script that reads the members of the modules.
+// 3. Check the members, and the dict is not injected by default.
+func TestEnableModuleIntrospection(t *testing.T) {
+	b := starbox.New("test")
+	b.AddNamedModules("base64")
+	b.AddModuleData("data", starlark.StringDict{"b": starlark.MakeInt(2), "a": starlark.MakeInt(1)})
+	b.AddModuleLoader("flat", func() (starlark.StringDict, error) {
+		return starlark.StringDict{"y": starlark.None, "x": starlark.None}, nil
+	})
+	b.EnableModuleIntrospection()
+	out, err := b.Run(hereDoc(`
+		names = sorted(__module_members__.keys())
+		b64 = __module_members__["base64"]
+		data = __module_members__["data"]
+		flat = __module_members__["flat"]
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := []interface{}{"base64", "data", "flat"}; !reflect.DeepEqual(es, out["names"]) {
+		t.Errorf("expect names %v, got %v", es, out["names"])
+	}
+	if es := []interface{}{"decode", "encode"}; !reflect.DeepEqual(es, out["b64"]) {
+		t.Errorf("expect base64 members %v, got %v", es, out["b64"])
+	}
+	if es := []interface{}{"a", "b"}; !reflect.DeepEqual(es, out["data"]) {
+		t.Errorf("expect data members %v, got %v", es, out["data"])
+	}
+	if es := []interface{}{"x", "y"}; !reflect.DeepEqual(es, out["flat"]) {
+		t.Errorf("expect flat members %v, got %v", es, out["flat"])
+	}
+
+	// off by default
+	b2 := starbox.New("test2")
+	b2.AddNamedModules("base64")
+	if _, err := b2.Run(`a = __module_members__`); err == nil {
+		t.Error("expect error for undefined __module_members__, got nil")
+	}
+}
+
+// TestSetModulesVarName tests the following:
+// 1. Create new Starbox instances with custom or empty names for the modules variable.
+// 2. Check the names of loaded modules are injected with the given name, or not injected at all.
+func TestSetModulesVarName(t *testing.T) {
+	b := starbox.New("test")
+	b.AddNamedModules("base64")
+	b.SetModulesVarName("loaded_mods")
+	out, err := b.Run(`a = loaded_mods; __modules__ = 1; b = __modules__`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := []interface{}{"base64"}; !reflect.DeepEqual(es, out["a"]) {
+		t.Errorf("expect %v, got %v", es, out["a"])
+	}
+	if out["b"] != int64(1) {
+		t.Errorf("expect b=1, got %v", out["b"])
+	}
+
+	b2 := starbox.New("test2")
+	b2.AddNamedModules("base64")
+	b2.SetModulesVarName("")
+	if _, err := b2.Run(`a = __modules__`); err == nil {
+		t.Error("expect error for undefined __modules__, got nil")
+	}
+	if _, err := b2.Run(`a = base64.encode("A")`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+}
+
+type ctxKeyType string
+
+// TestBindContextValue tests the following:
+// 1. Bind context values to globals.
+// 2. Run with contexts with and without the keys, and check the globals.
+// 3. Run without context, and check the globals are None.
+func TestBindContextValue(t *testing.T) {
+	b := starbox.New("test")
+	b.BindContextValue(ctxKeyType("user"), "user")
+	b.BindContextValue(ctxKeyType("unused"), "roles")
+	b.BindContextValue(ctxKeyType("roles"), "roles")
+
+	script := `res = [user, roles]`
+	ctx := context.WithValue(context.Background(), ctxKeyType("user"), "alice")
+	ctx = context.WithValue(ctx, ctxKeyType("roles"), []string{"admin", "dev"})
+	out, err := b.CreateRunConfig().Script(script).Context(ctx).Execute()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{"alice", []string{"admin", "dev"}}; !reflect.DeepEqual(out["res"], es) {
+		t.Errorf("expect %#v, got %#v", es, out["res"])
+	}
+
+	// the context lacks the key
+	ctx = context.WithValue(context.Background(), ctxKeyType("user"), "bob")
+	out, err = b.CreateRunConfig().Script(script).Context(ctx).Execute()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{"bob", nil}; !reflect.DeepEqual(out["res"], es) {
+		t.Errorf("expect %#v, got %#v", es, out["res"])
+	}
+
+	// no context
+	out, err = b.Run(script)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{nil, nil}; !reflect.DeepEqual(out["res"], es) {
+		t.Errorf("expect %#v, got %#v", es, out["res"])
+	}
+
+	// unconvertible value
+	ctx = context.WithValue(context.Background(), ctxKeyType("user"), make(chan int))
+	if _, err = b.CreateRunConfig().Script(script).Context(ctx).Execute(); err == nil || !strings.Contains(err.Error(), "bind context value user") {
+		t.Errorf("expect conversion error, got %v", err)
+	}
+}
+
+// TestSetArgs tests the following:
+// 1. Set the arguments and check the argv and argc globals.
+// 2. Check the arguments are copied.
+// 3. Check nil arguments mean an empty list, and no globals without SetArgs().
+func TestSetArgs(t *testing.T) {
+	args := []string{"run", "-v", "file.txt"}
+	b := starbox.New("test")
+	b.SetArgs(args)
+	args[0] = "changed"
+	out, err := b.Run(hereDoc(`
+		first = argv[0]
+		n = argc
+		flags = [a for a in argv if a.startswith("-")]
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["first"] != "run" || out["n"] != int64(3) || !reflect.DeepEqual(out["flags"], []interface{}{"-v"}) {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	b = starbox.New("test")
+	b.SetArgs(nil)
+	out, err = b.Run(`n = argc; l = argv`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["n"] != int64(0) || !reflect.DeepEqual(out["l"], []interface{}{}) {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	if _, err = starbox.New("test").Run(`l = argv`); err == nil {
+		t.Errorf("expect error for undefined argv, got nil")
+	}
+}
+
+// TestEnableInclude tests the following:
+// 1. Add builtin modules and module scripts, and enable include.
+// 2. Include the modules with and without the suffix, and check the precedence.
+// 3. Include a missing module, and check the error.
+// 4. Check include is not available unless enabled.
+func TestEnableInclude(t *testing.T) {
+	b := starbox.New("test")
+	b.AddNamedModules("runtime")
+	b.AddModuleScript("runtime", `pid = "ABC"`)
+	b.AddModuleScript("util", hereDoc(`
+		def double(x):
+			return x * 2
+		name = "util"
+	`))
+	b.EnableInclude()
+	out, err := b.Run(hereDoc(`
+		r1 = type(include("runtime").pid)
+		r2 = type(include("runtime.star").pid)
+		u1 = include("util")
+		u2 = include("util.star")
+		v = [u1.double(2), u2.double(3), u1.name]
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["r1"] != "int" || out["r2"] != "int" {
+		t.Errorf("expect builtin module wins, got %v, %v", out["r1"], out["r2"])
+	}
+	if es := []interface{}{int64(4), int64(6), "util"}; !reflect.DeepEqual(out["v"], es) {
+		t.Errorf("expect %v, got %v", es, out["v"])
+	}
+
+	if _, err = b.Run(`include("missing")`); err == nil || !strings.Contains(err.Error(), "cannot include missing") {
+		t.Errorf("expect include error, got %v", err)
+	}
+
+	if _, err = starbox.New("test").Run(`include("runtime")`); err == nil {
+		t.Errorf("expect error for undefined include, got nil")
+	}
+}
+
+// point is a custom Starlark type for tests.
+type point struct {
+	x, y int64
+}
+
+func (p *point) String() string        { return fmt.Sprintf("point(%d, %d)", p.x, p.y) }
+func (p *point) Type() string          { return "point" }
+func (p *point) Freeze()               {}
+func (p *point) Truth() starlark.Bool  { return p.x != 0 || p.y != 0 }
+func (p *point) Hash() (uint32, error) { return uint32(p.x ^ p.y), nil }
+func (p *point) AttrNames() []string   { return []string{"x", "y"} }
+func (p *point) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "x":
+		return starlark.MakeInt64(p.x), nil
+	case "y":
+		return starlark.MakeInt64(p.y), nil
+	}
+	return nil, nil
+}
+
+// TestAddTypedFunc tests the following:
+// 1. Add typed Go functions with various signatures, and call them in the script.
+// 2. Check the errors of the functions and the mismatched arguments.
+// 3. Add an invalid function, and expect it to be ignored.
+func TestAddTypedFunc(t *testing.T) {
+	b := starbox.New("test")
+	b.AddTypedFunc("div", func(a, b float64) (float64, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return a / b, nil
+	})
+	b.AddTypedFunc("repeat", func(s string, n int) string { return strings.Repeat(s, n) })
+	b.AddTypedFunc("sum", func(base int, nums ...int) int {
+		for _, n := range nums {
+			base += n
+		}
+		return base
+	})
+	b.AddTypedFunc("join", func(l []string, sep string) string { return strings.Join(l, sep) })
+	b.AddTypedFunc("keys", func(m map[string]int) int { return len(m) })
+	b.AddTypedFunc("kind", func(v starlark.Value) string { return v.Type() })
+	b.AddTypedFunc("split", func(n int) (int, int) { return n / 2, n % 2 })
+	b.AddTypedFunc("noop", func() {})
+	b.AddTypedFunc("bad", "not a function")
+
+	out, err := b.Run(hereDoc(`
+		a = div(7, 2)
+		b = repeat("ab", 3)
+		c = sum(1) + sum(1, 2, 3)
+		d = join(["x", "y"], "-")
+		e = keys({"a": 1, "b": 2})
+		f = kind((1, 2))
+		g = split(7)
+		h = noop()
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["a"] != 3.5 || out["b"] != "ababab" || out["c"] != int64(7) || out["d"] != "x-y" || out["e"] != int64(2) || out["f"] != "tuple" || out["h"] != nil {
+		t.Errorf("unexpected output: %v", out)
+	}
+	if g, ok := out["g"].([]interface{}); !ok || len(g) != 2 || g[0] != int64(3) || g[1] != int64(1) {
+		t.Errorf("unexpected tuple output: %v", out["g"])
+	}
+	if _, ok := out["bad"]; ok {
+		t.Errorf("expect invalid func to be ignored")
+	}
+
+	// errors
+	for script, want := range map[string]string{
+		`div(1, 0)`:          "division by zero",
+		`div(1)`:             "div: ",
+		`repeat(1, 2)`:       "for parameter 1",
+		`repeat("a", "b")`:   "for parameter 2",
+		`sum()`:              "sum: ",
+		`join([1], ",")`:     "join: ",
+		`repeat(s="a", n=1)`: "repeat: ",
+		`bad()`:              "undefined: bad",
+	} {
+		if _, err := b.Run(script); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("expect error with %q for %s, got %v", want, script, err)
+		}
+	}
+}
+
+// TestAddType tests the following:
+// 1. Add a constructor of custom type.
+// 2. Run a script that creates and uses the custom values.
+// 3. Check the custom value is kept as-is in the output.
+// 4. Check the errors of the constructor and keyword arguments.
+func TestAddType(t *testing.T) {
+	b := starbox.New("test")
+	b.AddType("point", func(args ...interface{}) (starlark.Value, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("want 2 arguments, got %d", len(args))
+		}
+		x, ok1 := args[0].(int64)
+		y, ok2 := args[1].(int64)
+		if !ok1 || !ok2 {
+			return nil, errors.New("want int arguments")
+		}
+		return &point{x: x, y: y}, nil
+	})
+	out, err := b.Run(hereDoc(`
+		p = point(3, 4)
+		d = p.x * p.x + p.y * p.y
+		t = type(p)
+		s = str(p)
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["d"] != int64(25) || out["t"] != "point" || out["s"] != "point(3, 4)" {
+		t.Errorf("unexpected output: %v", out)
+	}
+	if p, ok := out["p"].(*point); !ok || p.x != 3 || p.y != 4 {
+		t.Errorf("expect custom value as-is, got %T %v", out["p"], out["p"])
+	}
+
+	// errors
+	for _, script := range []string{`point(1)`, `point("a", "b")`, `point(1, y=2)`} {
+		if _, err := b.Run(script); err == nil || !strings.Contains(err.Error(), "point: ") {
+			t.Errorf("expect error for %s, got %v", script, err)
+		}
+	}
+}
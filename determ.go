@@ -0,0 +1,348 @@
+package starbox
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/1set/starlet"
+	tps "github.com/1set/starlet/dataconv/types"
+	librandom "github.com/1set/starlet/lib/random"
+	guuid "github.com/google/uuid"
+	stdtime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	randomModuleName = "random"
+)
+
+// SetRandomSeed replaces the random module with a pseudo-random one seeded with the given seed, so the values it generates are the same for the same scripts in the same order.
+// The seeded module has the same functions as the starlet random module, but it's not cryptographically secure.
+// It panics if called after execution.
+func (s *Starbox) SetRandomSeed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set random seed") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set random seed after execution")
+	}
+	s.markChanged()
+	s.randSeed, s.seeded = seed, true
+}
+
+// SetClock fixes the clock of the time module to the given time, so time.now() always returns it.
+// It panics if called after execution.
+func (s *Starbox) SetClock(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set clock") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set clock after execution")
+	}
+	s.markChanged()
+	s.clock, s.fixClock = t, true
+}
+
+// SetDeterministic turns off the sources of nondeterminism of the box in one call for reproducible results, it works like SetRandomSeed() and SetClock() together:
+//
+//   - random: all functions of the random module, including random.uuid(), are seeded with the given seed;
+//   - time: time.now() always returns the Unix epoch in UTC, or the time set by a later SetClock().
+//
+// Starlark dicts and sets always iterate in the insertion order, and __modules__ and SetGlobalCallback() use sorted names, so they're reproducible already.
+// Other sources like the duration of runs, the sleep() and the modules that access the network or file system are not controlled.
+// It panics if called after execution.
+func (s *Starbox) SetDeterministic(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set deterministic") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set deterministic after execution")
+	}
+	s.markChanged()
+	s.randSeed, s.seeded = seed, true
+	s.clock, s.fixClock = time.Unix(0, 0).UTC(), true
+}
+
+// setThreadClock fixes the clock of the time module for the thread if it's set.
+func (s *Starbox) setThreadClock(thread *starlark.Thread) {
+	if !s.fixClock {
+		return
+	}
+	clock := s.clock
+	stdtime.SetNow(thread, func() (time.Time, error) {
+		return clock, nil
+	})
+}
+
+// threadNow returns the current time in UTC for the thread, which is the fixed clock of the time module if it's set on the thread.
+func threadNow(thread *starlark.Thread) time.Time {
+	if thread != nil {
+		if now := stdtime.Now(thread); now != nil {
+			if t, err := now(); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return time.Now().UTC()
+}
+
+// seededRandomLoader returns the loader of the random module with a pseudo-random source of the given seed, the source is shared by all the modules loaded by it.
+// It wraps the starlet random module, which reads crypto/rand directly without a hook for the source, so the functions of the module are replaced by the seeded ones with the same arguments, and the other members are kept as is.
+func seededRandomLoader(seed int64) starlet.ModuleLoader {
+	r := &seededRandom{rng: rand.New(rand.NewSource(seed))}
+	funcs := map[string]func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error){
+		"randbytes": r.randbytes,
+		"randstr":   r.randstr,
+		"randb32":   r.randb32,
+		"randint":   r.randint,
+		"choice":    r.choice,
+		"choices":   r.choices,
+		"shuffle":   r.shuffle,
+		"random":    r.random,
+		"uniform":   r.uniform,
+		"uuid":      r.uuid,
+	}
+	return func() (starlark.StringDict, error) {
+		sd, err := librandom.LoadModule()
+		if err != nil {
+			return nil, err
+		}
+		mod, ok := sd[librandom.ModuleName].(*starlarkstruct.Module)
+		if !ok {
+			return nil, fmt.Errorf("unexpected random module: %v", sd[librandom.ModuleName])
+		}
+		members := make(starlark.StringDict, len(mod.Members))
+		for name, v := range mod.Members {
+			members[name] = v
+		}
+		for name, fn := range funcs {
+			members[name] = starlark.NewBuiltin(randomModuleName+"."+name, fn)
+		}
+		return starlark.StringDict{
+			randomModuleName: &starlarkstruct.Module{Name: mod.Name, Members: members},
+		}, nil
+	}
+}
+
+// seededRandom implements the functions of the random module with a pseudo-random source.
+type seededRandom struct {
+	rng *rand.Rand
+}
+
+// defaultRandLen is the default length for randbytes(), randstr() and randb32().
+const defaultRandLen = 10
+
+// randLen returns the length from the optional argument, or the default length if it's not positive.
+func randLen(n starlark.Int) int {
+	if l, ok := n.Int64(); ok && l > 0 {
+		return int(l)
+	}
+	return defaultRandLen
+}
+
+// randbytes(n) returns a random byte string of length n.
+func (r *seededRandom) randbytes(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var n starlark.Int
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "n?", &n); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, randLen(n))
+	r.rng.Read(buf)
+	return starlark.Bytes(buf), nil
+}
+
+// randstr(chars, n) returns a random string of given length from given characters.
+func (r *seededRandom) randstr(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		chars starlark.String
+		n     starlark.Int
+	)
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "chars", &chars, "n?", &n); err != nil {
+		return nil, err
+	}
+	if chars == "" {
+		return nil, errors.New(`chars must not be empty`)
+	}
+	return starlark.String(r.randString(string(chars), randLen(n))), nil
+}
+
+// randb32(n, sep) returns a random base32 string of length n with optional separator dash for every sep characters.
+func (r *seededRandom) randb32(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var n, sep starlark.Int
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "n?", &n, "sep?", &sep); err != nil {
+		return nil, err
+	}
+	s := r.randString(`ABCDEFGHIJKLMNOPQRSTUVWXYZ234567`, randLen(n))
+	if m, ok := sep.Int64(); ok && m > 0 && int(m) < len(s) {
+		buf := make([]byte, 0, len(s)+len(s)/int(m))
+		for i := 0; i < len(s); i++ {
+			if i > 0 && i%int(m) == 0 {
+				buf = append(buf, '-')
+			}
+			buf = append(buf, s[i])
+		}
+		s = string(buf)
+	}
+	return starlark.String(s), nil
+}
+
+// randint(a, b) returns a random integer N such that a <= N <= b.
+func (r *seededRandom) randint(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var a, b starlark.Int
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "a", &a, "b", &b); err != nil {
+		return nil, err
+	}
+	diff := new(big.Int).Sub(b.BigInt(), a.BigInt())
+	if diff.Sign() < 0 {
+		return nil, errors.New(`a must be less than or equal to b`)
+	}
+	diff.Add(diff, big.NewInt(1))
+	n := new(big.Int).Rand(r.rng, diff)
+	return starlark.MakeBigInt(n.Add(n, a.BigInt())), nil
+}
+
+// choice(seq) returns a random element from the non-empty sequence seq.
+func (r *seededRandom) choice(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var seq starlark.Indexable
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "seq", &seq); err != nil {
+		return nil, err
+	}
+	if seq.Len() == 0 {
+		return nil, errors.New(`cannot choose from an empty sequence`)
+	}
+	return seq.Index(r.rng.Intn(seq.Len())), nil
+}
+
+// choices(population, weights, cum_weights, k) returns a k sized list of elements chosen from the population with replacement.
+func (r *seededRandom) choices(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		population starlark.Indexable
+		weights    *starlark.List
+		cumWeights *starlark.List
+		k          = 1
+	)
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "population", &population, "weights?", &weights, "cum_weights?", &cumWeights, "k?", &k); err != nil {
+		return nil, err
+	}
+	n := population.Len()
+	if n == 0 {
+		return nil, errors.New("population is empty")
+	}
+	if k <= 0 {
+		return starlark.NewList(nil), nil
+	}
+	if weights != nil && cumWeights != nil {
+		return nil, errors.New("cannot specify both weights and cumulative weights")
+	}
+
+	// get or calculate cumulative weights
+	var cum []float64
+	for i, l := range []*starlark.List{weights, cumWeights} {
+		if l == nil {
+			continue
+		}
+		if l.Len() != n {
+			return nil, errors.New("the number of weights does not match the population")
+		}
+		cum = make([]float64, n)
+		sum := 0.0
+		for j := 0; j < n; j++ {
+			var w tps.FloatOrInt
+			if err := w.Unpack(l.Index(j)); err != nil {
+				return nil, errors.New("weights must be numeric")
+			}
+			if i == 0 {
+				sum += float64(w)
+			} else if sum = float64(w); j > 0 && sum < cum[j-1] {
+				return nil, errors.New("cumulative weights must be non-decreasing")
+			}
+			cum[j] = sum
+		}
+	}
+	if cum != nil && !(cum[n-1] > 0) {
+		return nil, errors.New("total of weights must be greater than zero")
+	}
+
+	// choose the elements
+	res := make([]starlark.Value, k)
+	for i := range res {
+		if cum == nil {
+			res[i] = population.Index(r.rng.Intn(n))
+		} else {
+			res[i] = population.Index(sort.SearchFloat64s(cum, r.rng.Float64()*cum[n-1]))
+		}
+	}
+	return starlark.NewList(res), nil
+}
+
+// shuffle(x) shuffles the sequence x in place.
+func (r *seededRandom) shuffle(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var seq starlark.HasSetIndex
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "seq", &seq); err != nil {
+		return nil, err
+	}
+	for i := seq.Len() - 1; i > 0; i-- {
+		j := r.rng.Intn(i + 1)
+		x, y := seq.Index(i), seq.Index(j)
+		if err := seq.SetIndex(i, y); err != nil {
+			return nil, err
+		}
+		if err := seq.SetIndex(j, x); err != nil {
+			return nil, err
+		}
+	}
+	return starlark.None, nil
+}
+
+// random() returns a random floating point number in the range 0.0 <= X < 1.0.
+func (r *seededRandom) random(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(bn.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.Float(r.rng.Float64()), nil
+}
+
+// uniform(a, b) returns a random floating point number N such that a <= N <= b for a <= b and b <= N <= a for b < a.
+func (r *seededRandom) uniform(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var a, b tps.FloatOrInt
+	if err := starlark.UnpackArgs(bn.Name(), args, kwargs, "a", &a, "b", &b); err != nil {
+		return nil, err
+	}
+	return starlark.Float(float64(a) + float64(b-a)*r.rng.Float64()), nil
+}
+
+// uuid() returns a random UUID (RFC 4122 version 4).
+func (r *seededRandom) uuid(thread *starlark.Thread, bn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(bn.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	u, err := guuid.NewRandomFromReader(r.rng)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.String(u.String()), nil
+}
+
+// randString returns a random string of given length from given characters.
+func (r *seededRandom) randString(chars string, n int) string {
+	runes := []rune(chars)
+	buf := make([]rune, n)
+	for i := range buf {
+		buf[i] = runes[r.rng.Intn(len(runes))]
+	}
+	return string(buf)
+}
@@ -0,0 +1,154 @@
+package starbox_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1set/starbox"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+var randomScript = hereDoc(`
+	load("random", "randint", "choice", "choices", "shuffle", "random", "uniform", "uuid", "randstr", "randb32", "randbytes")
+	l = list(range(10))
+	shuffle(l)
+	r = [randint(1, 100), choice("abcdef"), choices([1, 2, 3], weights=[1, 0, 1], k=4), random(), uniform(1, 2), uuid(), randstr("xyz", 5), randb32(8, 4), len(randbytes(3)), l]
+`)
+
+// TestSetRandomSeed tests the following:
+// 1. Run the same script with random functions in two boxes with the same seed.
+// 2. Check the results are the same, and different for another seed.
+func TestSetRandomSeed(t *testing.T) {
+	run := func(seed int64) interface{} {
+		b := starbox.New("test")
+		b.AddNamedModules("random")
+		b.SetRandomSeed(seed)
+		out, err := b.Run(randomScript)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return nil
+		}
+		return out["r"]
+	}
+
+	r1, r2, r3 := run(42), run(42), run(43)
+	if r1 == nil {
+		return
+	}
+	if !reflect.DeepEqual(r1, r2) {
+		t.Errorf("expect same results for same seed, got %v and %v", r1, r2)
+	}
+	if reflect.DeepEqual(r1, r3) {
+		t.Errorf("expect different results for different seeds, got %v", r1)
+	}
+
+	// check the values
+	res := r1.([]interface{})
+	if n := res[0].(int64); n < 1 || n > 100 {
+		t.Errorf("expect randint in range, got %d", n)
+	}
+	for _, c := range res[2].([]interface{}) {
+		if c == int64(2) {
+			t.Errorf("expect no zero-weight choice, got %v", res[2])
+		}
+	}
+	if u := res[5].(string); len(u) != 36 || u[14] != '4' {
+		t.Errorf("expect uuid v4, got %q", u)
+	}
+	if s := res[7].(string); len(s) != 9 || s[4] != '-' {
+		t.Errorf("expect separated base32 string, got %q", s)
+	}
+	if n := res[8].(int64); n != 3 {
+		t.Errorf("expect 3 random bytes, got %d", n)
+	}
+}
+
+// TestSetRandomSeed_Members tests the seeded random module has the same members as the starlet random module, and all the functions of it are replaced by the seeded ones.
+func TestSetRandomSeed_Members(t *testing.T) {
+	run := func(seeded bool) starlark.StringDict {
+		b := starbox.New("test")
+		b.AddNamedModules("random")
+		if seeded {
+			b.SetRandomSeed(1)
+		}
+		if _, err := b.Run(`m = random`); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return nil
+		}
+		v, _ := b.GetStarlarkResult("m")
+		mod, ok := v.(*starlarkstruct.Module)
+		if !ok {
+			t.Errorf("expect module, got %T", v)
+			return nil
+		}
+		return mod.Members
+	}
+	m1, m2 := run(false), run(true)
+	if n1, n2 := m1.Keys(), m2.Keys(); !reflect.DeepEqual(n1, n2) {
+		t.Errorf("expect same members, got %v and %v", n1, n2)
+	}
+	for name, v := range m1 {
+		if _, ok := v.(*starlark.Builtin); ok && m2[name] == v {
+			t.Errorf("expect function %s replaced by the seeded one", name)
+		}
+	}
+}
+
+// TestSetClock tests the clock of the time module is fixed.
+func TestSetClock(t *testing.T) {
+	ts := time.Date(2024, 2, 29, 12, 30, 0, 0, time.UTC)
+	b := starbox.New("test")
+	b.AddNamedModules("time")
+	b.SetClock(ts)
+	out, err := b.Run(hereDoc(`
+		a = time.now().unix
+		b = time.now().year
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["a"] != ts.Unix() || out["b"] != int64(2024) {
+		t.Errorf("expect fixed clock, got %v", out)
+	}
+}
+
+// TestSetDeterministic tests the following:
+// 1. Run the same script with random functions and the clock in two boxes.
+// 2. Check the results are the same, and the clock is the Unix epoch.
+// 3. Check the clock can be overridden by SetClock().
+func TestSetDeterministic(t *testing.T) {
+	script := randomScript + "\nnow = time.now().unix\n"
+	run := func(clock *time.Time) map[string]interface{} {
+		b := starbox.New("test")
+		b.AddNamedModules("random", "time")
+		b.SetDeterministic(7)
+		if clock != nil {
+			b.SetClock(*clock)
+		}
+		out, err := b.Run(script)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return nil
+		}
+		return out
+	}
+
+	o1, o2 := run(nil), run(nil)
+	if o1 == nil {
+		return
+	}
+	if !reflect.DeepEqual(o1, o2) {
+		t.Errorf("expect same results, got %v and %v", o1, o2)
+	}
+	if o1["now"] != int64(0) {
+		t.Errorf("expect clock at epoch, got %v", o1["now"])
+	}
+
+	ts := time.Unix(1700000000, 0)
+	if o3 := run(&ts); o3 == nil || o3["now"] != ts.Unix() || !reflect.DeepEqual(o1["r"], o3["r"]) {
+		t.Errorf("expect overridden clock and same random results, got %v", o3)
+	}
+}
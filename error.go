@@ -0,0 +1,215 @@
+package starbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// ErrorKind defines the category of a normalized error.
+type ErrorKind string
+
+const (
+	// ErrorKindSyntax is for errors in parsing or resolving the script, e.g. invalid syntax or undefined names.
+	ErrorKindSyntax ErrorKind = "syntax"
+	// ErrorKindRuntime is for errors raised during the execution of the script.
+	ErrorKindRuntime ErrorKind = "runtime"
+	// ErrorKindTimeout is for runs that exceed the deadline of the context.
+	ErrorKindTimeout ErrorKind = "timeout"
+	// ErrorKindCancel is for runs that are cancelled, including the timeouts of other sources which are only reported as cancellation by Starlark.
+	ErrorKindCancel ErrorKind = "cancel"
+	// ErrorKindModule is for errors in resolving or loading modules.
+	ErrorKindModule ErrorKind = "module"
+	// ErrorKindUnknown is for errors of unknown types.
+	ErrorKindUnknown ErrorKind = "unknown"
+)
+
+// RunError is a normalized error of a run, with the category, message and location of the error.
+// Thread is the name of the thread raising the runtime error if it's set by SetThreadName(), or empty otherwise.
+type RunError struct {
+	Kind      ErrorKind
+	Message   string
+	File      string
+	Line      int
+	Col       int
+	Backtrace string
+	Thread    string
+	err       error
+}
+
+// Error returns the message with the location of the error if available.
+func (e *RunError) Error() string {
+	if e.File != "" && e.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Message)
+	}
+	return e.Message
+}
+
+// Unwrap returns the original error.
+func (e *RunError) Unwrap() error {
+	return e.err
+}
+
+// NormalizeError converts the error returned by runs into a RunError, by unwrapping the known error types of Starlark, Starlet and Starbox.
+// Unknown errors are of ErrorKindUnknown with the raw message, and it returns nil for nil error.
+// Starlark reports both cancellation and timeout of the context as cancellation, so timeouts are only detected if the error wraps context.DeadlineExceeded.
+func NormalizeError(err error) *RunError {
+	if err == nil {
+		return nil
+	}
+	var re *RunError
+	if errors.As(err, &re) {
+		return re
+	}
+
+	re = &RunError{Kind: ErrorKindUnknown, Message: err.Error(), err: err}
+	var (
+		se syntax.Error
+		rl resolve.ErrorList
+		ee *starlark.EvalError
+	)
+	switch {
+	case errors.As(err, &se):
+		re.Kind = ErrorKindSyntax
+		re.Message = se.Msg
+		re.setPos(se.Pos)
+	case errors.As(err, &rl) && len(rl) > 0:
+		re.Kind = ErrorKindSyntax
+		re.Message = rl[0].Msg
+		re.setPos(rl[0].Pos)
+	case errors.Is(err, ErrModuleNotFound), errors.Is(err, ErrModuleConflict), errors.Is(err, ErrModuleLoadTimeout):
+		re.Kind = ErrorKindModule
+	case errors.Is(err, context.DeadlineExceeded):
+		re.Kind = ErrorKindTimeout
+	case errors.Is(err, context.Canceled):
+		re.Kind = ErrorKindCancel
+	}
+
+	// the location, backtrace and thread of runtime errors
+	var be *backtraceError
+	if errors.As(err, &be) {
+		re.Thread = be.thread
+	}
+	if errors.As(err, &ee) {
+		re.Message = ee.Msg
+		re.Backtrace = ee.Backtrace()
+		// the innermost frame with a valid position, skipping the builtins
+		for i := len(ee.CallStack) - 1; i >= 0; i-- {
+			if pos := ee.CallStack[i].Pos; pos.IsValid() && pos.Line > 0 {
+				re.setPos(pos)
+				break
+			}
+		}
+		if re.Kind == ErrorKindUnknown {
+			switch {
+			case strings.HasPrefix(ee.Msg, "Starlark computation cancelled"):
+				re.Kind = ErrorKindCancel
+			case strings.HasPrefix(ee.Msg, "cannot load "):
+				re.Kind = ErrorKindModule
+			default:
+				re.Kind = ErrorKindRuntime
+			}
+		}
+	}
+	return re
+}
+
+// setPos sets the location of the error from the given position.
+func (e *RunError) setPos(pos syntax.Position) {
+	if !pos.IsValid() || pos.Line <= 0 {
+		return
+	}
+	e.File = pos.Filename()
+	e.Line = int(pos.Line)
+	e.Col = int(pos.Col)
+}
+
+// SetIncludeBacktrace sets whether the errors of runs are guaranteed to include the Starlark backtrace of the call stack in the message.
+// It's off by default to leave the messages as they are, and the backtrace is always available from NormalizeError() or the wrapped *starlark.EvalError.
+// It panics if called after execution.
+func (s *Starbox) SetIncludeBacktrace(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set include backtrace") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set include backtrace after execution")
+	}
+	s.markChanged()
+	s.withTrace = enabled
+}
+
+// traceError appends the Starlark backtrace to the message of the given run error if it's enabled and not included yet, and tags it with the thread name if it's set by SetThreadName() for NormalizeError(), the original error is kept for unwrapping.
+func (s *Starbox) traceError(err error) error {
+	if err == nil || (!s.withTrace && s.thName == "") {
+		return err
+	}
+	var ee *starlark.EvalError
+	if !errors.As(err, &ee) {
+		return err
+	}
+	msg := err.Error()
+	if bt := ee.Backtrace(); s.withTrace && !strings.Contains(msg, bt) {
+		msg += "\n" + bt
+	} else if s.thName == "" {
+		return err
+	}
+	return &backtraceError{msg: msg, thread: s.thName, err: err}
+}
+
+// backtraceError is an error with the message of the original error and the Starlark backtrace, and the name of the thread raising it.
+type backtraceError struct {
+	msg    string
+	thread string
+	err    error
+}
+
+// Error returns the message with the backtrace.
+func (e *backtraceError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the original error.
+func (e *backtraceError) Unwrap() error {
+	return e.err
+}
+
+// wrapContextError wraps the error of a run with the error of the context if the context is done, so the error is compatible with context.Canceled or context.DeadlineExceeded, even if Starlark only reports the cancellation of the computation.
+func wrapContextError(ctx context.Context, err error) error {
+	if ctx == nil || err == nil {
+		return err
+	}
+	ce := ctx.Err()
+	if ce == nil || errors.Is(err, ce) {
+		return err
+	}
+	return &contextError{ctxErr: ce, err: err}
+}
+
+// contextError is an error of a run cancelled by the context, it matches the error of the context by errors.Is() and unwraps to the original error.
+type contextError struct {
+	ctxErr error
+	err    error
+}
+
+// Error returns the message of the context error and the original error.
+func (e *contextError) Error() string {
+	return e.ctxErr.Error() + ": " + e.err.Error()
+}
+
+// Is reports whether the target is the error of the context.
+func (e *contextError) Is(target error) bool {
+	return target == e.ctxErr
+}
+
+// Unwrap returns the original error.
+func (e *contextError) Unwrap() error {
+	return e.err
+}
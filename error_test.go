@@ -0,0 +1,217 @@
+package starbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1set/starbox"
+	"go.starlark.net/starlark"
+)
+
+// TestNormalizeError tests the following:
+// 1. Run scripts with different kinds of errors.
+// 2. Normalize the errors and check the kind, message and location.
+func TestNormalizeError(t *testing.T) {
+	tests := []struct {
+		name    string
+		run     func() error
+		kind    starbox.ErrorKind
+		message string
+		line    int
+		col     int
+	}{
+		{
+			name: "syntax",
+			run: func() error {
+				_, err := starbox.New("test").Run(`a = `)
+				return err
+			},
+			kind:    starbox.ErrorKindSyntax,
+			message: "got end of file, want primary expression",
+			line:    1,
+			col:     5,
+		},
+		{
+			name: "undefined",
+			run: func() error {
+				_, err := starbox.New("test").Run(`a = b`)
+				return err
+			},
+			kind:    starbox.ErrorKindSyntax,
+			message: "undefined: b",
+			line:    1,
+			col:     5,
+		},
+		{
+			name: "runtime",
+			run: func() error {
+				_, err := starbox.New("test").Run(hereDoc(`
+					def f():
+						return 1 // 0
+					f()
+				`))
+				return err
+			},
+			kind:    starbox.ErrorKindRuntime,
+			message: "floored division by zero",
+			line:    2,
+			col:     11,
+		},
+		{
+			name: "load",
+			run: func() error {
+				_, err := starbox.New("test").Run(`load("nope", "x")`)
+				return err
+			},
+			kind:    starbox.ErrorKindModule,
+			message: "cannot load nope: no file system given",
+			line:    1,
+			col:     1,
+		},
+		{
+			name: "module not found",
+			run: func() error {
+				b := starbox.New("test")
+				b.AddNamedModules("nope")
+				_, err := b.Run(`a = 1`)
+				return err
+			},
+			kind:    starbox.ErrorKindModule,
+			message: "module not found",
+		},
+		{
+			name: "run timeout",
+			run: func() error {
+				_, err := starbox.New("test").RunTimeout(`for i in range(100000000): pass`, 50*time.Millisecond)
+				return err
+			},
+			kind:    starbox.ErrorKindTimeout,
+			message: "Starlark computation cancelled: context cancelled",
+			line:    1,
+			col:     1,
+		},
+		{
+			name: "cancel",
+			run: func() error {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(50*time.Millisecond, cancel)
+				_, err := starbox.New("test").CreateRunConfig().Context(ctx).Script(`for i in range(100000000): pass`).Execute()
+				return err
+			},
+			kind:    starbox.ErrorKindCancel,
+			message: "Starlark computation cancelled: context cancelled",
+			line:    1,
+			col:     1,
+		},
+		{
+			name: "timeout",
+			run: func() error {
+				return fmt.Errorf("wait: %w", context.DeadlineExceeded)
+			},
+			kind:    starbox.ErrorKindTimeout,
+			message: "wait: context deadline exceeded",
+		},
+		{
+			name: "unknown",
+			run: func() error {
+				return errors.New("boom")
+			},
+			kind:    starbox.ErrorKindUnknown,
+			message: "boom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			re := starbox.NormalizeError(err)
+			if re == nil {
+				t.Errorf("expect normalized error, got nil for %v", err)
+				return
+			}
+			if re.Kind != tt.kind {
+				t.Errorf("expect kind %q, got %q", tt.kind, re.Kind)
+			}
+			if re.Message != tt.message {
+				t.Errorf("expect message %q, got %q", tt.message, re.Message)
+			}
+			if re.Line != tt.line || re.Col != tt.col {
+				t.Errorf("expect position %d:%d, got %d:%d", tt.line, tt.col, re.Line, re.Col)
+			}
+			if tt.line > 0 && re.File != "box.star" {
+				t.Errorf("expect file box.star, got %q", re.File)
+			}
+			if errors.Unwrap(re) == nil {
+				t.Errorf("expect wrapping the original error, got %v", re)
+			}
+		})
+	}
+
+	if re := starbox.NormalizeError(nil); re != nil {
+		t.Errorf("expect nil, got %v", re)
+	}
+}
+
+// TestNormalizeError_Backtrace tests the backtrace of runtime errors is kept.
+func TestNormalizeError_Backtrace(t *testing.T) {
+	_, err := starbox.New("test").Run(hereDoc(`
+		def f():
+			fail("oops")
+		f()
+	`))
+	re := starbox.NormalizeError(err)
+	if re == nil || !strings.Contains(re.Backtrace, "in f") || !strings.Contains(re.Backtrace, "in <toplevel>") {
+		t.Errorf("expect backtrace with frames, got %v", re)
+		return
+	}
+	if es := "box.star:2:6: fail: oops"; re.Error() != es {
+		t.Errorf("expect %q, got %q", es, re.Error())
+	}
+}
+
+// TestSetIncludeBacktrace tests the following:
+// 1. Run a script with an error in nested functions with the backtrace enabled.
+// 2. Check the backtrace frames in the error message, and it's included only once.
+// 3. Check the original error is kept.
+func TestSetIncludeBacktrace(t *testing.T) {
+	b := starbox.New("test")
+	b.SetIncludeBacktrace(true)
+	_, err := b.Run(hereDoc(`
+		def inner():
+			return 1 // 0
+		def outer():
+			return inner()
+		outer()
+	`))
+	if err == nil {
+		t.Errorf("expect error, got nil")
+		return
+	}
+	msg := err.Error()
+	for _, f := range []string{"floored division by zero", "Traceback (most recent call last):", "box.star:5:6: in <toplevel>", "box.star:4:14: in outer", "box.star:2:11: in inner"} {
+		if !strings.Contains(msg, f) {
+			t.Errorf("expect %q in message, got %q", f, msg)
+		}
+	}
+	if n := strings.Count(msg, "Traceback"); n != 1 {
+		t.Errorf("expect backtrace once, got %d in %q", n, msg)
+	}
+	var ee *starlark.EvalError
+	if !errors.As(err, &ee) {
+		t.Errorf("expect wrapped eval error, got %T", err)
+		return
+	}
+	if re := starbox.NormalizeError(err); re.Kind != starbox.ErrorKindRuntime || re.Line != 2 {
+		t.Errorf("unexpected normalized error: %+v", re)
+	}
+
+	// for errors without backtrace
+	b = starbox.New("test")
+	b.SetIncludeBacktrace(true)
+	if _, err := b.Run(`a = `); err == nil || strings.Contains(err.Error(), "Traceback") {
+		t.Errorf("expect syntax error without backtrace, got %v", err)
+	}
+}
@@ -1,11 +1,37 @@
 package starbox
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/1set/starlet"
+	"github.com/1set/starlet/lib/goidiomatic"
+	"github.com/1set/starlight/convert"
 	"github.com/psanford/memfs"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+var (
+	// ErrNotExecuted is the error for accessing the runtime state of a Starbox instance before the first run.
+	ErrNotExecuted = errors.New("starbox has not been executed")
+	// ErrClosed is the error for running a Starbox instance after it's closed.
+	ErrClosed = errors.New("starbox is closed")
+	// ErrMissingOutputs is the error for a run by RunExpect() that doesn't define all the required outputs.
+	ErrMissingOutputs = errors.New("missing required outputs")
+	// ErrPrintWarnings is the error for RunStrict() when the script printed warnings.
+	ErrPrintWarnings = errors.New("script printed warnings")
 )
 
 // Run executes a script and returns the converted output.
@@ -19,9 +45,133 @@ func (s *Starbox) Run(script string) (starlet.StringAnyMap, error) {
 	}
 
 	// run
-	s.hasExec = true
-	s.execTimes++
-	return s.mac.Run()
+	return s.runMachine(s.mac.Run)
+}
+
+// RunExpect executes a script like Run(), and returns an error wrapping ErrMissingOutputs with the names of the missing ones if the output doesn't contain all the required keys.
+// The output is returned even if some keys are missing, and the error of the run takes precedence.
+func (s *Starbox) RunExpect(script string, required ...string) (starlet.StringAnyMap, error) {
+	out, err := s.Run(script)
+	if err != nil {
+		return out, err
+	}
+	var missing []string
+	for _, key := range required {
+		if _, ok := out[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return out, fmt.Errorf("%w: %s", ErrMissingOutputs, strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// RunStrict executes a script like Run(), and returns an error wrapping ErrPrintWarnings with the warnings if any print message is collected by SetPrintAsWarnings().
+// The output is returned with the error, and the error of the run takes precedence. It works like Run() if SetPrintAsWarnings() is not enabled.
+func (s *Starbox) RunStrict(script string) (starlet.StringAnyMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err := s.prepareScriptEnv(script); err != nil {
+		return nil, err
+	}
+
+	// run and check the warnings of this run
+	out, err := s.runMachine(s.mac.Run)
+	if err == nil && len(s.warnings) > 0 {
+		err = fmt.Errorf("%w: %s", ErrPrintWarnings, strings.Join(s.warnings, "; "))
+	}
+	return out, err
+}
+
+// GetWarnings returns a copy of the print messages collected as warnings in the last run by SetPrintAsWarnings(), or nil if there is none.
+func (s *Starbox) GetWarnings() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.warnings) == 0 {
+		return nil
+	}
+	return append([]string(nil), s.warnings...)
+}
+
+// RunWithPredeclared executes a script with the given Starlark values as the predeclared environment of this run, and returns the converted output.
+// The script runs against a private environment of the loaded modules plus exactly the given values, which are used as is without conversion and take precedence over the modules of the same names.
+// The globals staged by methods like AddKeyValue() and the results of previous runs are not visible to the script, and neither the given values nor the results of this run are kept for the later runs.
+// The results of this run are still the ones of the last run for methods like GetStarlarkResult(), OutputJSONTyped() and ExportState().
+func (s *Starbox) RunWithPredeclared(script string, predeclared starlark.StringDict) (starlet.StringAnyMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment, the thread is created before setting the script, since it takes the predeclared values of the machine
+	if err := s.prepareEnv(); err != nil {
+		return nil, err
+	}
+	if err := s.prepareThread(true); err != nil {
+		return nil, err
+	}
+	if err := s.prepareScriptEnv(script); err != nil {
+		return nil, err
+	}
+
+	// build the private environment, the preloaded modules are kept for the later calls
+	if s.preEnv == nil {
+		pre := make(starlark.StringDict)
+		if err := s.mac.GetPreloadModules().LoadAll(pre); err != nil {
+			return nil, err
+		}
+		s.preEnv = pre
+	}
+	env := make(starlark.StringDict, len(s.preEnv)+len(predeclared))
+	for k, v := range s.preEnv {
+		env[k] = v
+	}
+	for k, v := range predeclared {
+		env[k] = v
+	}
+
+	// run on the thread of the machine against the private environment, and the results are kept by the box instead of the machine
+	var res starlark.StringDict
+	out, err := s.runMachine(func() (starlet.StringAnyMap, error) {
+		var err error
+		res, err = s.execWithPredeclared(env)
+		return convert.FromStringDict(res), err
+	})
+	s.lastRes = make(starlark.StringDict, len(s.lastOut))
+	for k := range s.lastOut {
+		if v, ok := res[k]; ok {
+			s.lastRes[k] = v
+		}
+	}
+	return out, err
+}
+
+// execWithPredeclared executes the script of the next run on the thread of the machine like the machine does, but against the given predeclared values instead of the ones of the machine, and returns the globals of the script.
+func (s *Starbox) execWithPredeclared(predeclared starlark.StringDict) (res starlark.StringDict, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("exec panic: %v", r)
+		}
+	}()
+
+	thread := s.mac.GetStarlarkThread()
+	thread.Uncancel()
+	thread.SetLocal("context", context.TODO())
+	reassign := !s.noReassign
+	opts := &syntax.FileOptions{Set: true, Recursion: s.maxDepth > 0, GlobalReassign: reassign, TopLevelControl: reassign, While: reassign}
+	res, err = starlark.ExecFileOptions(opts, thread, s.scriptName, s.depthScript(s.scriptName, s.scriptSrc, nil), predeclared)
+
+	// exit() with code 0 ends the run without error
+	if errors.Is(err, goidiomatic.ErrSystemExit) {
+		if code, _ := thread.Local(exitCodeLocalKey).(uint8); code == 0 {
+			err = nil
+		} else {
+			err = fmt.Errorf("exit code: %d", code)
+		}
+	}
+	return res, err
 }
 
 // RunFile executes a script file and returns the converted output.
@@ -35,12 +185,93 @@ func (s *Starbox) RunFile(file string) (starlet.StringAnyMap, error) {
 	}
 
 	// run
-	s.hasExec = true
-	s.execTimes++
-	return s.mac.RunFile(file, s.modFS, nil)
+	content, err := s.filterScript(file, nil, s.modFS)
+	if err != nil {
+		return nil, err
+	}
+	s.setScript(file, content, s.modFS)
+	return s.runMachine(func() (starlet.StringAnyMap, error) {
+		return s.mac.Run()
+	})
+}
+
+// RunFileContext executes a script file in the filesystem like RunFile() with the given context, and the run is cancelled when the context is done.
+// On cancellation or timeout of the context, the returned error is compatible with the error of the context, i.e. context.Canceled or context.DeadlineExceeded, and the script is not run at all if the context is already done.
+// Like RunTimeout(), the preparation of the environment before the run is not limited by the context.
+func (s *Starbox) RunFileContext(ctx context.Context, file string) (starlet.StringAnyMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err := s.prepareEnv(); err != nil {
+		return nil, err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// run with the context
+	content, err := s.filterScript(file, nil, s.modFS)
+	if err != nil {
+		return nil, err
+	}
+	s.setScript(file, content, s.modFS)
+	s.runCtx = ctx
+	return s.runMachine(func() (starlet.StringAnyMap, error) {
+		return s.mac.RunWithContext(ctx, nil)
+	})
+}
+
+// RunDir executes all the .star files in the given directory of the filesystem set by SetFS() in lexical order on the same machine, and each file sees the globals of all the previous ones.
+// It returns the merged converted output of all the files, and the later files overwrite the same names of the earlier ones.
+// It stops at the first error, and returns the merged output of the succeeded files with the error wrapped with the name of the failed file.
+func (s *Starbox) RunDir(dir string) (starlet.StringAnyMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err := s.prepareEnv(); err != nil {
+		return nil, err
+	}
+	if s.modFS == nil {
+		return nil, errors.New("no filesystem to run directory")
+	}
+
+	// list the script files, they're sorted by name
+	entries, err := fs.ReadDir(s.modFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// run one by one
+	merged := make(starlet.StringAnyMap)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".star") {
+			continue
+		}
+		file := path.Join(dir, entry.Name())
+		content, err := s.filterScript(file, nil, s.modFS)
+		if err != nil {
+			return merged, fmt.Errorf("%s: %w", file, err)
+		}
+		s.setScript(file, content, s.modFS)
+		out, err := s.runMachine(func() (starlet.StringAnyMap, error) {
+			return s.mac.Run()
+		})
+		if err != nil {
+			return merged, fmt.Errorf("%s: %w", file, err)
+		}
+		merged.Merge(out)
+	}
+	return merged, nil
 }
 
 // RunTimeout executes a script and returns the converted output.
+// If the run exceeds the timeout, the returned error is compatible with context.DeadlineExceeded.
+// The timeout only covers the execution of the script, the preparation of the environment before it, e.g. preloading the modules on the first run, is not limited by it.
 func (s *Starbox) RunTimeout(script string, timeout time.Duration) (starlet.StringAnyMap, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -50,10 +281,83 @@ func (s *Starbox) RunTimeout(script string, timeout time.Duration) (starlet.Stri
 		return nil, err
 	}
 
+	// run with the context of the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.runCtx = ctx
+	return s.runMachine(func() (starlet.StringAnyMap, error) {
+		return s.mac.RunWithContext(ctx, nil)
+	})
+}
+
+// RunCells executes the scripts in order on the same machine like cells of a notebook, and each script sees the globals of all the previous ones.
+// It stops at the first error, and returns the converted outputs of the succeeded scripts with the error wrapped with the index of the failed script.
+func (s *Starbox) RunCells(scripts ...string) ([]starlet.StringAnyMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]starlet.StringAnyMap, 0, len(scripts))
+	for i, script := range scripts {
+		// prepare environment
+		if err := s.prepareScriptEnv(script); err != nil {
+			return results, err
+		}
+
+		// run
+		out, err := s.runMachine(s.mac.Run)
+		if err != nil {
+			return results, fmt.Errorf("cell %d: %w", i, err)
+		}
+		results = append(results, out)
+	}
+	return results, nil
+}
+
+// RunInterruptible executes a script and returns the converted output, and the run is cancelled if the process receives an interrupt signal, e.g. Ctrl-C.
+// The signal is only captured for the duration of the run, and the previous signal handling is restored afterward.
+// On interrupt, the returned error is compatible with context.Canceled, no matter the script is sleeping or computing.
+func (s *Starbox) RunInterruptible(script string) (starlet.StringAnyMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err := s.prepareScriptEnv(script); err != nil {
+		return nil, err
+	}
+
+	// run with the context cancelled by interrupt signal
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	s.runCtx = ctx
+	return s.runMachine(func() (starlet.StringAnyMap, error) {
+		return s.mac.RunWithContext(ctx, nil)
+	})
+}
+
+// RunWithProfile executes a script with the CPU profiler of Starlark, and writes the profile in pprof format to the given writer after the run.
+// The profile can be analyzed with `go tool pprof`. The profiler is stopped even if the run fails.
+// Only one profiled run can be active at a time in the process, since the profiler of Starlark is global, and it returns an error if another one is running.
+func (s *Starbox) RunWithProfile(script string, w io.Writer) (out starlet.StringAnyMap, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err = s.prepareScriptEnv(script); err != nil {
+		return nil, err
+	}
+
+	// start the profiler, and stop it after the run
+	if err = starlark.StartProfile(w); err != nil {
+		return nil, fmt.Errorf("start profile: %w", err)
+	}
+	defer func() {
+		if e := starlark.StopProfile(); e != nil && err == nil {
+			err = fmt.Errorf("stop profile: %w", e)
+		}
+	}()
+
 	// run
-	s.hasExec = true
-	s.execTimes++
-	return s.mac.RunWithTimeout(timeout, nil)
+	return s.runMachine(s.mac.Run)
 }
 
 // REPL starts a REPL session.
@@ -67,9 +371,10 @@ func (s *Starbox) REPL() error {
 	}
 
 	// run
-	s.hasExec = true
-	s.execTimes++
-	s.mac.REPL()
+	_, _ = s.runMachine(func() (starlet.StringAnyMap, error) {
+		s.mac.REPL()
+		return nil, nil
+	})
 	return nil
 }
 
@@ -84,9 +389,7 @@ func (s *Starbox) RunInspect(script string) (starlet.StringAnyMap, error) {
 	}
 
 	// run script
-	s.hasExec = true
-	s.execTimes++
-	out, err := s.mac.Run()
+	out, err := s.runMachine(s.mac.Run)
 
 	// repl
 	s.mac.REPL()
@@ -108,9 +411,7 @@ func (s *Starbox) RunInspectIf(script string, cond InspectCondFunc) (starlet.Str
 	}
 
 	// run script
-	s.hasExec = true
-	s.execTimes++
-	out, err := s.mac.Run()
+	out, err := s.runMachine(s.mac.Run)
 
 	// repl
 	if cond(out, err) {
@@ -119,9 +420,221 @@ func (s *Starbox) RunInspectIf(script string, cond InspectCondFunc) (starlet.Str
 	return out, err
 }
 
+// runMachine marks the box as executed and calls the given function to run the machine, then finishes the run.
+// It should be called with the lock held and the environment prepared.
+func (s *Starbox) runMachine(run func() (starlet.StringAnyMap, error)) (starlet.StringAnyMap, error) {
+	if err := s.beginRun(); err != nil {
+		return nil, err
+	}
+	sr := s.startStats()
+	out, err := run()
+	s.lastStats = sr.finish(s)
+	return s.endRun(out, err)
+}
+
+// beginRun marks the box as executed, and sets up the thread and the predeclared values of the machine for the run.
+func (s *Starbox) beginRun() error {
+	if err := s.checkFrozenScript(); err != nil {
+		return err
+	}
+	s.hasExec = true
+	s.execTimes++
+	s.warnings = nil
+	thread := s.mac.GetStarlarkThread()
+	s.runThread = thread
+	s.resetExit(thread)
+	if err := s.bindContextValues(); err != nil {
+		s.finishRun()
+		return err
+	}
+	if s.thConfig != nil && thread != nil {
+		s.thConfig(thread)
+	}
+	return nil
+}
+
+// endRun checks the output and the error of the run, records the results and finishes the run.
+func (s *Starbox) endRun(out starlet.StringAnyMap, err error) (starlet.StringAnyMap, error) {
+	// the thread may be created by the first run
+	thread := s.mac.GetStarlarkThread()
+	err = wrapContextError(s.runCtx, err)
+	out, err = s.checkFrozen(out, err)
+	if s.bigOut {
+		convertBigOutputs(out)
+	}
+	err = s.checkExit(thread, s.traceError(err))
+	s.lastOut, s.lastRes = out, s.resultValues(out)
+	s.notifyGlobals(out)
+	s.finishRun()
+	if s.outFn != nil && out != nil {
+		out = s.outFn(out)
+	}
+	return out, err
+}
+
+// resultValues returns the raw Starlark values of the given output of the run, which are merged into the predeclared values of the machine by the run.
+func (s *Starbox) resultValues(out starlet.StringAnyMap) starlark.StringDict {
+	pd := s.mac.GetStarlarkPredeclared()
+	res := make(starlark.StringDict, len(out))
+	for k := range out {
+		if v, ok := pd[k]; ok {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// freezeGlobals freezes the predeclared values of the keys added by AddFrozenKeyValue(), and keeps them to detect reassignment.
+func (s *Starbox) freezeGlobals() {
+	s.frozenVals = nil
+	if len(s.frozenKeys) == 0 {
+		return
+	}
+	pd := s.mac.GetStarlarkPredeclared()
+	s.frozenVals = make(starlark.StringDict, len(s.frozenKeys))
+	for k := range s.frozenKeys {
+		if v, ok := pd[k]; ok {
+			v.Freeze()
+			s.frozenVals[k] = v
+		}
+	}
+}
+
+// checkFrozenScript parses and resolves the script of the next run, and returns an error if it binds any key added by AddFrozenKeyValue() at the top level, so the script is rejected before execution.
+// The invalid scripts are left to the run to report the errors.
+func (s *Starbox) checkFrozenScript() error {
+	if len(s.frozenKeys) == 0 {
+		return nil
+	}
+	src := s.scriptSrc
+	if src == nil && s.scriptFS != nil && s.scriptName != "" {
+		bs, err := fs.ReadFile(s.scriptFS, s.scriptName)
+		if err != nil {
+			return nil
+		}
+		src = bs
+	}
+	opts := &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true, Recursion: true}
+	f, err := opts.Parse(s.scriptName, src, 0)
+	if err != nil {
+		return nil
+	}
+	isPredeclared := func(string) bool { return true }
+	if err = resolve.File(f, isPredeclared, func(string) bool { return false }); err != nil {
+		return nil
+	}
+	var names []string
+	for _, b := range f.Module.(*resolve.Module).Globals {
+		if _, ok := s.frozenKeys[b.First.Name]; ok {
+			names = append(names, b.First.Name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Errorf("cannot reassign frozen globals: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// checkFrozen returns an error if the script assigned any key added by AddFrozenKeyValue(), and restores the predeclared values and removes the keys from the output.
+func (s *Starbox) checkFrozen(out starlet.StringAnyMap, err error) (starlet.StringAnyMap, error) {
+	if len(s.frozenVals) == 0 || len(out) == 0 {
+		return out, err
+	}
+	var names []string
+	for k, v := range s.frozenVals {
+		if _, ok := out[k]; ok {
+			names = append(names, k)
+			delete(out, k)
+			s.mac.GetStarlarkPredeclared()[k] = v
+		}
+	}
+	if len(names) > 0 && err == nil {
+		sort.Strings(names)
+		err = fmt.Errorf("cannot reassign frozen globals: %s", strings.Join(names, ", "))
+	}
+	return out, err
+}
+
+// bindContextValues converts the values bound by BindContextValue() from the context of the run, and sets them as the predeclared globals of the machine.
+func (s *Starbox) bindContextValues() error {
+	if len(s.ctxBinds) == 0 {
+		return nil
+	}
+	pd := s.mac.GetStarlarkPredeclared()
+	for name, key := range s.ctxBinds {
+		var v interface{}
+		if s.runCtx != nil {
+			v = s.runCtx.Value(key)
+		}
+		sv, err := s.ToStarlark(v)
+		if err != nil {
+			return fmt.Errorf("bind context value %s: %w", name, err)
+		}
+		pd[name] = sv
+	}
+	return nil
+}
+
+// notifyGlobals calls the global callback for each converted global of the output in the order of names.
+func (s *Starbox) notifyGlobals(out starlet.StringAnyMap) {
+	if s.globalFn == nil || len(out) == 0 {
+		return
+	}
+	names := make([]string, 0, len(out))
+	for name := range out {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.globalFn(name, out[name])
+	}
+}
+
+// finishRun cleans up the things for the run that just finished.
+func (s *Starbox) finishRun() {
+	s.runCtx = nil
+
+	// close the emit channel, so consumers know the run is done
+	if s.emitter != nil {
+		s.emitter.close()
+	}
+	// close the print channel as well
+	if s.printer != nil {
+		s.printer.close()
+	}
+}
+
+// RunParallel executes the script once for each input concurrently, and returns the converted outputs and errors aligned with the inputs by index.
+// Each input runs on a new machine cloned from the settings of the box, with the key-value pairs of the input as extra globals, so there is no shared state between runs except collective memories.
+// It uses at most the given number of worker goroutines, or the number of CPUs if workers is not positive.
+// The box itself is not executed, so it can still be configured or run afterwards.
+func (s *Starbox) RunParallel(script string, inputs []starlet.StringAnyMap, workers int) ([]starlet.StringAnyMap, []error) {
+	var (
+		outs = make([]starlet.StringAnyMap, len(inputs))
+		errs = make([]error, len(inputs))
+	)
+	if s.IsClosed() {
+		for i := range errs {
+			errs[i] = ErrClosed
+		}
+		return outs, errs
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	// snapshot the settings once, and clone it for each input
+	tpl := s.clone()
+	parallelDo(len(inputs), workers, func(i int) {
+		outs[i], errs[i] = tpl.clone().CreateRunConfig().Script(script).KeyValueMap(inputs[i]).Execute()
+	})
+	return outs, errs
+}
+
 // CallStarlarkFunc executes a function defined in Starlark with arguments and returns the converted output.
 func (s *Starbox) CallStarlarkFunc(name string, args ...interface{}) (interface{}, error) {
-	if s == nil || s.mac == nil {
+	if s == nil {
 		return nil, errors.New("no starlet machine")
 	}
 
@@ -129,14 +642,192 @@ func (s *Starbox) CallStarlarkFunc(name string, args ...interface{}) (interface{
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.mac == nil {
+		return nil, errors.New("no starlet machine")
+	}
+
 	// call it
 	return s.mac.Call(name, args...)
 }
 
+// StarCall defines a call of a function defined in Starlark for CallStarlarkChain(), the arguments are converted into Starlark values like CallStarlarkFunc() except the placeholders of ChainResult.
+type StarCall struct {
+	Name string
+	Args []interface{}
+}
+
+// ChainResult is a placeholder argument of StarCall referencing the result of an earlier call in the chain by its index, and the Starlark value of the result is passed as is without conversion.
+type ChainResult int
+
+const (
+	// PrevResult is the placeholder argument of StarCall referencing the result of the previous call in the chain.
+	PrevResult ChainResult = -1
+)
+
+// CallStarlarkChain executes the functions defined in Starlark one by one, and returns the converted results of all the calls.
+// The results of earlier calls can be passed to the later calls with the placeholders of ChainResult, which avoids the round trip of converting them into Go values and back.
+// It stops at the first failed call, and returns the results of the calls before it with the error. It returns ErrNotExecuted if the box has not been executed yet.
+func (s *Starbox) CallStarlarkChain(calls []StarCall) (res []interface{}, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if !s.hasExec || s.mac == nil {
+		return nil, ErrNotExecuted
+	}
+	thread := s.mac.GetStarlarkThread()
+	pd := s.mac.GetStarlarkPredeclared()
+	if thread == nil || pd == nil {
+		return nil, ErrNotExecuted
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("call panic: %v", r)
+		}
+	}()
+
+	vals := make([]starlark.Value, 0, len(calls))
+	res = make([]interface{}, 0, len(calls))
+	for i, c := range calls {
+		fn, ok := pd[c.Name].(starlark.Callable)
+		if !ok {
+			return res, fmt.Errorf("call %d: no such function: %s", i, c.Name)
+		}
+		args := make(starlark.Tuple, 0, len(c.Args))
+		for _, arg := range c.Args {
+			if ref, ok := arg.(ChainResult); ok {
+				idx := int(ref)
+				if ref == PrevResult {
+					idx = i - 1
+				}
+				if idx < 0 || idx >= i {
+					return res, fmt.Errorf("call %d %s: invalid result reference: %d", i, c.Name, ref)
+				}
+				args = append(args, vals[idx])
+				continue
+			}
+			sv, err := s.ToStarlark(arg)
+			if err != nil {
+				return res, fmt.Errorf("call %d %s: convert argument: %w", i, c.Name, err)
+			}
+			args = append(args, sv)
+		}
+
+		thread.Uncancel()
+		thread.SetLocal("context", context.TODO())
+		v, err := starlark.Call(thread, fn, args, nil)
+		if err != nil {
+			return res, fmt.Errorf("call %d %s: %w", i, c.Name, err)
+		}
+		vals = append(vals, v)
+		res = append(res, convert.FromValue(v))
+	}
+	return res, nil
+}
+
+// GetStarlarkGlobals returns a copy of the raw Starlark global values of the underlying machine after execution, without converting them to Go values.
+// It contains the preset globals, the loaded modules and the results of all previous runs, and can be used for AddStarlarkValues() of another box.
+// It returns ErrNotExecuted if the box has not been executed yet.
+func (s *Starbox) GetStarlarkGlobals() (starlark.StringDict, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasExec || s.mac == nil {
+		return nil, ErrNotExecuted
+	}
+	pd := s.mac.GetStarlarkPredeclared()
+	if pd == nil {
+		return nil, ErrNotExecuted
+	}
+	res := make(starlark.StringDict, len(pd))
+	for k, v := range pd {
+		res[k] = v
+	}
+	return res, nil
+}
+
+// GetStarlarkResult returns the raw Starlark value of the given result variable of the last run, without converting it to a Go value.
+// It works with AddKeyStarlarkValue() to pass a single value to another box losslessly, and returns false if the box has not been executed yet or the variable is not in the result.
+func (s *Starbox) GetStarlarkResult(name string) (starlark.Value, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasExec || s.mac == nil {
+		return nil, false
+	}
+	v, ok := s.lastRes[name]
+	return v, ok
+}
+
+// GetScript returns a copy of the script content set on the underlying machine for the last run, e.g. to show what was run in an error UI, or nil if no script is set yet or since Reset().
+// For the script files run by methods like RunFile(), the content is read from the filesystem on each call, and nil is returned if the file can't be read.
+func (s *Starbox) GetScript() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.scriptSrc != nil {
+		return append([]byte(nil), s.scriptSrc...)
+	}
+	if s.scriptFS != nil && s.scriptName != "" {
+		if bs, err := fs.ReadFile(s.scriptFS, s.scriptName); err == nil {
+			return bs
+		}
+	}
+	return nil
+}
+
+// setScript sets the script of the underlying machine for the next run, and records it for GetScript().
+func (s *Starbox) setScript(name string, content []byte, fsys fs.FS) {
+	s.mac.SetScript(name, s.depthScript(name, content, fsys), fsys)
+	s.recordScript(name, content, fsys)
+}
+
+// filterScript returns the script content filtered by the function set by SetScriptFilter(), or the content as is if no filter is set.
+// For the script file in the filesystem, i.e. the content is nil, the content is read from the filesystem for the filter.
+func (s *Starbox) filterScript(name string, content []byte, fsys fs.FS) ([]byte, error) {
+	if s.scFilter == nil {
+		return content, nil
+	}
+	if content == nil && fsys != nil {
+		bs, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		content = bs
+	}
+	filtered, err := s.scFilter(name, content)
+	if err != nil {
+		return nil, fmt.Errorf("filter script %s: %w", name, err)
+	}
+	if filtered == nil {
+		// nil content means reading from the filesystem for the machine, so use empty content instead
+		filtered = []byte{}
+	}
+	return filtered, nil
+}
+
+// recordScript records the script of the next run for GetScript(), the content is nil for the script file in the filesystem.
+func (s *Starbox) recordScript(name string, content []byte, fsys fs.FS) {
+	s.scriptName, s.scriptSrc, s.scriptFS = name, content, fsys
+}
+
 func (s *Starbox) prepareScriptEnv(script string) (err error) {
-	// if it's not the first run, set the script content only
+	if s.closed {
+		return ErrClosed
+	}
+
+	// if it's not the first run, set the script content with the filesystem of the box, which may be replaced by the runner or file runs
 	if s.hasExec {
-		s.mac.SetScriptContent([]byte(script))
+		content, err := s.filterScript(s.scriptName, []byte(script), nil)
+		if err != nil {
+			return err
+		}
+		s.setScript(s.scriptName, content, s.modFS)
 		return nil
 	}
 
@@ -146,28 +837,91 @@ func (s *Starbox) prepareScriptEnv(script string) (err error) {
 	}
 
 	// set script
-	s.mac.SetScript("box.star", []byte(script), s.modFS)
+	content, err := s.filterScript("box.star", []byte(script), nil)
+	if err != nil {
+		return err
+	}
+	s.setScript("box.star", content, s.modFS)
 
 	// all is done
 	return nil
 }
 
 func (s *Starbox) prepareEnv() (err error) {
+	if s.closed {
+		return ErrClosed
+	}
+	if s.envReady {
+		return nil
+	}
+
+	// enable recursion with the call depth limit
+	if s.maxDepth > 0 {
+		s.mac.EnableRecursionSupport()
+	}
+
+	// disable global reassignment, it's enabled for new machines
+	if s.noReassign {
+		s.mac.DisableGlobalReassign()
+	}
+
 	// set custom tag and print function
 	if s.structTag != "" {
 		s.mac.SetCustomTag(s.structTag)
 	}
-	if s.printFunc != nil {
+	if s.printWarn {
+		s.mac.SetPrintFunc(func(_ *starlark.Thread, msg string) {
+			s.warnings = append(s.warnings, msg)
+		})
+	} else if s.printer != nil {
+		// the prints after the channel is closed go to the print function as if there is no channel
+		if s.printFunc != nil {
+			s.printer.fallback = s.printFunc
+		} else if s.printFmt != nil {
+			s.printer.fallback = defaultPrintFunc(s.threadName(), s.printFmt.layout, s.printFmt.decorate)
+		} else {
+			s.printer.fallback = defaultPrintFunc(s.threadName(), defaultPrintLayout, true)
+		}
+		s.mac.SetPrintFunc(s.printer.print)
+	} else if s.printFunc != nil {
 		s.mac.SetPrintFunc(s.printFunc)
+	} else if s.printFmt != nil {
+		s.mac.SetPrintFunc(defaultPrintFunc(s.threadName(), s.printFmt.layout, s.printFmt.decorate))
+	} else if s.thName != "" {
+		s.mac.SetPrintFunc(defaultPrintFunc(s.thName, defaultPrintLayout, true))
 	}
 
 	// set variables
-	s.mac.SetGlobals(s.globals)
+	s.mac.SetGlobals(convertInputs(s.globals, s.timeMode))
+	if s.emitter != nil {
+		s.mac.AddGlobals(starlet.StringAnyMap{"emit": s.emitter.builtin()})
+	}
+	for name, ch := range s.chans {
+		s.mac.AddGlobals(starlet.StringAnyMap{name: &chanIterable{name: name, ch: ch, box: s}})
+	}
+	if s.include {
+		s.mac.AddGlobals(starlet.StringAnyMap{includeFuncName: starlark.NewBuiltin(includeFuncName, includeModule)})
+	}
+	if s.argv != nil {
+		s.mac.AddGlobals(starlet.StringAnyMap{"argv": starlarkStringList(s.argv), "argc": starlark.MakeInt(len(s.argv))})
+	}
+	if s.maxDepth > 0 {
+		s.mac.AddGlobals(starlet.StringAnyMap{callDepthFuncName: callDepthBuiltin(s.maxDepth)})
+	}
 
-	// extract module loaders
-	preMods, lazyMods, modNames, err := s.extractModLoaders()
-	if err != nil {
-		return err
+	// extract module loaders, or reuse the ones kept by ResetPreserveModules()
+	var (
+		preMods  starlet.ModuleLoaderList
+		lazyMods starlet.ModuleLoaderMap
+		modNames []string
+	)
+	if km := s.keptMods; km != nil {
+		preMods, lazyMods, modNames = km.preMods, km.lazyMods.Clone(), append([]string(nil), km.modNames...)
+	} else {
+		if preMods, lazyMods, modNames, _, err = s.extractModLoaders(); err != nil {
+			return err
+		}
+		s.lastMods = &extractedMods{preMods: preMods, lazyMods: lazyMods.Clone(), modNames: append([]string(nil), modNames...)}
 	}
 
 	// set modules to machine
@@ -176,23 +930,90 @@ func (s *Starbox) prepareEnv() (err error) {
 		s.mac.SetLazyloadModules(lazyMods)
 	}
 
-	// prepare script modules
-	if len(s.scriptMods) > 0 && s.modFS == nil {
+	// prepare script modules and mounted filesystems
+	if (len(s.scriptMods) > 0 || len(s.prefixFS) > 0) && s.modFS == nil {
 		rootFS := memfs.New()
 		for fp, scr := range s.scriptMods {
-			// TODO: support directory/file.star later
+			// create the parent directories for nested scripts
+			if dir := path.Dir(fp); dir != "." {
+				if err := rootFS.MkdirAll(dir, 0755); err != nil {
+					return err
+				}
+			}
 			if err := rootFS.WriteFile(fp, []byte(scr), 0644); err != nil {
 				return err
 			}
 			modNames = append(modNames, fp)
 		}
-		s.modFS = rootFS
+		if len(s.prefixFS) > 0 {
+			s.modFS = newMountFS(rootFS, s.prefixFS)
+		} else {
+			s.modFS = rootFS
+		}
+		s.modsFS = s.modFS
 	}
 
 	// set load module names
 	s.modNames = modNames
-	s.mac.AddGlobals(starlet.StringAnyMap{
-		"__modules__": starlarkStringList(modNames),
-	})
+	if s.modsVar != "" {
+		s.mac.AddGlobals(starlet.StringAnyMap{
+			s.modsVar: s.moduleNamesList(modNames),
+		})
+	}
+	if s.modIntro {
+		members, err := moduleMembers(lazyMods)
+		if err != nil {
+			return err
+		}
+		s.mac.AddGlobals(starlet.StringAnyMap{"__module_members__": members})
+	}
+
+	// prepare the thread for thread-related settings
+	if err = s.prepareThread(false); err != nil {
+		return err
+	}
+	s.freezeGlobals()
+	s.envReady = true
+	return nil
+}
+
+// Warmup prepares the environment in advance, i.e. resolves and preloads all the modules, so the first run is faster.
+// It doesn't execute any script or mark the box as executed, and the errors of module resolution are returned here instead of on the first run.
+// It's idempotent, and any change of settings after it discards the prepared environment.
+// Since the machine creates its thread on the first run, an empty script is run on it for the preparation, which counts as a run of the machine but not of the box.
+func (s *Starbox) Warmup() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.prepareEnv(); err != nil {
+		return err
+	}
+	return s.prepareThread(true)
+}
+
+// prepareThread creates the underlying Starlark thread in advance if it's not created yet, and applies the thread-related settings to it.
+// The thread is only created if the settings need it before the first run or force is true, otherwise the machine creates it on the first run.
+// The machine doesn't expose its thread setup, so an empty script is run to create the thread and preload the modules, it happens before any deadline or context of the run is applied, and it increases the run counter of the machine.
+func (s *Starbox) prepareThread(force bool) error {
+	if s.mac.GetStarlarkThread() != nil || (!force && !s.needThread()) {
+		return nil
+	}
+	if _, err := s.mac.RunScript([]byte{}, nil); err != nil {
+		return err
+	}
+	thread := s.mac.GetStarlarkThread()
+	if s.thName != "" {
+		thread.Name = s.thName
+	}
+	s.setThreadClock(thread)
+	for k, v := range s.thLocals {
+		thread.SetLocal(k, v)
+	}
 	return nil
 }
+
+// needThread reports whether any setting applies to the thread or the predeclared values of the machine before the first run, which are only available after the thread is created.
+func (s *Starbox) needThread() bool {
+	return s.thName != "" || len(s.thLocals) > 0 || s.thConfig != nil || s.fixClock ||
+		len(s.frozenKeys) > 0 || len(s.ctxBinds) > 0 || len(s.chans) > 0
+}
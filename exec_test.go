@@ -1,11 +1,18 @@
 package starbox_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/1set/starbox"
@@ -104,6 +111,364 @@ func TestRunFile(t *testing.T) {
 	}
 }
 
+// TestGetScript tests the following:
+// 1. Check no script is set before any run.
+// 2. Run scripts and files in different ways, and check the script content of the last run.
+// 3. Reset the box, and check the script is cleared.
+func TestGetScript(t *testing.T) {
+	fs := memfs.New()
+	fs.WriteFile("file.star", []byte(`f = 1`), 0644)
+	fs.WriteFile("conf.star", []byte(`c = 2`), 0644)
+
+	b := starbox.New("test")
+	b.SetFS(fs)
+	if sc := b.GetScript(); sc != nil {
+		t.Errorf("expect nil script, got %q", sc)
+	}
+
+	check := func(name, expect string, run func() error) {
+		if err := run(); err != nil {
+			t.Errorf("[%s] unexpected error: %v", name, err)
+			return
+		}
+		if sc := b.GetScript(); string(sc) != expect {
+			t.Errorf("[%s] expect script %q, got %q", name, expect, sc)
+		}
+	}
+	check("run", `a = 1`, func() error { _, err := b.Run(`a = 1`); return err })
+	check("run file", `f = 1`, func() error { _, err := b.RunFile("file.star"); return err })
+	check("run timeout", `b = 2`, func() error { _, err := b.RunTimeout(`b = 2`, time.Second); return err })
+	check("execute", `x = 3`, func() error { _, err := b.CreateRunConfig().Script(`x = 3`).Execute(); return err })
+	check("execute file", `c = 2`, func() error { _, err := b.CreateRunConfig().FileName("conf.star").Execute(); return err })
+	check("run empty", ``, func() error { _, err := b.Run(``); return err })
+
+	// the returned content is a copy
+	b.Run(`y = 1`)
+	b.GetScript()[0] = 'z'
+	if sc := b.GetScript(); string(sc) != `y = 1` {
+		t.Errorf("expect script unchanged, got %q", sc)
+	}
+
+	b.Reset()
+	if sc := b.GetScript(); sc != nil {
+		t.Errorf("expect nil script after reset, got %q", sc)
+	}
+}
+
+// TestRunFileContext tests the following:
+// 1. Run a script file with a context, and check the output.
+// 2. Cancel the context of a busy loop and a sleep, and check the errors are compatible with the context.
+// 3. Run with a done context, and check the script is not run.
+func TestRunFileContext(t *testing.T) {
+	fs := memfs.New()
+	fs.WriteFile("ok.star", []byte(`s = "hello"`), 0644)
+	fs.WriteFile("loop.star", []byte(hereDoc(`
+		def loop():
+			n = 0
+			for i in range(100000000):
+				n += i
+			return n
+		n = loop()
+	`)), 0644)
+	fs.WriteFile("sleep.star", []byte(`sleep(5)`), 0644)
+
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.SafeModuleSet)
+	b.SetFS(fs)
+	out, err := b.RunFileContext(context.Background(), "ok.star")
+	if err != nil || out["s"] != "hello" {
+		t.Errorf("expect s=hello, got %v, %v", out, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := b.RunFileContext(ctx, "loop.star"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expect prompt return after timeout, took %v", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := b.RunFileContext(ctx, "sleep.star"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+
+	before := b.String()
+	if _, err := b.RunFileContext(ctx, "ok.star"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context canceled for done context, got %v", err)
+	}
+	if after := b.String(); after != before {
+		t.Errorf("expect no run for done context, got %s", after)
+	}
+}
+
+// TestRunDir tests the following:
+// 1. Create a directory with .star files and other files.
+// 2. Run the directory, and check the files are run in order with the globals carried forward.
+// 3. Run a directory with a failing file, and check the error has the file name.
+func TestRunDir(t *testing.T) {
+	fs := memfs.New()
+	fs.MkdirAll("scripts/sub", 0755)
+	fs.WriteFile("scripts/20_b.star", []byte(`b = a + 1; c = "b"`), 0644)
+	fs.WriteFile("scripts/10_a.star", []byte(`a = 1; c = "a"`), 0644)
+	fs.WriteFile("scripts/30_c.star", []byte(`d = [a, b, c]`), 0644)
+	fs.WriteFile("scripts/readme.txt", []byte(`not a script`), 0644)
+	fs.WriteFile("scripts/sub/40_d.star", []byte(`e = 1`), 0644)
+	fs.MkdirAll("broken", 0755)
+	fs.WriteFile("broken/1.star", []byte(`x = 1`), 0644)
+	fs.WriteFile("broken/2.star", []byte(`y = x / 0`), 0644)
+	fs.WriteFile("broken/3.star", []byte(`z = 1`), 0644)
+
+	b := starbox.New("test")
+	b.SetFS(fs)
+	out, err := b.RunDir("scripts")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	es := starlet.StringAnyMap{"a": int64(1), "b": int64(2), "c": "b", "d": []interface{}{int64(1), int64(2), "b"}}
+	if !reflect.DeepEqual(out, es) {
+		t.Errorf("expect %v, got %v", es, out)
+	}
+
+	b = starbox.New("test")
+	b.SetFS(fs)
+	out, err = b.RunDir("broken")
+	if err == nil || !strings.HasPrefix(err.Error(), "broken/2.star: ") {
+		t.Errorf("expect error with file name, got %v", err)
+	}
+	if es := (starlet.StringAnyMap{"x": int64(1)}); !reflect.DeepEqual(out, es) {
+		t.Errorf("expect %v, got %v", es, out)
+	}
+
+	// missing directory or filesystem
+	if _, err = starbox.New("test").RunDir("scripts"); err == nil {
+		t.Errorf("expect error for no filesystem, got nil")
+	}
+	b = starbox.New("test")
+	b.SetFS(fs)
+	if _, err = b.RunDir("missing"); err == nil {
+		t.Errorf("expect error for missing directory, got nil")
+	}
+}
+
+// TestRunExpect tests the following:
+// 1. Run a script that defines all the required outputs, and check no error.
+// 2. Run a script that misses some required outputs, and check the error names the missing ones.
+// 3. Run a script with an error, and check the error of the run is returned.
+func TestRunExpect(t *testing.T) {
+	b := starbox.New("test")
+	out, err := b.RunExpect(`a = 1; b = 2`, "a", "b")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["a"] != int64(1) || out["b"] != int64(2) {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	out, err = b.RunExpect(`c = a + b`, "c", "d", "e")
+	if !errors.Is(err, starbox.ErrMissingOutputs) || !strings.HasSuffix(err.Error(), ": d, e") {
+		t.Errorf("expect missing outputs error, got %v", err)
+	}
+	if out["c"] != int64(3) {
+		t.Errorf("expect output returned, got %v", out)
+	}
+
+	if _, err = b.RunExpect(`fail("oops")`, "x"); err == nil || errors.Is(err, starbox.ErrMissingOutputs) {
+		t.Errorf("expect error of the run, got %v", err)
+	}
+}
+
+// TestRunWithPredeclared tests the following:
+// 1. Stage globals and modules, and run with predeclared values of the same and new names.
+// 2. Check the predeclared values win and are used as is, while the modules are still loaded, and the staged globals are not visible.
+// 3. Run again and check neither the predeclared values nor the results stay.
+func TestRunWithPredeclared(t *testing.T) {
+	b := starbox.New("test")
+	b.AddKeyValue("a", 1)
+	b.AddKeyValue("b", 2)
+	b.AddNamedModules("json", "base64")
+	pd := starlark.StringDict{
+		"a":      starlark.String("override"),
+		"base64": starlark.MakeInt(64),
+		"l":      starlark.NewList([]starlark.Value{starlark.MakeInt(1)}),
+		"double": starlark.NewBuiltin("double", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var x int
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "x", &x); err != nil {
+				return nil, err
+			}
+			return starlark.MakeInt(x * 2), nil
+		}),
+	}
+	out, err := b.RunWithPredeclared(hereDoc(`
+		x = a
+		y = double(3)
+		z = json.encode(base64)
+		l.append(2)
+		t = type(l)
+	`), pd)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["x"] != "override" || out["y"] != int64(6) || out["z"] != "64" || out["t"] != "list" {
+		t.Errorf("unexpected output: %v", out)
+	}
+	if _, ok := out["double"]; ok {
+		t.Errorf("expect predeclared values not in output, got %v", out)
+	}
+	if l := pd["l"].(*starlark.List); l.Len() != 2 {
+		t.Errorf("expect predeclared list used as is, got %v", l)
+	}
+
+	// staged globals are not visible
+	if _, err = b.RunWithPredeclared(`y = b`, pd); err == nil {
+		t.Error("expect error for staged global, got nil")
+	}
+
+	// neither predeclared values nor results stay for later runs
+	out, err = b.Run(`w = a + b; v = type(base64)`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["w"] != int64(3) || out["v"] != "module" {
+		t.Errorf("expect staged values, got %v", out)
+	}
+	for _, script := range []string{`d = double`, `d = x`} {
+		if _, err = b.Run(script); err == nil {
+			t.Errorf("expect error for %q, got nil", script)
+		}
+	}
+}
+
+// TestRunWithPredeclared_Results tests the following:
+// 1. Run a script to define a global, then run a script with predeclared values defining the same name.
+// 2. Check the raw result and the typed JSON output are of the run with predeclared values.
+// 3. Check the global of the earlier run is kept for the later runs, and the preloaded modules are not loaded again.
+func TestRunWithPredeclared_Results(t *testing.T) {
+	b := starbox.New("test")
+	loadCnt := 0
+	b.AddModuleLoader("mine", func() (starlark.StringDict, error) {
+		loadCnt++
+		return starlark.StringDict{"num": starlark.MakeInt(100)}, nil
+	})
+	if _, err := b.Run(`x = 1`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	pd := starlark.StringDict{"p": starlark.String("private")}
+	for i := 0; i < 2; i++ {
+		out, err := b.RunWithPredeclared(`x = p; n = num`, pd)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if out["x"] != "private" || out["n"] != int64(100) {
+			t.Errorf("unexpected output: %v", out)
+		}
+	}
+	cnt := loadCnt
+
+	if v, ok := b.GetStarlarkResult("x"); !ok || v != starlark.String("private") {
+		t.Errorf("expect raw result of the run, got %v, %v", v, ok)
+	}
+	bs, err := b.OutputJSONTyped()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := `{"n":{"type":"int","value":100},"x":{"type":"string","value":"private"}}`; string(bs) != es {
+		t.Errorf("expect %s, got %s", es, bs)
+	}
+	st, err := b.ExportState()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := `"private"`; st.Globals["x"] != es {
+		t.Errorf("expect %s, got %v", es, st.Globals)
+	}
+
+	out, err := b.Run(`y = x + 1`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["y"] != int64(2) {
+		t.Errorf("expect y=2, got %v", out["y"])
+	}
+	if _, err = b.RunWithPredeclared(`z = num`, pd); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if loadCnt != cnt {
+		t.Errorf("expect no more loads of modules, got %d after %d", loadCnt, cnt)
+	}
+}
+
+func TestRunStrict(t *testing.T) {
+	var printed []string
+	b := starbox.New("test")
+	b.SetPrintFunc(func(_ *starlark.Thread, msg string) {
+		printed = append(printed, msg)
+	})
+	b.SetPrintAsWarnings(true)
+	if ws := b.GetWarnings(); ws != nil {
+		t.Errorf("expect no warnings before run, got %v", ws)
+	}
+
+	out, err := b.RunStrict(`print("low disk"); x = 1; print("slow", x)`)
+	if !errors.Is(err, starbox.ErrPrintWarnings) || !strings.HasSuffix(err.Error(), ": low disk; slow 1") {
+		t.Errorf("expect ErrPrintWarnings, got %v", err)
+	}
+	if out["x"] != int64(1) {
+		t.Errorf("expect output with warnings, got %v", out)
+	}
+	if ws := b.GetWarnings(); !reflect.DeepEqual(ws, []string{"low disk", "slow 1"}) {
+		t.Errorf("unexpected warnings: %v", ws)
+	}
+	if len(printed) != 0 {
+		t.Errorf("expect warnings not printed, got %v", printed)
+	}
+
+	// the warnings are reset for each run
+	if _, err := b.RunStrict(`y = x + 1`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if ws := b.GetWarnings(); ws != nil {
+		t.Errorf("expect no warnings, got %v", ws)
+	}
+	if _, err := b.Run(`print("ok")`); err != nil {
+		t.Errorf("unexpected error for Run: %v", err)
+	}
+	if ws := b.GetWarnings(); len(ws) != 1 {
+		t.Errorf("expect warnings collected by Run, got %v", ws)
+	}
+
+	// the error of the run takes precedence
+	if _, err := b.RunStrict(`print("before"); fail("oops")`); err == nil || errors.Is(err, starbox.ErrPrintWarnings) {
+		t.Errorf("expect run error, got %v", err)
+	}
+
+	// it works like Run without collecting
+	b = starbox.New("test")
+	b.SetPrintFunc(func(_ *starlark.Thread, msg string) {
+		printed = append(printed, msg)
+	})
+	if _, err := b.RunStrict(`print("hello")`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(printed) != 1 || b.GetWarnings() != nil {
+		t.Errorf("expect message printed, got %v and %v", printed, b.GetWarnings())
+	}
+}
+
 func TestRunFile_PrepareError(t *testing.T) {
 	// prepare file system
 	nm := "try.star"
@@ -155,6 +520,12 @@ func TestRunTimeout(t *testing.T) {
 		t.Errorf("expected error but not, output: %v", out)
 	}
 
+	// timeout of busy loop
+	b.Reset()
+	if _, err := b.RunTimeout(`for i in range(100000000): pass`, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+
 	// no timeout
 	b.Reset()
 	if _, err := b.RunTimeout(`sleep(0.2)`, time.Second); err != nil {
@@ -162,6 +533,166 @@ func TestRunTimeout(t *testing.T) {
 	}
 }
 
+// TestRunCancelSleep tests the sleep builtin is interrupted immediately when the context of the run is cancelled.
+func TestRunCancelSleep(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.SafeModuleSet)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := b.CreateRunConfig().Script(`sleep(5)`).Context(ctx).Execute()
+	elapsed := time.Since(start)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("expect prompt return after cancellation, took %v", elapsed)
+	}
+}
+
+// TestRunInterruptible tests the run is cancelled by the interrupt signal, and the script runs normally without it.
+func TestRunInterruptible(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.SafeModuleSet)
+	if out, err := b.RunInterruptible(`a = 1`); err != nil || out["a"] != int64(1) {
+		t.Errorf("expect a=1, got %v, %v", out, err)
+		return
+	}
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Skipf("cannot find current process: %v", err)
+	}
+	for _, script := range []string{`sleep(5)`, `for i in range(1000000000): pass`} {
+		time.AfterFunc(100*time.Millisecond, func() {
+			if err := p.Signal(os.Interrupt); err != nil {
+				t.Logf("cannot send interrupt: %v", err)
+			}
+		})
+		start := time.Now()
+		_, err = b.RunInterruptible(script)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Skipf("interrupt is not delivered, took %v", elapsed)
+		}
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expect context canceled for %q, got %v", script, err)
+		}
+	}
+}
+
+// TestSetGlobalCallback tests the callback is called for each global of the output after the run, in the order of names.
+func TestSetGlobalCallback(t *testing.T) {
+	var (
+		names  []string
+		values []interface{}
+	)
+	b := starbox.New("test")
+	b.SetGlobalCallback(func(name string, value interface{}) {
+		names = append(names, name)
+		values = append(values, value)
+	})
+	out, err := b.Run(hereDoc(`
+		c = "three"
+		a = 1
+		b = [2]
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if es := []string{"a", "b", "c"}; !reflect.DeepEqual(es, names) {
+		t.Errorf("expect names %v, got %v", es, names)
+	}
+	if es := []interface{}{int64(1), []interface{}{int64(2)}, "three"}; !reflect.DeepEqual(es, values) {
+		t.Errorf("expect values %v, got %v", es, values)
+	}
+	if len(out) != 3 {
+		t.Errorf("expect 3 globals in output, got %v", out)
+	}
+
+	// nil callback is a no-op
+	b2 := starbox.New("test2")
+	b2.SetGlobalCallback(nil)
+	if _, err := b2.Run(`a = 1`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+}
+
+// TestRunCells tests the scripts run in order with accumulated globals, and it stops at the first error.
+// TestSetOutputTransform tests the following:
+// 1. Set an output transform that drops nil values and renames keys.
+// 2. Run scripts with different methods, and check the outputs are transformed.
+// 3. Check the typed getters see the output before transform.
+func TestSetOutputTransform(t *testing.T) {
+	transform := func(out starlet.StringAnyMap) starlet.StringAnyMap {
+		res := make(starlet.StringAnyMap, len(out))
+		for k, v := range out {
+			if v != nil {
+				res["out_"+k] = v
+			}
+		}
+		return res
+	}
+	script := `a = 1; b = None`
+	es := starlet.StringAnyMap{"out_a": int64(1)}
+
+	b := starbox.New("test")
+	b.SetOutputTransform(transform)
+	out, err := b.Run(script)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(out, es) {
+		t.Errorf("expect %v, got %v", es, out)
+	}
+	if v, err := b.GetInt("a"); err != nil || v != 1 {
+		t.Errorf("expect getter sees the output before transform, got %v, %v", v, err)
+	}
+
+	b = starbox.New("test")
+	b.SetOutputTransform(transform)
+	if out, err = b.CreateRunConfig().Script(script).Execute(); err != nil || !reflect.DeepEqual(out, es) {
+		t.Errorf("expect %v, got %v, %v", es, out, err)
+	}
+
+	b = starbox.New("test")
+	b.SetOutputTransform(transform)
+	outs, err := b.RunCells(script, `c = a + 1`)
+	if err != nil || len(outs) != 2 || !reflect.DeepEqual(outs[0], es) || !reflect.DeepEqual(outs[1], starlet.StringAnyMap{"out_c": int64(2)}) {
+		t.Errorf("unexpected outputs: %v, %v", outs, err)
+	}
+}
+
+func TestRunCells(t *testing.T) {
+	b := starbox.New("test")
+	res, err := b.RunCells(`a = 10`, `b = a * 2`, `c = a + b`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	es := []starlet.StringAnyMap{{"a": int64(10)}, {"b": int64(20)}, {"c": int64(30)}}
+	if !reflect.DeepEqual(es, res) {
+		t.Errorf("expect %v, got %v", es, res)
+	}
+
+	// stop at the first error
+	b2 := starbox.New("test2")
+	res, err = b2.RunCells(`a = 1`, `b = a + x`, `c = 3`)
+	if err == nil || !strings.Contains(err.Error(), "cell 1") {
+		t.Errorf("expect error of cell 1, got %v", err)
+	}
+	if es := []starlet.StringAnyMap{{"a": int64(1)}}; !reflect.DeepEqual(es, res) {
+		t.Errorf("expect %v, got %v", es, res)
+	}
+
+	// no scripts
+	if res, err := starbox.New("test3").RunCells(); err != nil || len(res) != 0 {
+		t.Errorf("expect empty results, got %v, %v", res, err)
+	}
+}
+
 func TestRunTwice(t *testing.T) {
 	b := starbox.New("test")
 	out, err := b.Run(`a = 10`)
@@ -594,211 +1125,618 @@ func TestCallStarFunc(t *testing.T) {
 	}
 }
 
-func TestSetAddRunPanic(t *testing.T) {
-	getBox := func(t *testing.T) *starbox.Starbox {
-		b := starbox.New("test")
-		out, err := b.Run(`s = "hello world"`)
-		if err != nil {
-			t.Errorf("unexpected error: %v", err)
-		}
-		if out["s"] != "hello world" {
-			t.Errorf("unexpected output: %v", out)
+func TestCallStarlarkChain(t *testing.T) {
+	b := starbox.New("test")
+	if _, err := b.CallStarlarkChain(nil); err != starbox.ErrNotExecuted {
+		t.Errorf("expect ErrNotExecuted, got %v", err)
+	}
+	_, err := b.Run(hereDoc(`
+		def make(n):
+			return lambda x: x * n
+		def apply(f, x):
+			return f(x)
+		def add(a, b):
+			return a + b
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	// the function can't be converted, but it's passed as is
+	res, err := b.CallStarlarkChain([]starbox.StarCall{
+		{Name: "make", Args: []interface{}{3}},
+		{Name: "apply", Args: []interface{}{starbox.PrevResult, 5}},
+		{Name: "add", Args: []interface{}{starbox.ChainResult(1), starbox.PrevResult}},
+		{Name: "add", Args: []interface{}{"a", "b"}},
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if len(res) != 4 || res[1] != int64(15) || res[2] != int64(30) || res[3] != "ab" {
+		t.Errorf("unexpected results: %v", res)
+	}
+
+	// stop at the first failure
+	for _, calls := range [][]starbox.StarCall{
+		{{Name: "add", Args: []interface{}{1, 2}}, {Name: "missing"}},
+		{{Name: "add", Args: []interface{}{1, 2}}, {Name: "add", Args: []interface{}{starbox.ChainResult(1), 1}}},
+		{{Name: "add", Args: []interface{}{1, 2}}, {Name: "add", Args: []interface{}{starbox.PrevResult, "a"}}},
+		{{Name: "add", Args: []interface{}{1, 2}}, {Name: "add", Args: []interface{}{make(chan int), 1}}},
+	} {
+		res, err := b.CallStarlarkChain(calls)
+		if err == nil || !strings.HasPrefix(err.Error(), "call 1") {
+			t.Errorf("expect error of the second call, got %v", err)
 		}
-		logger, err := zap.NewDevelopment()
-		if err != nil {
-			t.Errorf("unexpected error for zap: %v", err)
+		if len(res) != 1 || res[0] != int64(3) {
+			t.Errorf("expect result of the first call, got %v", res)
 		}
-		starbox.SetLog(logger.Sugar())
-		return b
 	}
+}
 
-	tests := []struct {
-		name string
-		fn   func(b *starbox.Starbox)
-	}{
-		{
-			name: "set logger",
-			fn: func(b *starbox.Starbox) {
-				b.SetLogger(nil)
-			},
-		},
-		{
-			name: "set struct",
-			fn: func(b *starbox.Starbox) {
-				b.SetStructTag("json")
-			},
-		},
-		{
-			name: "set printf",
-			fn: func(b *starbox.Starbox) {
+func TestGetStarlarkGlobals(t *testing.T) {
+	b := starbox.New("test")
+	if _, err := b.GetStarlarkGlobals(); err != starbox.ErrNotExecuted {
+		t.Errorf("expect ErrNotExecuted, got %v", err)
+		return
+	}
+
+	b.AddKeyValue("base", 100)
+	if _, err := b.Run(hereDoc(`
+		def add(x):
+			return base + x
+		nums = [1, 2, 3]
+	`)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	sd, err := b.GetStarlarkGlobals()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if _, ok := sd["add"].(*starlark.Function); !ok {
+		t.Errorf("expect starlark function, got %T", sd["add"])
+	}
+	if _, ok := sd["nums"].(*starlark.List); !ok {
+		t.Errorf("expect starlark list, got %T", sd["nums"])
+	}
+	if ev := starlark.MakeInt(100); sd["base"] != ev {
+		t.Errorf("expect %v, got %v", ev, sd["base"])
+	}
+
+	// feed the raw values into another box
+	b2 := starbox.New("test2")
+	b2.AddStarlarkValues(sd)
+	out, err := b2.Run(`r = add(nums[-1])`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := int64(103); out["r"] != es {
+		t.Errorf("expect %d, got %v", es, out["r"])
+	}
+}
+
+func TestGetStarlarkResult(t *testing.T) {
+	b := starbox.New("test")
+	if _, ok := b.GetStarlarkResult("a"); ok {
+		t.Errorf("expect no result before execution")
+		return
+	}
+
+	b.AddKeyValue("base", 100)
+	if _, err := b.Run(hereDoc(`
+		def add(x):
+			return base + x
+		d = {"a": [1, 2], "b": add}
+	`)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	d, ok := b.GetStarlarkResult("d")
+	if !ok {
+		t.Errorf("expect result d")
+		return
+	}
+	if _, ok := d.(*starlark.Dict); !ok {
+		t.Errorf("expect starlark dict, got %T", d)
+		return
+	}
+	if _, ok := b.GetStarlarkResult("base"); ok {
+		t.Errorf("expect no result for preset global")
+	}
+	if _, ok := b.GetStarlarkResult("missing"); ok {
+		t.Errorf("expect no result for missing name")
+	}
+
+	// feed the raw value into another box
+	b2 := starbox.New("test2")
+	b2.AddKeyStarlarkValue("d", d)
+	out, err := b2.Run(`r = d["b"](d["a"][-1])`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := int64(102); out["r"] != es {
+		t.Errorf("expect %d, got %v", es, out["r"])
+	}
+
+	// only the result of the last run
+	if _, err := b.Run(`e = 1`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if _, ok := b.GetStarlarkResult("d"); ok {
+		t.Errorf("expect no result d from previous run")
+	}
+	if v, ok := b.GetStarlarkResult("e"); !ok || v != starlark.MakeInt(1) {
+		t.Errorf("expect result e = 1, got %v", v)
+	}
+}
+
+func TestSetAddRunPanic(t *testing.T) {
+	getBox := func(t *testing.T) *starbox.Starbox {
+		b := starbox.New("test")
+		out, err := b.Run(`s = "hello world"`)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if out["s"] != "hello world" {
+			t.Errorf("unexpected output: %v", out)
+		}
+		logger, err := zap.NewDevelopment()
+		if err != nil {
+			t.Errorf("unexpected error for zap: %v", err)
+		}
+		starbox.SetLog(logger.Sugar())
+		return b
+	}
+
+	tests := []struct {
+		name string
+		fn   func(b *starbox.Starbox)
+	}{
+		{
+			name: "set logger",
+			fn: func(b *starbox.Starbox) {
+				b.SetLogger(nil)
+			},
+		},
+		{
+			name: "set struct",
+			fn: func(b *starbox.Starbox) {
+				b.SetStructTag("json")
+			},
+		},
+		{
+			name: "set printf",
+			fn: func(b *starbox.Starbox) {
 				b.SetPrintFunc(func(thread *starlark.Thread, msg string) {
 					t.Logf("printf: %s", msg)
 				})
 			},
 		},
 		{
-			name: "set fs",
+			name: "set fs",
+			fn: func(b *starbox.Starbox) {
+				b.SetFS(nil)
+			},
+		},
+		{
+			name: "set module set",
+			fn: func(b *starbox.Starbox) {
+				b.SetModuleSet(starbox.SafeModuleSet)
+			},
+		},
+		{
+			name: "add key value",
+			fn: func(b *starbox.Starbox) {
+				b.AddKeyValue("a", 1)
+			},
+		},
+		{
+			name: "add frozen key value",
+			fn: func(b *starbox.Starbox) {
+				b.AddFrozenKeyValue("f", 1)
+			},
+		},
+		{
+			name: "add key starlark value",
+			fn: func(b *starbox.Starbox) {
+				b.AddKeyStarlarkValue("a", starlark.MakeInt(100))
+			},
+		},
+		{
+			name: "add key values",
+			fn: func(b *starbox.Starbox) {
+				b.AddKeyValues(starlet.StringAnyMap{
+					"a": 1,
+					"b": 2,
+				})
+			},
+		},
+		{
+			name: "add starlark values",
+			fn: func(b *starbox.Starbox) {
+				b.AddStarlarkValues(starlark.StringDict{
+					"a": starlark.MakeInt(1),
+					"b": starlark.MakeInt(2),
+				})
+			},
+		},
+		{
+			name: "add builtin",
+			fn: func(b *starbox.Starbox) {
+				b.AddBuiltin("a", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+					return starlark.String("aloha"), nil
+				})
+			},
+		},
+		{
+			name: "add named module",
+			fn: func(b *starbox.Starbox) {
+				b.AddNamedModules("base64")
+			},
+		},
+		{
+			name: "add module loader",
+			fn: func(b *starbox.Starbox) {
+				b.AddModuleLoader("mine", func() (starlark.StringDict, error) {
+					return starlark.StringDict{
+						"shift": starlark.NewBuiltin("shift", func(thread *starlark.Thread, bt *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+							var a, b int64
+							if err := starlark.UnpackArgs(bt.Name(), args, kwargs, "a", &a, "b", &b); err != nil {
+								return nil, err
+							}
+							return starlark.MakeInt64(a << b).Add(starlark.MakeInt(5)), nil
+						}),
+						"num": starlark.MakeInt(100),
+					}, nil
+				})
+			},
+		},
+		{
+			name: "add module data",
+			fn: func(b *starbox.Starbox) {
+				b.AddModuleData("data", starlark.StringDict{
+					"a": starlark.MakeInt(10),
+					"b": starlark.MakeInt(20),
+					"c": starlark.MakeInt(300),
+				})
+			},
+		},
+		{
+			name: "add module functions",
+			fn: func(b *starbox.Starbox) {
+				b.AddModuleFunctions("func", starbox.FuncMap{
+					"noop": func(thread *starlark.Thread, bt *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+						return starlark.None, nil
+					},
+				})
+			},
+		},
+		{
+			name: "add struct data",
+			fn: func(b *starbox.Starbox) {
+				b.AddStructData("data", starlark.StringDict{
+					"A": starlark.MakeInt(10),
+					"B": starlark.MakeInt(20),
+					"C": starlark.MakeInt(300),
+				})
+			},
+		},
+		{
+			name: "add struct functions",
+			fn: func(b *starbox.Starbox) {
+				b.AddStructFunctions("func", starbox.FuncMap{
+					"noop": func(thread *starlark.Thread, bt *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+						return starlark.None, nil
+					},
+				})
+			},
+		},
+		{
+			name: "add module script",
+			fn: func(b *starbox.Starbox) {
+				b.AddModuleScript("data", hereDoc(`
+					a = 10
+					b = 20
+					c = 300
+				`))
+			},
+		},
+		{
+			name: "add module fs",
+			fn: func(b *starbox.Starbox) {
+				b.AddModuleFS("lib", fstest.MapFS{})
+			},
+		},
+		{
+			name: "add module script using module",
+			fn: func(b *starbox.Starbox) {
+				b.AddNamedModules("base64")
+				b.AddModuleScript("data", hereDoc(`
+					load("base64", "encode")
+					a = encode("hello world")
+					print(a, base64.encode("Aloha!"))
+				`))
+			},
+		},
+		{
+			name: "add http context",
+			fn: func(b *starbox.Starbox) {
+				b.AddHTTPContext(nil)
+			},
+		},
+		{
+			name: "add http context opts",
+			fn: func(b *starbox.Starbox) {
+				b.AddHTTPContextOpts(nil, starbox.HTTPContextOptions{})
+			},
+		},
+		{
+			name: "create memory",
+			fn: func(b *starbox.Starbox) {
+				b.CreateMemory("test1")
+			},
+		},
+		{
+			name: "attach memory",
+			fn: func(b *starbox.Starbox) {
+				m := starbox.NewMemory()
+				b.AttachMemory("test2", m)
+			},
+		},
+		{
+			name: "attach memory cow",
+			fn: func(b *starbox.Starbox) {
+				b.AttachMemoryCOW("test3", starbox.NewMemory())
+			},
+		},
+		{
+			name: "create observed memory",
+			fn: func(b *starbox.Starbox) {
+				b.CreateObservedMemory("test4")
+			},
+		},
+		{
+			name: "create memory with ttl",
+			fn: func(b *starbox.Starbox) {
+				b.CreateMemoryWithTTL("test5", time.Second)
+			},
+		},
+		{
+			name: "set cache provider",
+			fn: func(b *starbox.Starbox) {
+				b.SetScriptCache(nil)
+			},
+		},
+		{
+			name: "set module provider",
+			fn: func(b *starbox.Starbox) {
+				b.SetDynamicModuleLoader(nil)
+			},
+		},
+		{
+			name: "set thread local",
+			fn: func(b *starbox.Starbox) {
+				b.SetThreadLocal("key", "value")
+			},
+		},
+		{
+			name: "set thread name",
+			fn: func(b *starbox.Starbox) {
+				b.SetThreadName("worker")
+			},
+		},
+		{
+			name: "add emit channel",
+			fn: func(b *starbox.Starbox) {
+				b.AddEmitChannel(make(chan interface{}))
+			},
+		},
+		{
+			name: "set print channel",
+			fn: func(b *starbox.Starbox) {
+				b.PrintChannel(1)
+			},
+		},
+		{
+			name: "set print channel drop",
+			fn: func(b *starbox.Starbox) {
+				b.SetPrintChannelDrop(true)
+			},
+		},
+		{
+			name: "set exit handler",
+			fn: func(b *starbox.Starbox) {
+				b.SetExitHandler(func(int) {})
+			},
+		},
+		{
+			name: "set module load timeout",
+			fn: func(b *starbox.Starbox) {
+				b.SetModuleLoadTimeout(time.Second)
+			},
+		},
+		{
+			name: "set bulk dynamic module loader",
+			fn: func(b *starbox.Starbox) {
+				b.SetBulkDynamicModuleLoader(nil)
+			},
+		},
+		{
+			name: "add channel",
+			fn: func(b *starbox.Starbox) {
+				_ = b.AddChannel("source", make(chan interface{}))
+			},
+		},
+		{
+			name: "set time conversion",
+			fn: func(b *starbox.Starbox) {
+				b.SetTimeConversion(starbox.TimeModeUnix)
+			},
+		},
+		{
+			name: "set thread configurator",
+			fn: func(b *starbox.Starbox) {
+				b.SetThreadConfigurator(func(*starlark.Thread) {})
+			},
+		},
+		{
+			name: "set print format",
+			fn: func(b *starbox.Starbox) {
+				b.SetPrintFormat("", false)
+			},
+		},
+		{
+			name: "set print as warnings",
+			fn: func(b *starbox.Starbox) {
+				b.SetPrintAsWarnings(true)
+			},
+		},
+		{
+			name: "set big int output",
+			fn: func(b *starbox.Starbox) {
+				b.SetBigIntOutput(true)
+			},
+		},
+		{
+			name: "set global callback",
+			fn: func(b *starbox.Starbox) {
+				b.SetGlobalCallback(nil)
+			},
+		},
+		{
+			name: "enable module introspection",
+			fn: func(b *starbox.Starbox) {
+				b.EnableModuleIntrospection()
+			},
+		},
+		{
+			name: "set max call depth",
+			fn: func(b *starbox.Starbox) {
+				b.SetMaxCallDepth(100)
+			},
+		},
+		{
+			name: "set output transform",
 			fn: func(b *starbox.Starbox) {
-				b.SetFS(nil)
+				b.SetOutputTransform(nil)
 			},
 		},
 		{
-			name: "set module set",
+			name: "set allow global reassign",
 			fn: func(b *starbox.Starbox) {
-				b.SetModuleSet(starbox.SafeModuleSet)
+				b.SetAllowGlobalReassign(false)
 			},
 		},
 		{
-			name: "add key value",
+			name: "add typed func",
 			fn: func(b *starbox.Starbox) {
-				b.AddKeyValue("a", 1)
+				b.AddTypedFunc("add", func(a, b int) int { return a + b })
 			},
 		},
 		{
-			name: "add key starlark value",
+			name: "add named modules glob",
 			fn: func(b *starbox.Starbox) {
-				b.AddKeyStarlarkValue("a", starlark.MakeInt(100))
+				b.AddNamedModulesGlob("*")
 			},
 		},
 		{
-			name: "add key values",
+			name: "use registry",
 			fn: func(b *starbox.Starbox) {
-				b.AddKeyValues(starlet.StringAnyMap{
-					"a": 1,
-					"b": 2,
-				})
+				b.UseRegistry(starbox.NewBuiltinRegistry())
 			},
 		},
 		{
-			name: "add starlark values",
+			name: "set script filter",
 			fn: func(b *starbox.Starbox) {
-				b.AddStarlarkValues(starlark.StringDict{
-					"a": starlark.MakeInt(1),
-					"b": starlark.MakeInt(2),
-				})
+				b.SetScriptFilter(nil)
 			},
 		},
 		{
-			name: "add builtin",
+			name: "add type",
 			fn: func(b *starbox.Starbox) {
-				b.AddBuiltin("a", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-					return starlark.String("aloha"), nil
-				})
+				b.AddType("point", func(args ...interface{}) (starlark.Value, error) { return starlark.None, nil })
 			},
 		},
 		{
-			name: "add named module",
+			name: "enable include",
 			fn: func(b *starbox.Starbox) {
-				b.AddNamedModules("base64")
+				b.EnableInclude()
 			},
 		},
 		{
-			name: "add module loader",
+			name: "set json print",
 			fn: func(b *starbox.Starbox) {
-				b.AddModuleLoader("mine", func() (starlark.StringDict, error) {
-					return starlark.StringDict{
-						"shift": starlark.NewBuiltin("shift", func(thread *starlark.Thread, bt *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-							var a, b int64
-							if err := starlark.UnpackArgs(bt.Name(), args, kwargs, "a", &a, "b", &b); err != nil {
-								return nil, err
-							}
-							return starlark.MakeInt64(a << b).Add(starlark.MakeInt(5)), nil
-						}),
-						"num": starlark.MakeInt(100),
-					}, nil
-				})
+				b.SetJSONPrint(io.Discard)
 			},
 		},
 		{
-			name: "add module data",
+			name: "set args",
 			fn: func(b *starbox.Starbox) {
-				b.AddModuleData("data", starlark.StringDict{
-					"a": starlark.MakeInt(10),
-					"b": starlark.MakeInt(20),
-					"c": starlark.MakeInt(300),
-				})
+				b.SetArgs([]string{"-v"})
 			},
 		},
 		{
-			name: "add module functions",
+			name: "bind context value",
 			fn: func(b *starbox.Starbox) {
-				b.AddModuleFunctions("func", starbox.FuncMap{
-					"noop": func(thread *starlark.Thread, bt *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-						return starlark.None, nil
-					},
-				})
+				b.BindContextValue("key", "value")
 			},
 		},
 		{
-			name: "add struct data",
+			name: "set random seed",
 			fn: func(b *starbox.Starbox) {
-				b.AddStructData("data", starlark.StringDict{
-					"A": starlark.MakeInt(10),
-					"B": starlark.MakeInt(20),
-					"C": starlark.MakeInt(300),
-				})
+				b.SetRandomSeed(1)
 			},
 		},
 		{
-			name: "add struct functions",
+			name: "set clock",
 			fn: func(b *starbox.Starbox) {
-				b.AddStructFunctions("func", starbox.FuncMap{
-					"noop": func(thread *starlark.Thread, bt *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-						return starlark.None, nil
-					},
-				})
+				b.SetClock(time.Now())
 			},
 		},
 		{
-			name: "add module script",
+			name: "set deterministic",
 			fn: func(b *starbox.Starbox) {
-				b.AddModuleScript("data", hereDoc(`
-					a = 10
-					b = 20
-					c = 300
-				`))
+				b.SetDeterministic(1)
 			},
 		},
 		{
-			name: "add module script using module",
+			name: "set include backtrace",
 			fn: func(b *starbox.Starbox) {
-				b.AddNamedModules("base64")
-				b.AddModuleScript("data", hereDoc(`
-					load("base64", "encode")
-					a = encode("hello world")
-					print(a, base64.encode("Aloha!"))
-				`))
+				b.SetIncludeBacktrace(true)
 			},
 		},
 		{
-			name: "add http context",
+			name: "set modules var name",
 			fn: func(b *starbox.Starbox) {
-				b.AddHTTPContext(nil)
+				b.SetModulesVarName("mods")
 			},
 		},
 		{
-			name: "create memory",
+			name: "set module set except",
 			fn: func(b *starbox.Starbox) {
-				b.CreateMemory("test1")
+				b.SetModuleSetExcept(starbox.SafeModuleSet, "json")
 			},
 		},
 		{
-			name: "attach memory",
+			name: "set module set with",
 			fn: func(b *starbox.Starbox) {
-				m := starbox.NewMemory()
-				b.AttachMemory("test2", m)
+				_ = b.SetModuleSetWith(starbox.EmptyModuleSet, "json")
 			},
 		},
 		{
-			name: "set cache provider",
+			name: "set parallel module loading",
 			fn: func(b *starbox.Starbox) {
-				b.SetScriptCache(nil)
+				b.SetParallelModuleLoading(true)
 			},
 		},
 		{
-			name: "set module provider",
+			name: "set module priority",
 			fn: func(b *starbox.Starbox) {
-				b.SetDynamicModuleLoader(nil)
+				b.SetModulePriority(starbox.PriorityCustomWins)
 			},
 		},
 	}
@@ -1113,6 +2051,43 @@ func TestConflictGlobalModule(t *testing.T) {
 	}
 }
 
+// TestSetAllowGlobalReassign tests the following:
+// 1. Run scripts reassigning globals with the default setting.
+// 2. Disallow global reassignment, and check the reassignment fails.
+// 3. Check the setting is kept after Reset().
+func TestSetAllowGlobalReassign(t *testing.T) {
+	scripts := []string{
+		"a = 1\na = 2",
+		"if True:\n    a = 1",
+	}
+	b := starbox.New("test")
+	for _, script := range scripts {
+		b.Reset()
+		if _, err := b.Run(script); err != nil {
+			t.Errorf("unexpected error for %q: %v", script, err)
+		}
+	}
+
+	b = starbox.New("test")
+	b.SetAllowGlobalReassign(false)
+	for i := 0; i < 2; i++ {
+		for _, script := range scripts {
+			b.Reset()
+			if _, err := b.Run(script); err == nil {
+				t.Errorf("expect error for %q, got nil", script)
+			}
+		}
+	}
+	b.Reset()
+	if _, err := b.Run("a = 1\na = 2"); err == nil || !strings.Contains(err.Error(), "cannot reassign global a") {
+		t.Errorf("expect reassign error, got %v", err)
+	}
+	b.Reset()
+	if out, err := b.Run("a = 1\nb = a + 1"); err != nil || out["b"] != int64(2) {
+		t.Errorf("unexpected result: %v, %v", out, err)
+	}
+}
+
 func TestConflictModuleMemberLoader(t *testing.T) {
 	name := "go_idiomatic"
 	b := starbox.New("test")
@@ -1132,6 +2107,215 @@ func TestConflictModuleMemberLoader(t *testing.T) {
 	}
 }
 
+// TestSetModulePriority tests the following:
+// 1. Create Starbox instances with a custom module conflicting with a builtin module.
+// 2. Set different module priority policies.
+// 3. Check which module wins, or the conflict error is returned.
+func TestSetModulePriority(t *testing.T) {
+	getBox := func(policy starbox.ModulePriority) *starbox.Starbox {
+		b := starbox.New("test")
+		b.SetModuleSet(starbox.SafeModuleSet)
+		b.SetModulePriority(policy)
+		b.AddModuleData("json", starlark.StringDict{"mine": starlark.True})
+		b.AddModuleData("data", starlark.StringDict{"a": starlark.MakeInt(1)})
+		return b
+	}
+
+	// builtin wins
+	b := getBox(starbox.PriorityBuiltinWins)
+	if _, err := b.Run(`s = json.encode([1])`); err != nil {
+		t.Errorf("builtin wins: expect nil, got %v", err)
+	}
+
+	// custom wins
+	b = getBox(starbox.PriorityCustomWins)
+	out, err := b.Run(`load("json", "mine"); m = mine and json.mine; d = data.a; s = base64.encode("a")`)
+	if err != nil {
+		t.Errorf("custom wins: expect nil, got %v", err)
+	} else if out["m"] != true {
+		t.Errorf("custom wins: expect m=true, got %v", out["m"])
+	}
+	if _, err := b.Run(`s = json.encode([1])`); err == nil {
+		t.Error("custom wins: expect error for builtin member, got nil")
+	}
+
+	// error on conflicts
+	b = getBox(starbox.PriorityError)
+	if _, err := b.Run(`a = 1`); !errors.Is(err, starbox.ErrModuleConflict) {
+		t.Errorf("error: expect conflict error, got %v", err)
+	} else if es := "module name conflict: json"; err.Error() != es {
+		t.Errorf("error: expect %q, got %q", es, err.Error())
+	}
+
+	// no conflicts
+	b = starbox.New("test")
+	b.SetModulePriority(starbox.PriorityError)
+	b.AddNamedModules("base64")
+	b.AddModuleData("data", starlark.StringDict{"a": starlark.MakeInt(1)})
+	if _, err := b.Run(`a = data.a; s = base64.encode("a")`); err != nil {
+		t.Errorf("no conflict: expect nil, got %v", err)
+	}
+}
+
+// TestResolveModules tests the following:
+// 1. Create a new Starbox instance with builtin, custom and dynamic modules, including conflicts.
+// 2. Resolve the modules without execution, and check the names of preload and lazyload modules.
+// 3. Check the box is not executed and errors are returned for missing modules.
+func TestResolveModules(t *testing.T) {
+	b := starbox.New("test")
+	b.AddNamedModules("base64", "go_idiomatic", "mine")
+	b.AddModuleData("go_idiomatic", starlark.StringDict{"a": starlark.MakeInt(1)})
+	b.AddModuleData("data", starlark.StringDict{"a": starlark.MakeInt(1)})
+	b.AddModuleData("cus", starlark.StringDict{"a": starlark.MakeInt(1)})
+	b.SetDynamicModuleLoader(func(name string) (starlet.ModuleLoader, error) {
+		return func() (starlark.StringDict, error) {
+			return starlark.StringDict{name: starlark.True}, nil
+		}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		pre, lazy, err := b.ResolveModules()
+		if err != nil {
+			t.Errorf("expect nil, got %v", err)
+			return
+		}
+		if es := []string{"base64", "go_idiomatic", "cus", "data", "mine"}; !reflect.DeepEqual(es, pre) {
+			t.Errorf("expect preload %v, got %v", es, pre)
+		}
+		if es := []string{"base64", "cus", "data", "go_idiomatic", "mine"}; !reflect.DeepEqual(es, lazy) {
+			t.Errorf("expect lazyload %v, got %v", es, lazy)
+		}
+	}
+	if st := b.GetSteps(); st != 0 {
+		t.Errorf("expect no execution, got %d steps", st)
+	}
+	b.AddKeyValue("x", 1)
+
+	b2 := starbox.New("test2")
+	b2.AddNamedModules("not_exists")
+	if _, _, err := b2.ResolveModules(); err == nil {
+		t.Error("expect error for missing module, got nil")
+	}
+}
+
+// TestClassifyModule tests the following:
+// 1. Configure modules from different sources.
+// 2. Check each name is classified by the precedence before and after execution.
+// 3. Check the filesystem set by SetFS() overrides the module scripts.
+func TestClassifyModule(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.EmptyModuleSet)
+	b.AddNamedModules("base64", "go_idiomatic", "mine")
+	b.AddModuleData("go_idiomatic", starlark.StringDict{"a": starlark.MakeInt(1)})
+	b.AddModuleData("data", starlark.StringDict{"a": starlark.MakeInt(1)})
+	b.AddModuleScript("util", `x = 1`)
+	b.AddModuleFS("lib", fstest.MapFS{"math.star": {Data: []byte(`y = 2`)}})
+	b.SetDynamicModuleLoader(func(name string) (starlet.ModuleLoader, error) {
+		return func() (starlark.StringDict, error) {
+			return starlark.StringDict{name: starlark.True}, nil
+		}, nil
+	})
+
+	check := func(stage string) {
+		for name, es := range map[string]string{
+			"base64":        "builtin",
+			"go_idiomatic":  "builtin",
+			"data":          "custom",
+			"mine":          "dynamic",
+			"util":          "script",
+			"util.star":     "script",
+			"lib/math.star": "script",
+			"json":          "",
+			"lib/none.star": "",
+		} {
+			src, ok := b.ClassifyModule(name)
+			if src != es || ok != (es != "") {
+				t.Errorf("[%s] expect %q for %s, got %q, %v", stage, es, name, src, ok)
+			}
+		}
+	}
+	check("before")
+	if _, err := b.Run(`load("util", "x"); load("lib/math.star", "y")`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	check("after")
+
+	b = starbox.New("test")
+	b.SetModulePriority(starbox.PriorityCustomWins)
+	b.AddNamedModules("base64")
+	b.AddModuleData("base64", starlark.StringDict{"a": starlark.MakeInt(1)})
+	b.AddModuleScript("util", `x = 1`)
+	b.SetFS(fstest.MapFS{"other.star": {Data: []byte(`z = 3`)}})
+	if src, ok := b.ClassifyModule("base64"); src != "custom" || !ok {
+		t.Errorf("expect custom module wins, got %q, %v", src, ok)
+	}
+	if src, ok := b.ClassifyModule("other"); src != "script" || !ok {
+		t.Errorf("expect script in filesystem, got %q, %v", src, ok)
+	}
+	if _, ok := b.ClassifyModule("util"); ok {
+		t.Errorf("expect module script overridden by filesystem")
+	}
+	if _, ok := b.ClassifyModule("mine"); ok {
+		t.Errorf("expect no dynamic module without loader")
+	}
+}
+
+func TestModuleSymbols(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.EmptyModuleSet)
+	b.AddNamedModules("base64", "mine")
+	b.AddModuleLoader("data", func() (starlark.StringDict, error) {
+		return starlark.StringDict{"b": starlark.MakeInt(1), "a": starlark.MakeInt(2), "_c": starlark.None}, nil
+	})
+	b.AddModuleScript("util", hereDoc(`
+		load("data", "a")
+		x, (y, z) = 1, (2, 3)
+		_hidden = 4
+		def hello(w):
+			v = w
+			return v
+		cond = [i for i in range(3)]
+		print(undefined_name)
+	`))
+	b.AddModuleFS("lib", fstest.MapFS{"math.star": {Data: []byte(`pi = 3.14`)}, "bad.star": {Data: []byte(`x = (`)}})
+	b.SetDynamicModuleLoader(func(name string) (starlet.ModuleLoader, error) {
+		return func() (starlark.StringDict, error) {
+			return starlark.StringDict{name: starlark.True, "extra": starlark.False}, nil
+		}, nil
+	})
+
+	for name, es := range map[string][]string{
+		"base64":        {"base64"},
+		"data":          {"a", "b"},
+		"mine":          {"extra", "mine"},
+		"util":          {"cond", "hello", "x", "y", "z"},
+		"util.star":     {"cond", "hello", "x", "y", "z"},
+		"lib/math.star": {"pi"},
+	} {
+		names, err := b.ModuleSymbols(name)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", name, err)
+		} else if !reflect.DeepEqual(names, es) {
+			t.Errorf("expect %v for %s, got %v", es, name, names)
+		}
+	}
+	if _, err := b.ModuleSymbols("json"); !errors.Is(err, starbox.ErrModuleNotFound) {
+		t.Errorf("expect ErrModuleNotFound, got %v", err)
+	}
+	if _, err := b.ModuleSymbols("lib/bad.star"); err == nil {
+		t.Errorf("expect syntax error, got nil")
+	}
+
+	// the module scripts are not executed
+	if _, err := b.Run(`load("lib/math.star", "pi")`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if names, err := b.ModuleSymbols("lib/math"); err != nil || !reflect.DeepEqual(names, []string{"pi"}) {
+		t.Errorf("expect [pi] after run, got %v, %v", names, err)
+	}
+}
+
 func TestConflictModuleStructLoader(t *testing.T) {
 	name := "base64"
 	b := starbox.New("test")
@@ -1208,6 +2392,109 @@ func TestModuleLoaderOnce(t *testing.T) {
 	}
 }
 
+// TestWarmup tests the following:
+// 1. Create a new Starbox instance with a counting module loader.
+// 2. Warm up the box twice, and check the module is preloaded only once.
+// 3. Run a script and check the module is not loaded again.
+// 4. Check the errors of module resolution are returned by Warmup, and changes after warm-up take effect.
+func TestWarmup(t *testing.T) {
+	b := starbox.New("test")
+	loadCnt := 0
+	b.AddModuleLoader("mine", func() (starlark.StringDict, error) {
+		loadCnt++
+		return starlark.StringDict{"num": starlark.MakeInt(100)}, nil
+	})
+	for i := 0; i < 2; i++ {
+		if err := b.Warmup(); err != nil {
+			t.Errorf("expect nil, got %v", err)
+			return
+		}
+	}
+	if loadCnt != 1 {
+		t.Errorf("expect 1 load after warm-up, got %d", loadCnt)
+	}
+	out, err := b.Run(`r = num + 1`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["r"] != int64(101) {
+		t.Errorf("expect r=101, got %v", out["r"])
+	}
+	if loadCnt != 1 {
+		t.Errorf("expect 1 load after run, got %d", loadCnt)
+	}
+
+	// errors of module resolution
+	b2 := starbox.New("test2")
+	b2.AddNamedModules("not_exists")
+	if err := b2.Warmup(); err == nil {
+		t.Error("expect error for missing module, got nil")
+	}
+
+	// changes after warm-up
+	b3 := starbox.New("test3")
+	b3.AddKeyValue("a", 1)
+	if err := b3.Warmup(); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	b3.AddKeyValue("b", 2)
+	out, err = b3.Run(`c = a + b`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["c"] != int64(3) {
+		t.Errorf("expect c=3, got %v", out["c"])
+	}
+
+	// module changes after warm-up
+	modLoader := func() (starlark.StringDict, error) {
+		return starlark.StringDict{"y": starlark.MakeInt(4)}, nil
+	}
+	for name, tc := range map[string]struct {
+		change func(b *starbox.Starbox)
+		script string
+	}{
+		"module script": {func(b *starbox.Starbox) { b.AddModuleScript("b", `y = 4`) }, `load("b.star", "y")`},
+		"module fs":     {func(b *starbox.Starbox) { b.AddModuleFS("lib", fstest.MapFS{"b.star": {Data: []byte(`y = 4`)}}) }, `load("lib/b.star", "y")`},
+		"filesystem":    {func(b *starbox.Starbox) { b.SetFS(fstest.MapFS{"b.star": {Data: []byte(`y = 4`)}}) }, `load("b.star", "y")`},
+		"module loader": {func(b *starbox.Starbox) { b.AddModuleLoader("mod", modLoader) }, `load("mod", "y")`},
+		"named module":  {func(b *starbox.Starbox) { b.AddNamedModules("math") }, `y = int(math.sqrt(16))`},
+	} {
+		b := starbox.New("test")
+		b.SetModuleSet(starbox.EmptyModuleSet)
+		b.AddModuleScript("a", `x = 1`)
+		if err := b.Warmup(); err != nil {
+			t.Errorf("[%s] expect nil, got %v", name, err)
+			continue
+		}
+		tc.change(b)
+		out, err := b.Run(tc.script + "\nr = y")
+		if err != nil {
+			t.Errorf("[%s] expect nil, got %v", name, err)
+			continue
+		}
+		if out["r"] != int64(4) {
+			t.Errorf("[%s] expect r=4, got %v", name, out["r"])
+		}
+	}
+
+	// module scripts added after reset
+	b4 := starbox.New("test4")
+	b4.AddModuleScript("a", `x = 1`)
+	if _, err := b4.Run(`load("a.star", "x")`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	b4.Reset()
+	b4.AddModuleScript("b", `y = 2`)
+	if out, err := b4.Run(`load("a.star", "x"); load("b.star", "y"); r = x + y`); err != nil || out["r"] != int64(3) {
+		t.Errorf("expect r=3, got %v, %v", out, err)
+	}
+}
+
 func TestAddHTTPContext_Nil(t *testing.T) {
 	b := starbox.New("test")
 	b.AddHTTPContext(nil)
@@ -1239,6 +2526,64 @@ func TestAddHTTPContext(t *testing.T) {
 	}
 }
 
+func TestAddHTTPContextOpts(t *testing.T) {
+	newReq := func(body string) *http.Request {
+		req, _ := http.NewRequest("POST", "https://localhost/?q=1&a=2", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	// truncate the body and parse form
+	b := starbox.New("test")
+	req := newReq("name=kai&tag=x&tag=y")
+	resp, err := b.AddHTTPContextOpts(req, starbox.HTTPContextOptions{MaxBodyBytes: 14, ParseForm: true})
+	if err != nil || resp == nil {
+		t.Errorf("unexpected result: %v, %v", resp, err)
+		return
+	}
+	out, err := b.Run(`body = request.body; form = request.form == {"a": ["2"], "name": ["kai"], "q": ["1"], "tag": ["x"]}; m = request.method`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["body"] != "name=kai&tag=x" || out["form"] != true || out["m"] != "POST" {
+		t.Errorf("unexpected output: %v", out)
+	}
+	if bs, _ := io.ReadAll(req.Body); string(bs) != "name=kai&tag=x&tag=y" {
+		t.Errorf("expect full body readable in Go, got %q", bs)
+	}
+
+	// no limit and no form
+	b = starbox.New("test")
+	if _, err := b.AddHTTPContextOpts(newReq(`{"a":1}`), starbox.HTTPContextOptions{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	out, err = b.Run(`a = request.json["a"]; f = hasattr(request, "form")`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if out["a"] != int64(1) || out["f"] != false {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	// error on oversize
+	b = starbox.New("test")
+	if _, err := b.AddHTTPContextOpts(newReq("0123456789"), starbox.HTTPContextOptions{MaxBodyBytes: 9, ErrorOnOversize: true}); !errors.Is(err, starbox.ErrHTTPBodyTooLarge) {
+		t.Errorf("expect ErrHTTPBodyTooLarge, got %v", err)
+	}
+	if _, err := b.AddHTTPContextOpts(newReq("0123456789"), starbox.HTTPContextOptions{MaxBodyBytes: 10, ErrorOnOversize: true}); err != nil {
+		t.Errorf("unexpected error for body within limit: %v", err)
+	}
+
+	// nil request
+	b = starbox.New("test")
+	if _, err := b.AddHTTPContextOpts(nil, starbox.HTTPContextOptions{ParseForm: true}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if out, err := b.Run(`res = request`); err != nil || out["res"] != nil {
+		t.Errorf("expect None request, got %v, %v", out, err)
+	}
+}
+
 func TestConcurrentRun(t *testing.T) {
 	b := starbox.New("test")
 	var wg sync.WaitGroup
@@ -1255,6 +2600,77 @@ func TestConcurrentRun(t *testing.T) {
 	wg.Wait()
 }
 
+// TestRunParallel tests the following:
+// 1. Create a new Starbox instance with a key-value pair and a module set.
+// 2. Run the script for many inputs in parallel.
+// 3. Check the results and errors are aligned with the inputs.
+// 4. Check the box itself is not executed.
+func TestRunParallel(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.SafeModuleSet)
+	b.AddKeyValue("base", 100)
+
+	var inputs []starlet.StringAnyMap
+	for i := 0; i < 50; i++ {
+		inputs = append(inputs, starlet.StringAnyMap{"x": i})
+	}
+	script := `y = base + 100 // x; z = math.floor(1.5)`
+	outs, errs := b.RunParallel(script, inputs, 4)
+	if len(outs) != len(inputs) || len(errs) != len(inputs) {
+		t.Errorf("expect %d results, got %d outputs and %d errors", len(inputs), len(outs), len(errs))
+		return
+	}
+	for i := range inputs {
+		if i == 0 {
+			if errs[i] == nil {
+				t.Errorf("expect error for input %d, got nil", i)
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("expect nil for input %d, got %v", i, errs[i])
+			continue
+		}
+		if es := int64(100 + 100/i); outs[i]["y"] != es {
+			t.Errorf("expect y=%d for input %d, got %v", es, i, outs[i]["y"])
+		}
+	}
+
+	// the box is still configurable
+	if st := b.GetSteps(); st != 0 {
+		t.Errorf("expect 0 steps, got %d", st)
+	}
+	b.AddKeyValue("base", 200)
+	out, err := b.Run(`y = base`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["y"] != int64(200) {
+		t.Errorf("expect y=200, got %v", out["y"])
+	}
+}
+
+// TestRunParallel_DefaultWorkers tests the number of workers defaults to the number of CPUs.
+func TestRunParallel_DefaultWorkers(t *testing.T) {
+	b := starbox.New("test")
+	outs, errs := b.RunParallel(`y = x * 2`, []starlet.StringAnyMap{{"x": 1}, {"x": 2}, {"x": 3}}, 0)
+	for i, e := range errs {
+		if e != nil {
+			t.Errorf("expect nil for input %d, got %v", i, e)
+			return
+		}
+		if es := int64((i + 1) * 2); outs[i]["y"] != es {
+			t.Errorf("expect y=%d, got %v", es, outs[i]["y"])
+		}
+	}
+
+	outs, errs = b.RunParallel(`y = 1`, nil, 0)
+	if len(outs) != 0 || len(errs) != 0 {
+		t.Errorf("expect empty results, got %v and %v", outs, errs)
+	}
+}
+
 func BenchmarkRunBox(b *testing.B) {
 	s := hereDoc(`
 		a = 10
@@ -1313,3 +2729,42 @@ func BenchmarkRunScript(b *testing.B) {
 		}
 	}
 }
+
+// TestRunWithProfile tests the following:
+// 1. Run a script with the profiler, and check the profile is written in pprof format.
+// 2. Check the profiler is stopped after a failed run, so the next profiled run works.
+func TestRunWithProfile(t *testing.T) {
+	var buf bytes.Buffer
+	b := starbox.New("test")
+	out, err := b.RunWithProfile(hereDoc(`
+		def fib(n):
+			a, b = 0, 1
+			for _ in range(n):
+				a, b = b, a + b
+			return a
+		x = [fib(i) for i in range(300)]
+		r = fib(10)
+	`), &buf)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["r"] != int64(55) {
+		t.Errorf("expect r=55, got %v", out["r"])
+	}
+	// pprof profiles are gzip-compressed protocol buffers
+	if data := buf.Bytes(); len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Errorf("expect gzip-compressed profile, got %d bytes", len(data))
+	}
+
+	// failed run
+	var buf2 bytes.Buffer
+	b2 := starbox.New("test2")
+	if _, err := b2.RunWithProfile(`a = 1 // 0`, &buf2); err == nil {
+		t.Error("expect error, got nil")
+	}
+	var buf3 bytes.Buffer
+	if _, err := starbox.New("test3").RunWithProfile(`a = 1`, &buf3); err != nil {
+		t.Errorf("expect nil for the next profiled run, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package starbox
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+const (
+	exitCodeLocalKey = "exit_code"
+)
+
+// ExitError is the error returned by runs when the script called exit() or quit() with a non-zero exit code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+// Error returns the error message of the exit.
+func (e *ExitError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("exit code: %d", e.Code)
+}
+
+// Unwrap returns the underlying error of the exit.
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// SetExitHandler sets the function to call with the exit code after a run in which the script called exit() or quit() from the go_idiomatic module.
+// By default, exit() only stops the script: exit code 0 ends the run without error like a normal end, and a non-zero code makes the run return an *ExitError with the code.
+// The handler doesn't change the semantics, it's called synchronously with the lock of the box held after the run, so it must not call methods of the box.
+// It panics if called after execution.
+func (s *Starbox) SetExitHandler(fn func(code int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set exit handler") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set exit handler after execution")
+	}
+	s.markChanged()
+	s.exitFn = fn
+}
+
+// GetExitCode returns the exit code of the last run and true if the script called exit() or quit() in the run, or 0 and false otherwise.
+func (s *Starbox) GetExitCode() (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.exitCode, s.exited
+}
+
+// resetExit clears the exit code of the last run from the box and the thread.
+func (s *Starbox) resetExit(thread *starlark.Thread) {
+	s.exitCode, s.exited = 0, false
+	if thread != nil {
+		thread.SetLocal(exitCodeLocalKey, nil)
+	}
+}
+
+// checkExit records the exit code if the script called exit() in the run, calls the exit handler, and converts the error of a non-zero exit code into *ExitError.
+func (s *Starbox) checkExit(thread *starlark.Thread, err error) error {
+	if thread == nil {
+		return err
+	}
+	code, ok := thread.Local(exitCodeLocalKey).(uint8)
+	if !ok {
+		return err
+	}
+	s.exitCode, s.exited = int(code), true
+	if s.exitFn != nil {
+		s.exitFn(s.exitCode)
+	}
+	if err != nil && code != 0 {
+		return &ExitError{Code: s.exitCode, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package starbox_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/1set/starbox"
+)
+
+// TestSetExitHandler tests the following:
+// 1. Create a new Starbox instance with an exit handler.
+// 2. Run scripts which end normally, or call exit() with zero and non-zero codes.
+// 3. Check the handler, the exit code and the returned errors.
+func TestSetExitHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		wantCalled bool
+		wantCode   int
+		wantErr    bool
+	}{
+		{"normal", `a = 1`, false, 0, false},
+		{"exit zero", `exit(0)`, true, 0, false},
+		{"quit zero", `quit()`, true, 0, false},
+		{"exit non-zero", `exit(3)`, true, 3, true},
+		{"runtime error", `a = 1 // 0`, false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				called bool
+				code   = -1
+			)
+			b := starbox.New("test")
+			b.SetModuleSet(starbox.SafeModuleSet)
+			b.SetExitHandler(func(c int) {
+				called = true
+				code = c
+			})
+			_, err := b.Run(tt.script)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expect error %v, got %v", tt.wantErr, err)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("expect handler called %v, got %v", tt.wantCalled, called)
+			}
+			if called && code != tt.wantCode {
+				t.Errorf("expect exit code %d, got %d", tt.wantCode, code)
+			}
+			if c, ok := b.GetExitCode(); ok != tt.wantCalled || c != tt.wantCode {
+				t.Errorf("expect exit code %d (%v), got %d (%v)", tt.wantCode, tt.wantCalled, c, ok)
+			}
+			var ee *starbox.ExitError
+			if isExit := errors.As(err, &ee); isExit != (tt.wantCalled && tt.wantErr) {
+				t.Errorf("expect exit error %v, got %v", tt.wantCalled && tt.wantErr, err)
+			} else if isExit && ee.Code != tt.wantCode {
+				t.Errorf("expect exit error code %d, got %d", tt.wantCode, ee.Code)
+			}
+		})
+	}
+}
+
+// TestGetExitCode_Reset tests the exit code is cleared for the next run.
+func TestGetExitCode_Reset(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.SafeModuleSet)
+	if _, err := b.Run(`exit(2)`); err == nil {
+		t.Error("expect error, got nil")
+	}
+	if c, ok := b.GetExitCode(); !ok || c != 2 {
+		t.Errorf("expect exit code 2, got %d (%v)", c, ok)
+	}
+	if _, err := b.Run(`b = 2`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+	if c, ok := b.GetExitCode(); ok || c != 0 {
+		t.Errorf("expect no exit code, got %d (%v)", c, ok)
+	}
+}
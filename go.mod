@@ -5,6 +5,8 @@ go 1.18
 require (
 	bitbucket.org/neiku/hlog v0.1.2
 	github.com/1set/starlet v0.1.2
+	github.com/1set/starlight v0.1.2
+	github.com/google/uuid v1.6.0
 	github.com/h2so5/here v0.0.0-20200815043652-5e14eb691fae
 	github.com/psanford/memfs v0.0.0-20230130182539-4dbf7e3e865e
 	go.starlark.net v0.0.0-20240123142251-f86470692795
@@ -13,11 +15,9 @@ require (
 
 require (
 	github.com/1set/gut v0.0.0-20201117175203-a82363231997 // indirect
-	github.com/1set/starlight v0.1.2 // indirect
 	github.com/BurntSushi/toml v1.2.1 // indirect
 	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e // indirect
 	github.com/google/go-cmp v0.5.6 // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	go.uber.org/atomic v1.11.0 // indirect
 	go.uber.org/multierr v1.9.0 // indirect
 	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
@@ -1,11 +1,17 @@
 package starbox
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 
 	"github.com/1set/starlet"
 	"github.com/1set/starlet/dataconv"
@@ -17,6 +23,7 @@ const (
 )
 
 // NewMemory creates a new shared dictionary for la mémoire collective.
+// Scripts can read it with a default for missing keys via the positional get(key, default), e.g. share.get("count", 0), and the keyword default=... is supported by the memories of WrapMemory() and CreateObservedMemory().
 func NewMemory() *dataconv.SharedDict {
 	return dataconv.NewNamedSharedDict(memoryTypeName)
 }
@@ -26,9 +33,13 @@ func (s *Starbox) AttachMemory(name string, memory *dataconv.SharedDict) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add memory") {
+		return
+	}
 	if s.hasExec {
-		log.DPanic("cannot add memory after execution")
+		s.logger().DPanic("cannot add memory after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
@@ -40,9 +51,13 @@ func (s *Starbox) CreateMemory(name string) *dataconv.SharedDict {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.rejectChange("add memory") {
+		return nil
+	}
 	if s.hasExec {
-		log.DPanic("cannot add memory after execution")
+		s.logger().DPanic("cannot add memory after execution")
 	}
+	s.markChanged()
 	if s.globals == nil {
 		s.globals = make(starlet.StringAnyMap)
 	}
@@ -51,6 +66,682 @@ func (s *Starbox) CreateMemory(name string) *dataconv.SharedDict {
 	return memory
 }
 
+// GetMemory returns the shared dictionary added to the global environment with the given name by methods like AttachMemory() or CreateMemory(), and whether it exists.
+// For a Memory or a memory created by CreateMemoryWithTTL(), its underlying shared dictionary is returned. It returns false if the global doesn't exist or isn't a shared dictionary.
+func (s *Starbox) GetMemory(name string) (*dataconv.SharedDict, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return sharedDictOf(s.globals[name])
+}
+
+// ListMemories returns the sorted names of the shared dictionaries added to the global environment, i.e. the names GetMemory() would find.
+// It works before execution, and the memories are snapshotted by MemoryEntries() with the dictionaries from GetMemory().
+func (s *Starbox) ListMemories() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0)
+	for name, v := range s.globals {
+		if _, ok := sharedDictOf(v); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MemorySizes returns the names of the shared dictionaries added to the global environment with their current numbers of entries, as a quick view of the shared state.
+// It's read-only, so the expired entries of the memories with TTL are counted until they are pruned.
+func (s *Starbox) MemorySizes() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sizes := make(map[string]int)
+	for name, v := range s.globals {
+		if sd, ok := sharedDictOf(v); ok {
+			sizes[name] = sd.Len()
+		}
+	}
+	return sizes
+}
+
+// sharedDictOf returns the underlying shared dictionary of the given global value, and whether it's a shared dictionary.
+func sharedDictOf(v interface{}) (*dataconv.SharedDict, bool) {
+	switch v := v.(type) {
+	case *dataconv.SharedDict:
+		return v, v != nil
+	case *Memory:
+		return v.SharedDict, v != nil
+	case *ttlMemory:
+		return v.SharedDict, v != nil
+	case *cowMemory:
+		return v.SharedDict, v != nil
+	default:
+		return nil, false
+	}
+}
+
+// CreateMemoryWithTTL creates a new shared dictionary for la mémoire collective with the given name like CreateMemory(), and the entries older than ttl are treated as absent by scripts.
+// The expired entries are pruned lazily when scripts access the memory, there is no background sweep, so the returned dictionary may still hold expired entries between the accesses.
+// Setting a key with m[key] = value in scripts refreshes its timestamp, while the entries written via methods like update() or by Go code are timed from the first time scripts access the memory after that.
+// A non-positive ttl means the entries never expire.
+// It panics if called after execution.
+func (s *Starbox) CreateMemoryWithTTL(name string, ttl time.Duration) *dataconv.SharedDict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add memory") {
+		return nil
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add memory after execution")
+	}
+	s.markChanged()
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap)
+	}
+	memory := dataconv.NewNamedSharedDict(memoryTypeName)
+	if ttl > 0 {
+		s.globals[name] = &ttlMemory{SharedDict: memory, ttl: ttl, stamps: make(map[string]time.Time)}
+	} else {
+		s.globals[name] = memory
+	}
+	return memory
+}
+
+// AttachMemoryCOW adds a copy-on-write view of the given shared dictionary to the global environment before execution, and returns the overlay for inspecting or discarding the changes after runs.
+// Scripts read the entries from the overlay first and then from base, and the writes land only in the overlay, so base is never changed by the box and its later changes are visible for the keys not written yet.
+// The mutable values read from base like lists and dicts are deep-copied into the overlay on the first read, so mutating them in place doesn't reach base, and the methods like keys() or pop() work on the overlay after copying the remaining entries of base into it.
+// A nil base gives an empty overlay. It panics if called after execution.
+func (s *Starbox) AttachMemoryCOW(name string, base *dataconv.SharedDict) *dataconv.SharedDict {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add memory") {
+		return nil
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add memory after execution")
+	}
+	s.markChanged()
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap)
+	}
+	overlay := dataconv.NewNamedSharedDict(memoryTypeName)
+	s.globals[name] = &cowMemory{SharedDict: overlay, base: base, removed: make(map[string]struct{})}
+	return overlay
+}
+
+// MemoryEntries returns a snapshot of the contents of the given shared dictionary, with each value converted into a Go value.
+// The snapshot is taken with the lock of the shared dictionary held, and non-string keys are converted into their string representations.
+func MemoryEntries(m *dataconv.SharedDict) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, errors.New("nil memory")
+	}
+	d, err := m.CloneDict()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]interface{}, d.Len())
+	for _, item := range d.Items() {
+		v, err := dataconv.Unmarshal(item[1])
+		if err != nil {
+			return nil, fmt.Errorf("convert memory entry %s: %w", item[0], err)
+		}
+		entries[dataconv.StarString(item[0])] = v
+	}
+	return entries, nil
+}
+
+// MergeMemory copies all the entries of src into dst as the Starlark values without conversion, and the existing keys of dst are overwritten only if overwrite is true.
+// The entries of src are copied from a snapshot taken with its lock held, and the entries are written with the lock of dst held, all at once if overwrite is true, or the check and the write of each key together otherwise, so it's safe to call it while scripts are using either of them.
+// It returns an error if either of them is nil, or dst is frozen.
+func MergeMemory(dst, src *dataconv.SharedDict, overwrite bool) error {
+	if dst == nil || src == nil {
+		return errors.New("nil memory")
+	}
+	if dst == src {
+		return nil
+	}
+	d, err := src.CloneDict()
+	if err != nil {
+		return err
+	}
+	if overwrite {
+		return callMemoryMethod(dst, "update", d)
+	}
+	for _, item := range d.Items() {
+		if err := callMemoryMethod(dst, "setdefault", item[0], item[1]); err != nil {
+			return fmt.Errorf("merge memory entry %s: %w", item[0], err)
+		}
+	}
+	return nil
+}
+
+// callMemoryMethod calls the method of the dict with the given arguments, it's done with the lock of the memory held.
+func callMemoryMethod(m *dataconv.SharedDict, name string, args ...starlark.Value) error {
+	fn, err := m.Attr(name)
+	if err != nil {
+		return err
+	} else if fn == nil {
+		return fmt.Errorf("memory has no method %s", name)
+	}
+	_, err = starlark.Call(&starlark.Thread{Name: "memory"}, fn, args, nil)
+	return err
+}
+
+// ExportMemory returns a snapshot of the entries of the given shared dictionary as the Starlark values without conversion, which is suitable for AddStarlarkValues() of another box.
+// Unlike AttachMemory(), the entries become separate globals and later changes of the memory are not reflected. The nested values are shared by reference to avoid deep copies, so the in-place changes of them are visible from both sides.
+// It returns an error if the memory is nil or has non-string keys.
+func ExportMemory(m *dataconv.SharedDict) (starlark.StringDict, error) {
+	if m == nil {
+		return nil, errors.New("nil memory")
+	}
+	d, err := m.CloneDict()
+	if err != nil {
+		return nil, err
+	}
+	values := make(starlark.StringDict, d.Len())
+	for _, item := range d.Items() {
+		k, ok := item[0].(starlark.String)
+		if !ok {
+			return nil, fmt.Errorf("export memory entry %s: key is %s, not string", item[0], item[0].Type())
+		}
+		values[string(k)] = item[1]
+	}
+	return values, nil
+}
+
+// MemoryChangeFunc is the function to be notified of a write to the collective memory, oldVal is nil if the key is new.
+type MemoryChangeFunc func(key string, oldVal, newVal starlark.Value)
+
+// Memory wraps a shared dictionary for la mémoire collective, and notifies the registered functions of each item assignment like m[key] = value performed by scripts.
+// The writes via methods like update() or setdefault() go to the shared dictionary directly, so they're not notified.
+type Memory struct {
+	*dataconv.SharedDict
+	mu    sync.Mutex
+	hooks []MemoryChangeFunc
+}
+
+// WrapMemory wraps the given shared dictionary as a Memory, a nil dictionary gives a new empty memory.
+// To make scripts use it, add it as a Starlark value by AddKeyStarlarkValue() or use CreateObservedMemory() instead.
+func WrapMemory(m *dataconv.SharedDict) *Memory {
+	if m == nil {
+		m = dataconv.NewNamedSharedDict(memoryTypeName)
+	}
+	return &Memory{SharedDict: m}
+}
+
+// CreateObservedMemory creates a new Memory with the given name, and adds it to the global environment before execution.
+func (s *Starbox) CreateObservedMemory(name string) *Memory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("add memory") {
+		return nil
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot add memory after execution")
+	}
+	s.markChanged()
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap)
+	}
+	memory := WrapMemory(nil)
+	s.globals[name] = memory
+	return memory
+}
+
+// OnChange registers the function to be called after each write of the memory has been committed, with the string representation of the key, and the previous and new values.
+// The functions are called in the order of registration on the goroutine of the writing script and without any lock held, so they can read or even write the same memory.
+func (m *Memory) OnChange(fn func(key string, oldVal, newVal starlark.Value)) {
+	if fn == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hooks = append(m.hooks, fn)
+}
+
+// hookCount returns the number of the registered functions.
+func (m *Memory) hookCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.hooks)
+}
+
+// SetKey sets the value for the given key, and notifies the registered functions after the write.
+func (m *Memory) SetKey(k, v starlark.Value) error {
+	// the old value and the write are paired under the lock, so concurrent writers see consistent changes
+	m.mu.Lock()
+	old, found, err := m.SharedDict.Get(k)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	if err := m.SharedDict.SetKey(k, v); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	hooks := m.hooks
+	m.mu.Unlock()
+
+	if !found {
+		old = nil
+	}
+	key := dataconv.StarString(k)
+	for _, fn := range hooks {
+		fn(key, old, v)
+	}
+	return nil
+}
+
+// Attr returns the method of the memory, and get() accepts the default value as a keyword argument, e.g. share.get("count", default=0), and the lookup is performed with the lock held.
+func (m *Memory) Attr(name string) (starlark.Value, error) {
+	if name == memoryGetName {
+		return memoryGetter(m.SharedDict), nil
+	}
+	return m.SharedDict.Attr(name)
+}
+
+// CompareSameType compares the memory with another memory or shared dictionary by their underlying contents.
+func (m *Memory) CompareSameType(op syntax.Token, yv starlark.Value, depth int) (bool, error) {
+	switch y := yv.(type) {
+	case *Memory:
+		yv = y.SharedDict
+	case *ttlMemory:
+		y.prune()
+		yv = y.SharedDict
+	case *cowMemory:
+		yv = y.merged()
+	}
+	return m.SharedDict.CompareSameType(op, yv, depth)
+}
+
+// ttlMemory wraps a shared dictionary to expire the entries older than the ttl for scripts, the timestamps are kept by the string representations of the keys.
+type ttlMemory struct {
+	*dataconv.SharedDict
+	ttl    time.Duration
+	mu     sync.Mutex
+	stamps map[string]time.Time
+}
+
+// String returns the string representation of the memory without expired entries.
+func (m *ttlMemory) String() string {
+	m.prune()
+	return m.SharedDict.String()
+}
+
+// Truth returns the truth value of the memory without expired entries.
+func (m *ttlMemory) Truth() starlark.Bool {
+	m.prune()
+	return m.SharedDict.Truth()
+}
+
+// Get returns the value for the given key, and the expired entry is removed and treated as absent.
+func (m *ttlMemory) Get(k starlark.Value) (starlark.Value, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := k.String()
+	if ts, ok := m.stamps[key]; ok && time.Since(ts) >= m.ttl {
+		if err := m.remove(k); err != nil {
+			return nil, false, err
+		}
+	}
+	v, found, err := m.SharedDict.Get(k)
+	if found {
+		if _, ok := m.stamps[key]; !ok {
+			m.stamps[key] = time.Now()
+		}
+	}
+	return v, found, err
+}
+
+// SetKey sets the value for the given key, and refreshes its timestamp.
+func (m *ttlMemory) SetKey(k, v starlark.Value) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.SharedDict.SetKey(k, v); err != nil {
+		return err
+	}
+	m.stamps[k.String()] = time.Now()
+	return nil
+}
+
+// Attr returns the method of the memory after pruning the expired entries, so methods like get() or keys() skip them.
+func (m *ttlMemory) Attr(name string) (starlark.Value, error) {
+	m.prune()
+	if name == memoryGetName {
+		return memoryGetter(m), nil
+	}
+	return m.SharedDict.Attr(name)
+}
+
+// CompareSameType compares the memory with another memory or shared dictionary by their underlying contents.
+func (m *ttlMemory) CompareSameType(op syntax.Token, yv starlark.Value, depth int) (bool, error) {
+	m.prune()
+	switch y := yv.(type) {
+	case *ttlMemory:
+		y.prune()
+		yv = y.SharedDict
+	case *Memory:
+		yv = y.SharedDict
+	case *cowMemory:
+		yv = y.merged()
+	}
+	return m.SharedDict.CompareSameType(op, yv, depth)
+}
+
+// prune removes all the expired entries, and starts timing the entries without timestamps.
+func (m *ttlMemory) prune() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.SharedDict.CloneDict()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	live := make(map[string]struct{}, d.Len())
+	for _, k := range d.Keys() {
+		key := k.String()
+		ts, ok := m.stamps[key]
+		if !ok {
+			m.stamps[key] = now
+		} else if now.Sub(ts) >= m.ttl {
+			_ = m.remove(k)
+			continue
+		}
+		live[key] = struct{}{}
+	}
+	for key := range m.stamps {
+		if _, ok := live[key]; !ok {
+			delete(m.stamps, key)
+		}
+	}
+}
+
+// remove deletes the given key from the underlying dictionary and its timestamp, it must be called with the lock held.
+func (m *ttlMemory) remove(k starlark.Value) error {
+	delete(m.stamps, k.String())
+	pop, err := m.SharedDict.Attr("pop")
+	if err != nil {
+		return err
+	}
+	_, err = starlark.Call(&starlark.Thread{Name: "memory"}, pop, starlark.Tuple{k, starlark.None}, nil)
+	return err
+}
+
+// cowMemory wraps an overlay shared dictionary to read through to a base one for copy-on-write, the keys removed from the overlay are kept by their string representations to hide them in base.
+type cowMemory struct {
+	*dataconv.SharedDict
+	base    *dataconv.SharedDict
+	mu      sync.Mutex
+	removed map[string]struct{}
+}
+
+// String returns the string representation of the merged entries of the overlay and base.
+func (m *cowMemory) String() string {
+	return m.merged().String()
+}
+
+// Truth returns the truth value of the merged entries of the overlay and base.
+func (m *cowMemory) Truth() starlark.Bool {
+	return m.merged().Truth()
+}
+
+// Get returns the value for the given key from the overlay, or from base if it's not in the overlay, and the mutable value of base is copied into the overlay.
+func (m *cowMemory) Get(k starlark.Value) (starlark.Value, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, found, err := m.SharedDict.Get(k)
+	if found || err != nil {
+		return v, found, err
+	}
+	if _, ok := m.removed[k.String()]; ok || m.base == nil {
+		return nil, false, nil
+	}
+	if v, found, err = m.base.Get(k); !found || err != nil {
+		return v, found, err
+	}
+	if cp, copied := copyStarlarkValue(v); copied {
+		if err := m.SharedDict.SetKey(k, cp); err != nil {
+			return nil, false, err
+		}
+		return cp, true, nil
+	}
+	return v, true, nil
+}
+
+// SetKey sets the value for the given key in the overlay.
+func (m *cowMemory) SetKey(k, v starlark.Value) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.SharedDict.SetKey(k, v); err != nil {
+		return err
+	}
+	delete(m.removed, k.String())
+	return nil
+}
+
+// Attr returns the method of the memory, and the methods other than get() work on the overlay after copying the remaining entries of base into it.
+func (m *cowMemory) Attr(name string) (starlark.Value, error) {
+	if name == memoryGetName {
+		return memoryGetter(m), nil
+	}
+	attr, err := m.SharedDict.Attr(name)
+	if attr == nil || err != nil {
+		return attr, err
+	}
+	return starlark.NewBuiltin(name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		keys, err := m.copyUp()
+		if err != nil {
+			return nil, err
+		}
+		res, err := starlark.Call(thread, attr, args, kwargs)
+
+		// hide the keys of base removed from the overlay by the method, e.g. pop() or clear()
+		for _, k := range keys {
+			if _, found, _ := m.SharedDict.Get(k); !found {
+				m.removed[k.String()] = struct{}{}
+			}
+		}
+		return res, err
+	}), nil
+}
+
+// CompareSameType compares the merged entries of the memory with another memory or shared dictionary.
+func (m *cowMemory) CompareSameType(op syntax.Token, yv starlark.Value, depth int) (bool, error) {
+	switch y := yv.(type) {
+	case *cowMemory:
+		yv = y.merged()
+	case *Memory:
+		yv = y.SharedDict
+	case *ttlMemory:
+		y.prune()
+		yv = y.SharedDict
+	}
+	return m.merged().CompareSameType(op, yv, depth)
+}
+
+// copyUp copies the entries of base which are neither in the overlay nor removed into the overlay, and returns the keys of base, it must be called with the lock held.
+func (m *cowMemory) copyUp() ([]starlark.Value, error) {
+	if m.base == nil {
+		return nil, nil
+	}
+	d, err := m.base.CloneDict()
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range d.Items() {
+		k, v := item[0], item[1]
+		if _, ok := m.removed[k.String()]; ok {
+			continue
+		}
+		if _, found, err := m.SharedDict.Get(k); found || err != nil {
+			continue
+		}
+		cp, _ := copyStarlarkValue(v)
+		if err := m.SharedDict.SetKey(k, cp); err != nil {
+			return nil, err
+		}
+	}
+	return d.Keys(), nil
+}
+
+// merged returns a snapshot of the entries of the overlay and the ones of base which are neither in the overlay nor removed, the values of base are deep-copied.
+func (m *cowMemory) merged() *dataconv.SharedDict {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.SharedDict.CloneDict()
+	if err != nil {
+		d = starlark.NewDict(0)
+	}
+	if m.base != nil {
+		if bd, err := m.base.CloneDict(); err == nil {
+			for _, item := range bd.Items() {
+				k := item[0]
+				if _, ok := m.removed[k.String()]; ok {
+					continue
+				}
+				if _, found, _ := d.Get(k); !found {
+					cp, _ := copyStarlarkValue(item[1])
+					_ = d.SetKey(k, cp)
+				}
+			}
+		}
+	}
+	sd := dataconv.NewSharedDictFromDict(d)
+	sd.SetTypeName(m.SharedDict.Type())
+	return sd
+}
+
+// copyStarlarkValue returns a deep copy of the given value if it's or contains a mutable container, i.e. list, dict or set, and whether it's copied.
+// The values of other types are returned as is.
+func copyStarlarkValue(v starlark.Value) (starlark.Value, bool) {
+	switch x := v.(type) {
+	case *starlark.List:
+		elems := make([]starlark.Value, x.Len())
+		for i := range elems {
+			elems[i], _ = copyStarlarkValue(x.Index(i))
+		}
+		return starlark.NewList(elems), true
+	case starlark.Tuple:
+		var (
+			elems  = make(starlark.Tuple, len(x))
+			copied bool
+		)
+		for i, e := range x {
+			var c bool
+			elems[i], c = copyStarlarkValue(e)
+			copied = copied || c
+		}
+		if !copied {
+			return x, false
+		}
+		return elems, true
+	case *starlark.Dict:
+		d := starlark.NewDict(x.Len())
+		for _, item := range x.Items() {
+			cp, _ := copyStarlarkValue(item[1])
+			_ = d.SetKey(item[0], cp)
+		}
+		return d, true
+	case *starlark.Set:
+		st := starlark.NewSet(x.Len())
+		iter := x.Iterate()
+		defer iter.Done()
+		var e starlark.Value
+		for iter.Next(&e) {
+			_ = st.Insert(e)
+		}
+		return st, true
+	default:
+		return v, false
+	}
+}
+
+// memoryGetName is the name of the method to read a memory with a default value.
+const memoryGetName = "get"
+
+// memoryGetter returns the get(key, default=None) method for the given memory, which returns the default value if the key is missing.
+func memoryGetter(m starlark.Mapping) *starlark.Builtin {
+	return starlark.NewBuiltin(memoryGetName, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var (
+			key starlark.Value
+			dft starlark.Value = starlark.None
+		)
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "key", &key, "default?", &dft); err != nil {
+			return nil, err
+		}
+		v, found, err := m.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return dft, nil
+		}
+		return v, nil
+	})
+}
+
+// MergePolicy defines how MergeResults() resolves the keys present in both of the results.
+type MergePolicy uint8
+
+const (
+	// OverlayWins keeps the values of the overlay for the conflicting keys, like StringAnyMap.Merge(), it's the default policy.
+	OverlayWins MergePolicy = iota
+	// BaseWins keeps the values of the base for the conflicting keys.
+	BaseWins
+	// ErrorOnConflict fails the merge with ErrMergeConflict on any conflicting key.
+	ErrorOnConflict
+)
+
+var (
+	// ErrMergeConflict is the error for MergeResults() with ErrorOnConflict when both of the results have the same key with different values.
+	ErrMergeConflict = errors.New("merge results conflict")
+)
+
+// MergeResults returns a new map with all the entries of base and overlay, e.g. to compose the output of one box with the extras for another, and neither of them is changed.
+// A key present in both with deeply equal values is not considered a conflict, and the other conflicting keys are resolved by the given policy.
+// It returns an error wrapping ErrMergeConflict with the sorted conflicting keys for ErrorOnConflict, or for an unknown policy.
+func MergeResults(base, overlay starlet.StringAnyMap, policy MergePolicy) (starlet.StringAnyMap, error) {
+	if policy > ErrorOnConflict {
+		return nil, fmt.Errorf("unknown merge policy: %d", policy)
+	}
+	res := make(starlet.StringAnyMap, len(base)+len(overlay))
+	for k, v := range base {
+		res[k] = v
+	}
+	var conflicts []string
+	for k, v := range overlay {
+		if bv, ok := base[k]; ok && !reflect.DeepEqual(bv, v) {
+			switch policy {
+			case BaseWins:
+				continue
+			case ErrorOnConflict:
+				conflicts = append(conflicts, k)
+				continue
+			}
+		}
+		res[k] = v
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, fmt.Errorf("%w: %s", ErrMergeConflict, strings.Join(conflicts, ", "))
+	}
+	return res, nil
+}
+
 var (
 	// HereDoc returns unindented string as here-document.
 	HereDoc = here.Doc
@@ -174,3 +865,18 @@ func starlarkStringList(ss []string) *starlark.List {
 	}
 	return starlark.NewList(values)
 }
+
+// moduleNamesList returns a new list of the given module names for __modules__, the values of the names are kept by the box and reused for the same names, so the following environments skip converting them.
+func (s *Starbox) moduleNamesList(names []string) *starlark.List {
+	same := len(s.modValues) == len(names)
+	for i := 0; same && i < len(names); i++ {
+		same = s.modValues[i].(starlark.String) == starlark.String(names[i])
+	}
+	if !same {
+		s.modValues = make([]starlark.Value, len(names))
+		for i, n := range names {
+			s.modValues[i] = starlark.String(n)
+		}
+	}
+	return starlark.NewList(append([]starlark.Value(nil), s.modValues...))
+}
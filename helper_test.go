@@ -1,10 +1,15 @@
 package starbox
 
 import (
+	"errors"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/1set/starlet"
+	"github.com/1set/starlet/dataconv"
 	"go.starlark.net/starlark"
 )
 
@@ -96,6 +101,588 @@ func TestCollectiveMemory(t *testing.T) {
 	}
 }
 
+// TestMemoryEntries tests the following:
+// 1. Create a new Starbox instance with a collective memory.
+// 2. Run script that populates the collective memory.
+// 3. Check the snapshot of the collective memory contains all the converted entries.
+func TestMemoryEntries(t *testing.T) {
+	if _, err := MemoryEntries(nil); err == nil {
+		t.Errorf("expect error for nil memory, got nil")
+	}
+
+	b := New("test")
+	mem := b.CreateMemory("share")
+	if es, err := MemoryEntries(mem); err != nil || len(es) != 0 {
+		t.Errorf("expect empty entries, got %v, %v", es, err)
+		return
+	}
+	_, err := b.Run(HereDoc(`
+		share["a"] = 1
+		share["b"] = "two"
+		share["c"] = [3, 4.5]
+		share["d"] = {"e": True}
+		share[6] = None
+	`))
+	if err != nil {
+		t.Errorf("expect nil error, got %v", err)
+		return
+	}
+
+	entries, err := MemoryEntries(mem)
+	if err != nil {
+		t.Errorf("expect nil error, got %v", err)
+		return
+	}
+	expected := map[string]interface{}{
+		"a": 1,
+		"b": "two",
+		"c": []interface{}{3, 4.5},
+		"d": map[string]interface{}{"e": true},
+		"6": nil,
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expect %v, got %v", expected, entries)
+	}
+}
+
+// TestAttachMemoryCOW tests the following:
+// 1. Create a base collective memory with entries.
+// 2. Attach copy-on-write views of the base to two boxes, and run scripts that read and write the memory.
+// 3. Check the writes land only in the overlays, and the base is unchanged.
+func TestAttachMemoryCOW(t *testing.T) {
+	base := NewMemory()
+	if err := base.SetKey(starlark.String("count"), starlark.MakeInt(1)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+
+	script := HereDoc(`
+		mem["count"] = mem["count"] + delta
+		mem["seen"] = delta
+		res = mem["count"]
+	`)
+	var overlays []*dataconv.SharedDict
+	for _, delta := range []int{10, 20} {
+		b := New("test")
+		overlay := b.AttachMemoryCOW("mem", base)
+		b.AddKeyValue("delta", delta)
+		out, err := b.Run(script)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if es := int64(1 + delta); out["res"] != es {
+			t.Errorf("expect %d, got %v", es, out["res"])
+		}
+		overlays = append(overlays, overlay)
+	}
+
+	// check the overlays and base
+	for i, delta := range []int{10, 20} {
+		entries, err := MemoryEntries(overlays[i])
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if es := map[string]interface{}{"count": 1 + delta, "seen": delta}; !reflect.DeepEqual(entries, es) {
+			t.Errorf("expect %v, got %v", es, entries)
+		}
+	}
+	entries, err := MemoryEntries(base)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := map[string]interface{}{"count": 1}; !reflect.DeepEqual(entries, es) {
+		t.Errorf("expect base unchanged %v, got %v", es, entries)
+	}
+	if ov := overlays[0]; ov.Type() != memoryTypeName {
+		t.Errorf("expect type %q, got %q", memoryTypeName, ov.Type())
+	}
+
+	// nil base
+	b := New("test")
+	overlay := b.AttachMemoryCOW("mem", nil)
+	if _, err := b.Run(`mem["a"] = 1`); err != nil || overlay.Len() != 1 {
+		t.Errorf("expect overlay with one entry, got %v, %v", overlay, err)
+	}
+}
+
+// TestAttachMemoryCOW_Overlay tests the following:
+// 1. Attach a copy-on-write view of a base memory with nested values.
+// 2. Mutate the nested values in place, and check base is unchanged.
+// 3. Change base after attaching, and check the changes are visible for the keys not written by the box.
+// 4. Remove the keys of base by methods, and check they are hidden from the box but kept in base.
+func TestAttachMemoryCOW_Overlay(t *testing.T) {
+	base := NewMemory()
+	one := func() *starlark.List { return starlark.NewList([]starlark.Value{starlark.MakeInt(1)}) }
+	d := starlark.NewDict(1)
+	_ = d.SetKey(starlark.String("k"), one())
+	for k, v := range map[string]starlark.Value{"l": one(), "d": d, "t": starlark.Tuple{starlark.MakeInt(1), one()}} {
+		if err := base.SetKey(starlark.String(k), v); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+	}
+	_ = base.SetKey(starlark.String("n"), starlark.MakeInt(1))
+	_ = base.SetKey(starlark.String("gone"), starlark.MakeInt(0))
+
+	b := New("test")
+	overlay := b.AttachMemoryCOW("mem", base)
+	_ = base.SetKey(starlark.String("n"), starlark.MakeInt(2))
+	_ = base.SetKey(starlark.String("late"), starlark.String("new"))
+	out, err := b.Run(HereDoc(`
+		mem["l"].append(2)
+		mem["d"]["k"].append(2)
+		mem["t"][1].append(2)
+		res = [mem["l"], mem["d"]["k"], mem["t"][1], mem["n"], mem.get("late")]
+		popped = mem.pop("gone")
+		has_gone = "gone" in mem.keys()
+		gone = mem.get("gone", -1)
+		eq = mem == mem
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	es := []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(1), int64(2)}, []interface{}{int64(1), int64(2)}, int64(2), "new"}
+	if !reflect.DeepEqual(out["res"], es) {
+		t.Errorf("expect %v, got %v", es, out["res"])
+	}
+	if out["popped"] != int64(0) || out["has_gone"] != false || out["gone"] != int64(-1) || out["eq"] != true {
+		t.Errorf("unexpected output: %v", out)
+	}
+
+	// base is unchanged
+	entries, err := MemoryEntries(base)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	eb := map[string]interface{}{
+		"l":    []interface{}{1},
+		"d":    map[string]interface{}{"k": []interface{}{1}},
+		"t":    []interface{}{1, []interface{}{1}},
+		"n":    2,
+		"gone": 0,
+		"late": "new",
+	}
+	if !reflect.DeepEqual(entries, eb) {
+		t.Errorf("expect base unchanged %v, got %v", eb, entries)
+	}
+	if _, found, _ := overlay.Get(starlark.String("gone")); found {
+		t.Errorf("expect popped key not in overlay")
+	}
+}
+
+// TestMergeMemory tests the following:
+// 1. Create two collective memories with overlapping keys.
+// 2. Merge them with and without overwriting, and check the entries.
+// 3. Check the errors of nil and frozen memories.
+func TestMergeMemory(t *testing.T) {
+	newMem := func(script string) *dataconv.SharedDict {
+		b := New("test")
+		mem := b.CreateMemory("mem")
+		if _, err := b.Run(script); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		return mem
+	}
+	tests := []struct {
+		overwrite bool
+		want      map[string]interface{}
+	}{
+		{false, map[string]interface{}{"a": 1, "b": "dst", "c": []interface{}{3}}},
+		{true, map[string]interface{}{"a": 1, "b": "src", "c": []interface{}{3}}},
+	}
+	for _, tt := range tests {
+		dst := newMem(`mem["a"] = 1; mem["b"] = "dst"`)
+		src := newMem(`mem["b"] = "src"; mem["c"] = [3]`)
+		if err := MergeMemory(dst, src, tt.overwrite); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		entries, err := MemoryEntries(dst)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		if !reflect.DeepEqual(entries, tt.want) {
+			t.Errorf("overwrite=%v: expect %v, got %v", tt.overwrite, tt.want, entries)
+		}
+		if src.Len() != 2 {
+			t.Errorf("expect src unchanged, got %v", src)
+		}
+		// the values are copied as-is
+		v1, _, _ := dst.Get(starlark.String("c"))
+		v2, _, _ := src.Get(starlark.String("c"))
+		if v1 != v2 {
+			t.Errorf("expect the same Starlark value, got %v and %v", v1, v2)
+		}
+	}
+
+	// errors
+	mem := NewMemory()
+	if err := MergeMemory(nil, mem, true); err == nil {
+		t.Errorf("expect error for nil memory, got nil")
+	}
+	if err := MergeMemory(mem, mem, true); err != nil {
+		t.Errorf("expect nil error for self merge, got %v", err)
+	}
+	frozen := NewMemory()
+	frozen.Freeze()
+	if err := MergeMemory(frozen, newMem(`mem["a"] = 1`), true); err == nil {
+		t.Errorf("expect error for frozen memory, got nil")
+	}
+}
+
+// TestExportMemory tests the following:
+// 1. Export a memory written by a script, and add the values to another box as globals.
+// 2. Check the values are read as globals, and the nested values are shared by reference.
+// 3. Check the errors for nil memory and non-string keys.
+func TestExportMemory(t *testing.T) {
+	if _, err := ExportMemory(nil); err == nil {
+		t.Errorf("expect error for nil memory, got nil")
+	}
+
+	b1 := New("test1")
+	mem := b1.CreateMemory("mem")
+	if _, err := b1.Run(`mem["a"] = 1; mem["l"] = [1, 2]`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	values, err := ExportMemory(mem)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if len(values) != 2 {
+		t.Errorf("expect 2 values, got %v", values)
+	}
+	if v, _, _ := mem.Get(starlark.String("l")); v != values["l"] {
+		t.Errorf("expect nested value shared by reference, got %v", values["l"])
+	}
+
+	b2 := New("test2")
+	b2.AddStarlarkValues(values)
+	out, err := b2.Run(`s = a + l[0] + l[1]`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if out["s"] != int64(4) {
+		t.Errorf("expect s=4, got %v", out["s"])
+	}
+	if err := mem.SetKey(starlark.String("a"), starlark.MakeInt(100)); err != nil || values["a"] != starlark.MakeInt(1) {
+		t.Errorf("expect snapshot unchanged, got %v, %v", values["a"], err)
+	}
+
+	if err := mem.SetKey(starlark.MakeInt(1), starlark.None); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if _, err := ExportMemory(mem); err == nil {
+		t.Errorf("expect error for non-string key, got nil")
+	}
+}
+
+// TestMemoryOnChange tests the following:
+// 1. Create an observed memory and register change functions.
+// 2. Run a script that writes the memory, including new and existing keys.
+// 3. Check the notifications, and the function reading the same memory doesn't deadlock.
+func TestMemoryOnChange(t *testing.T) {
+	type change struct {
+		key      string
+		old, new string
+	}
+	var changes []change
+	str := func(v starlark.Value) string {
+		if v == nil {
+			return "<nil>"
+		}
+		return v.String()
+	}
+
+	b := New("test")
+	mem := b.CreateObservedMemory("mem")
+	mem.OnChange(nil)
+	mem.OnChange(func(key string, oldVal, newVal starlark.Value) {
+		// the write is committed and the memory is readable without deadlock
+		if v, found, err := mem.Get(starlark.String(key)); key != "3" && (err != nil || !found || v != newVal) {
+			t.Errorf("expect committed value %v for %s, got %v, %v, %v", newVal, key, v, found, err)
+		}
+		changes = append(changes, change{key, str(oldVal), str(newVal)})
+	})
+	out, err := b.Run(HereDoc(`
+		mem["a"] = 1
+		mem["a"] = 2
+		mem[3] = "c"
+		x = mem["a"] + mem.len()
+		y = mem == mem
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if x := out["x"]; x != int64(4) {
+		t.Errorf("expect x=4, got %v", x)
+	}
+	if y := out["y"]; y != true {
+		t.Errorf("expect y=true, got %v", y)
+	}
+	ec := []change{
+		{"a", "<nil>", "1"},
+		{"a", "1", "2"},
+		{"3", "<nil>", `"c"`},
+	}
+	if !reflect.DeepEqual(changes, ec) {
+		t.Errorf("expect changes %v, got %v", ec, changes)
+	}
+
+	// wrap an existing memory and write from Go
+	sd := NewMemory()
+	wm := WrapMemory(sd)
+	var n int
+	wm.OnChange(func(key string, oldVal, newVal starlark.Value) { n++ })
+	if err := wm.SetKey(starlark.String("k"), starlark.True); err != nil || n != 1 {
+		t.Errorf("expect one change, got %d, %v", n, err)
+	}
+	if v, found, _ := sd.Get(starlark.String("k")); !found || v != starlark.True {
+		t.Errorf("expect the underlying memory updated, got %v", v)
+	}
+	sd.Freeze()
+	if err := wm.SetKey(starlark.String("k"), starlark.False); err == nil || n != 1 {
+		t.Errorf("expect error without change for frozen memory, got %d, %v", n, err)
+	}
+	if WrapMemory(nil).Len() != 0 {
+		t.Errorf("expect empty memory for nil")
+	}
+}
+
+// TestGetMemory tests the following:
+// 1. Add memories and other globals to a box.
+// 2. Get the memories back by name before and after runs.
+// 3. Check the missing names and non-memory globals are rejected.
+func TestGetMemory(t *testing.T) {
+	b := New("test")
+	mem := b.CreateMemory("share")
+	other := NewMemory()
+	b.AttachMemory("history", other)
+	om := b.CreateObservedMemory("observed")
+	b.AddKeyValue("num", 1)
+
+	check := func(name string, expect *dataconv.SharedDict) {
+		got, ok := b.GetMemory(name)
+		if expect == nil {
+			if ok || got != nil {
+				t.Errorf("%s: expect no memory, got %v, %v", name, got, ok)
+			}
+			return
+		}
+		if !ok || got != expect {
+			t.Errorf("%s: expect memory %p, got %p, %v", name, expect, got, ok)
+		}
+	}
+	check("share", mem)
+	check("history", other)
+	check("observed", om.SharedDict)
+	check("num", nil)
+	check("missing", nil)
+
+	if _, err := b.Run(`share["a"] = 1; history["b"] = 2`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	check("share", mem)
+	if got, _ := b.GetMemory("history"); got.Len() != 1 {
+		t.Errorf("expect history memory updated, got %v", got)
+	}
+}
+
+// TestListMemories tests the following:
+// 1. Attach memories of different kinds with other globals.
+// 2. Check the sorted names of memories before and after execution.
+func TestListMemories(t *testing.T) {
+	b := New("test")
+	if names := b.ListMemories(); names == nil || len(names) != 0 {
+		t.Errorf("expect empty names, got %v", names)
+	}
+	b.CreateMemory("share")
+	b.AttachMemory("history", NewMemory())
+	b.CreateObservedMemory("observed")
+	b.CreateMemoryWithTTL("cache", time.Minute)
+	b.AddKeyValue("num", 1)
+
+	expect := []string{"cache", "history", "observed", "share"}
+	if names := b.ListMemories(); !reflect.DeepEqual(names, expect) {
+		t.Errorf("expect %v before execution, got %v", expect, names)
+	}
+	if _, err := b.Run(`share["a"] = cache.get("x", 1)`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if names := b.ListMemories(); !reflect.DeepEqual(names, expect) {
+		t.Errorf("expect %v after execution, got %v", expect, names)
+	}
+}
+
+// TestMemorySizes tests the following:
+// 1. Attach memories with other globals, and check the sizes are zero before execution.
+// 2. Write entries in scripts, and check the sizes after execution.
+func TestMemorySizes(t *testing.T) {
+	b := New("test")
+	if sizes := b.MemorySizes(); sizes == nil || len(sizes) != 0 {
+		t.Errorf("expect empty sizes, got %v", sizes)
+	}
+	b.CreateMemory("share")
+	b.AttachMemory("history", NewMemory())
+	b.CreateMemoryWithTTL("cache", time.Minute)
+	b.AddKeyValue("num", 1)
+
+	if es := map[string]int{"share": 0, "history": 0, "cache": 0}; !reflect.DeepEqual(b.MemorySizes(), es) {
+		t.Errorf("expect %v before execution, got %v", es, b.MemorySizes())
+	}
+	if _, err := b.Run(`share["a"] = 1; share["b"] = 2; cache["x"] = 3`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := map[string]int{"share": 2, "history": 0, "cache": 1}; !reflect.DeepEqual(b.MemorySizes(), es) {
+		t.Errorf("expect %v after execution, got %v", es, b.MemorySizes())
+	}
+}
+
+// TestCreateMemoryWithTTL tests the following:
+// 1. Create a memory with TTL and write entries in scripts.
+// 2. Check the entries are readable before expiry, and absent after expiry.
+// 3. Check setting a key refreshes its timestamp, and the expired entries are pruned from the returned dictionary.
+func TestCreateMemoryWithTTL(t *testing.T) {
+	ttl := 200 * time.Millisecond
+	b := New("test")
+	mem := b.CreateMemoryWithTTL("cache", ttl)
+	if got, ok := b.GetMemory("cache"); !ok || got != mem {
+		t.Errorf("expect memory by name, got %v, %v", got, ok)
+	}
+	out, err := b.Run(HereDoc(`
+		cache["a"] = 1
+		cache[2] = "b"
+		x = [cache["a"], cache.get(2), len(cache.keys()), "a" in cache]
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{int64(1), "b", int64(2), true}; !reflect.DeepEqual(out["x"], es) {
+		t.Errorf("expect %v, got %v", es, out["x"])
+	}
+
+	// refresh one key and wait for the other one to expire
+	time.Sleep(ttl / 2)
+	if _, err := b.Run(`cache["a"] = 10`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	time.Sleep(ttl/2 + ttl/4)
+	out, err = b.Run(HereDoc(`
+		y = [cache.get("a"), cache.get(2), 2 in cache, cache.len(), bool(cache)]
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{int64(10), nil, false, int64(1), true}; !reflect.DeepEqual(out["y"], es) {
+		t.Errorf("expect %v, got %v", es, out["y"])
+	}
+	if mem.Len() != 1 {
+		t.Errorf("expect expired entries pruned, got %v", mem)
+	}
+
+	// all expired
+	time.Sleep(ttl)
+	if _, err := b.Run(`z = cache["a"]`); err == nil {
+		t.Errorf("expect error for expired key, got nil")
+	}
+	if mem.Len() != 0 {
+		t.Errorf("expect all entries pruned, got %v", mem)
+	}
+
+	// no expiry
+	b = New("test")
+	mem = b.CreateMemoryWithTTL("cache", 0)
+	if _, err := b.Run(`cache["a"] = 1`); err != nil || mem.Len() != 1 {
+		t.Errorf("expect entry kept without ttl, got %v, %v", mem, err)
+	}
+}
+
+// TestMemoryGetDefault tests the following:
+// 1. Create memories of different kinds, and run a script reading missing and existing keys with get().
+// 2. Check the default values are returned for missing keys, and None if no default is given.
+// 3. Check the plain memory is attached as is, and its get() takes the positional default.
+func TestMemoryGetDefault(t *testing.T) {
+	b := New("test")
+	plain := b.CreateMemory("plain")
+	b.CreateObservedMemory("observed")
+	b.CreateMemoryWithTTL("cache", time.Minute)
+	out, err := b.Run(HereDoc(`
+		res = []
+		for m in [observed, cache]:
+			m["a"] = 1
+			res.append([m.get("a"), m.get("a", 2), m.get("b"), m.get("b", 3), m.get("b", default=4)])
+		plain["a"] = 1
+		res.append([plain.get("a"), plain.get("a", 2), plain.get("b"), plain.get("b", 3), 4])
+		p = plain
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	row := []interface{}{int64(1), int64(1), nil, int64(3), int64(4)}
+	if es := []interface{}{row, row, row}; !reflect.DeepEqual(out["res"], es) {
+		t.Errorf("expect %v, got %v", es, out["res"])
+	}
+	if v, ok := b.GetStarlarkResult("p"); !ok || v != starlark.Value(plain) {
+		t.Errorf("expect the plain memory attached as is, got %T", v)
+	}
+}
+
+// TestMergeResults tests the following:
+// 1. Merge two results with overlapping keys by each policy.
+// 2. Check the merged results, the conflicts and the inputs are unchanged.
+func TestMergeResults(t *testing.T) {
+	base := starlet.StringAnyMap{"a": int64(1), "b": "base", "c": []interface{}{int64(1)}}
+	overlay := starlet.StringAnyMap{"b": "overlay", "c": []interface{}{int64(1)}, "d": true}
+	tests := []struct {
+		policy  MergePolicy
+		want    starlet.StringAnyMap
+		wantErr bool
+	}{
+		{OverlayWins, starlet.StringAnyMap{"a": int64(1), "b": "overlay", "c": []interface{}{int64(1)}, "d": true}, false},
+		{BaseWins, starlet.StringAnyMap{"a": int64(1), "b": "base", "c": []interface{}{int64(1)}, "d": true}, false},
+		{ErrorOnConflict, nil, true},
+		{MergePolicy(100), nil, true},
+	}
+	for _, tt := range tests {
+		got, err := MergeResults(base, overlay, tt.policy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("MergeResults(%d) error = %v, wantErr %v", tt.policy, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MergeResults(%d) = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+	if _, err := MergeResults(base, overlay, ErrorOnConflict); !errors.Is(err, ErrMergeConflict) || !strings.HasSuffix(err.Error(), ": b") {
+		t.Errorf("expect ErrMergeConflict of b, got %v", err)
+	}
+	if len(base) != 3 || base["b"] != "base" || len(overlay) != 3 {
+		t.Errorf("expect inputs unchanged, got %v and %v", base, overlay)
+	}
+
+	// nil maps
+	if got, err := MergeResults(nil, nil, ErrorOnConflict); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("expect empty map, got %v, %v", got, err)
+	}
+}
+
 func TestIntersectStrings(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -503,3 +1090,47 @@ func TestStarlarkStringList(t *testing.T) {
 		})
 	}
 }
+
+func TestModuleNamesList(t *testing.T) {
+	b := New("test")
+	l1 := b.moduleNamesList([]string{"a", "b"})
+	l2 := b.moduleNamesList([]string{"a", "b"})
+	if l1 == l2 {
+		t.Errorf("Expected new lists for the same names")
+	}
+	if es := starlarkStringList([]string{"a", "b"}); l1.String() != es.String() || l2.String() != es.String() {
+		t.Errorf("Expected %v, got %v and %v", es, l1, l2)
+	}
+	if err := l1.SetIndex(0, starlark.String("x")); err != nil {
+		t.Errorf("Expected the list to be mutable, got %v", err)
+	}
+	if err := l1.Append(starlark.String("c")); err != nil {
+		t.Errorf("Expected the list to be mutable, got %v", err)
+	}
+	if l3 := b.moduleNamesList([]string{"a", "b"}); l3.String() != `["a", "b"]` {
+		t.Errorf("Expected the cached names unchanged, got %v", l3)
+	}
+	if l4 := b.moduleNamesList([]string{"ab"}); l4.String() != `["ab"]` {
+		t.Errorf("Expected the list of new names, got %v", l4)
+	}
+	if l5 := b.moduleNamesList(nil); l5.Len() != 0 {
+		t.Errorf("Expected empty list, got %v", l5)
+	}
+}
+
+func BenchmarkStarlarkStringList(b *testing.B) {
+	names := []string{"atom", "base64", "csv", "go_idiomatic", "hashlib", "json", "math", "random", "re", "string", "struct", "time"}
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = starlarkStringList(names)
+		}
+	})
+	box := New("bench")
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = box.moduleNamesList(names)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package starbox
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	includeFuncName = "include"
+)
+
+// EnableInclude injects a global builtin include(name) before execution, which loads a module by its base name and returns all its members as a module value, e.g. rt = include("runtime").
+// Unlike load(), the name works with or without the ".star" suffix. The module loaded by the base name wins, i.e. builtin and custom modules take precedence over the script module with the same base name, and the script module is loaded only if there's no such module.
+// If the module has a single member named after the base name like builtin modules, the member itself is returned, so include("runtime").pid works as runtime.pid.
+// Since Starlark resolves the global names before execution, the members can't be added to the namespace of the caller directly.
+// It panics if called after execution.
+func (s *Starbox) EnableInclude() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("enable include") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot enable include after execution")
+	}
+	s.markChanged()
+	s.include = true
+}
+
+// includeModule implements include(name), it loads the module by the base name and then the script module.
+func includeModule(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	if thread.Load == nil {
+		return nil, fmt.Errorf("%s: load not supported", b.Name())
+	}
+	base := strings.TrimSuffix(strings.TrimSpace(name), ".star")
+	if base == "" {
+		return nil, fmt.Errorf("%s: empty module name", b.Name())
+	}
+
+	// try the base name first, and then the script
+	members, err := thread.Load(thread, base)
+	if err != nil {
+		if members, err = thread.Load(thread, base+".star"); err != nil {
+			return nil, fmt.Errorf("%s: cannot include %s: %w", b.Name(), name, err)
+		}
+	}
+
+	// return the single member of the same name directly, e.g. builtin modules
+	if len(members) == 1 {
+		if m, ok := members[base].(starlark.HasAttrs); ok {
+			return m, nil
+		}
+	}
+	return &starlarkstruct.Module{Name: base, Members: members}, nil
+}
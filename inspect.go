@@ -0,0 +1,227 @@
+package starbox
+
+import (
+	"errors"
+
+	"github.com/1set/starlet"
+	"github.com/1set/starlight/convert"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+var (
+	// ErrInspectorExpired is the error for using an Inspector after the box has been run again or reset.
+	ErrInspectorExpired = errors.New("inspector is expired by a subsequent run")
+)
+
+// Inspector evaluates expressions against the final state of a Starbox instance after a run of RunPeek().
+// It shares the globals and modules of the underlying machine, and it expires once the box runs again or gets reset.
+type Inspector struct {
+	box *Starbox
+	mac *starlet.Machine
+	run uint
+}
+
+// RunPeek executes a script like Run() and returns the converted output, and an Inspector for evaluating expressions against the state after the run.
+// Unlike RunInspect(), it's not interactive, so it's suitable for programmatic inspection, e.g. in tests.
+// The Inspector is returned even if the script fails, so the partial state can be inspected.
+func (s *Starbox) RunPeek(script string) (starlet.StringAnyMap, *Inspector, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err := s.prepareScriptEnv(script); err != nil {
+		return nil, nil, err
+	}
+
+	// run script
+	out, err := s.runMachine(s.mac.Run)
+	return out, &Inspector{box: s, mac: s.mac, run: s.execTimes}, err
+}
+
+// Eval evaluates the given expression against the globals and modules after the run, and returns the converted value.
+// It returns ErrInspectorExpired if the box has been run again or reset since the Inspector was created.
+// It holds the lock of the box exclusively like runs, since the expression may mutate the shared values, e.g. by calling functions.
+func (i *Inspector) Eval(expr string) (interface{}, error) {
+	s := i.box
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mac != i.mac || s.execTimes != i.run {
+		return nil, ErrInspectorExpired
+	}
+	return s.evalExpr(expr)
+}
+
+// Eval evaluates a single expression against the current globals and modules of the box, and returns the converted value.
+// Like Run(), it prepares the environment on the first call and reuses it on subsequent calls, but it doesn't change the globals.
+// It's a context-free evaluation on a separate thread: the context and timeout, thread locals, fixed clock, call depth limit and thread configurator don't apply, and only the print function is shared.
+// It doesn't count as a run either, so the box is not marked as executed and the stats are not changed, and the setters still work after it.
+// It returns an error for statements, e.g. assignments, since only expressions are accepted.
+func (s *Starbox) Eval(expr string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	// prepare environment
+	if !s.hasExec {
+		if err := s.prepareEnv(); err != nil {
+			return nil, err
+		}
+		if err := s.prepareThread(true); err != nil {
+			return nil, err
+		}
+	}
+
+	// evaluate
+	return s.evalExpr(expr)
+}
+
+// evalExpr evaluates the given expression on a new thread with the predeclared values of the machine, and returns the converted value.
+func (s *Starbox) evalExpr(expr string) (interface{}, error) {
+	thread := &starlark.Thread{Name: s.threadName()}
+	if t := s.mac.GetStarlarkThread(); t != nil {
+		thread.Print = t.Print
+	}
+	val, err := starlark.Eval(thread, "eval.star", expr, s.mac.GetStarlarkPredeclared())
+	if err != nil {
+		return nil, err
+	}
+	return convert.FromValue(val), nil
+}
+
+// RunExpr executes a script like Run(), and returns the converted value of its last top-level expression statement like a REPL echoes, instead of the output.
+// Unlike Eval(), the setup statements before the final expression are allowed, and the globals they define are kept like Run().
+// It returns nil without error if the last statement is not an expression, e.g. an assignment.
+func (s *Starbox) RunExpr(script string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err := s.prepareScriptEnv(script); err != nil {
+		return nil, err
+	}
+
+	// assign the last expression of the filtered script to a hidden global, and take it out after the run
+	src, ok := assignLastExpr(string(s.scriptSrc), lastExprName)
+	if !ok {
+		_, err := s.runMachine(s.mac.Run)
+		return nil, err
+	}
+	s.mac.SetScriptContent(s.depthScript(s.scriptName, []byte(src), nil))
+	var val starlark.Value
+	_, err := s.runMachine(func() (starlet.StringAnyMap, error) {
+		out, err := s.mac.Run()
+		pd := s.mac.GetStarlarkPredeclared()
+		val = pd[lastExprName]
+		delete(pd, lastExprName)
+		delete(out, lastExprName)
+		return out, err
+	})
+	if err != nil || val == nil {
+		return nil, err
+	}
+	return convert.FromValue(val), nil
+}
+
+// lastExprName is the name of the hidden global holding the value of the last expression for RunExpr().
+const lastExprName = "__starbox_last_expr__"
+
+// assignLastExpr rewrites the given script to assign its last top-level expression statement to the given name, and ok is false if the script is invalid or the last statement is not an expression.
+// The expression is kept in place, so the positions of errors in the script are not changed except the columns of that line.
+func assignLastExpr(script string, name string) (src string, ok bool) {
+	opts := &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true, Recursion: true}
+	f, err := opts.Parse("box.star", script, 0)
+	if err != nil || len(f.Stmts) == 0 {
+		return "", false
+	}
+	last, isExpr := f.Stmts[len(f.Stmts)-1].(*syntax.ExprStmt)
+	if !isExpr {
+		return "", false
+	}
+	start, end := last.X.Span()
+	so, eo := byteOffset(script, start), byteOffset(script, end)
+	return script[:so] + name + " = (" + script[so:eo] + ")" + script[eo:], true
+}
+
+// ScriptInputs parses and resolves the given script without executing it, and returns the sorted names it references but neither defines nor gets from the box, i.e. the inputs it requires.
+// The names provided by the globals, modules and other settings of the box, the results of previous runs, and the universal builtins of Starlark are excluded.
+// Like Warmup(), it prepares the environment on the first call, so the module resolution errors are returned here.
+func (s *Starbox) ScriptInputs(script string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment to get the predeclared names
+	if err := s.prepareEnv(); err != nil {
+		return nil, err
+	}
+	if err := s.prepareThread(true); err != nil {
+		return nil, err
+	}
+	predeclared := s.mac.GetStarlarkPredeclared()
+
+	// exclude the provided names
+	free, err := freeNames(script)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([]string, 0, len(free))
+	for _, name := range free {
+		if _, ok := predeclared[name]; ok {
+			continue
+		}
+		if _, ok := s.ctxBinds[name]; ok {
+			continue
+		}
+		if _, ok := starlark.Universe[name]; ok {
+			continue
+		}
+		inputs = append(inputs, name)
+	}
+	return inputs, nil
+}
+
+// UsedGlobals parses and resolves the given script without executing it, and returns the sorted keys of the globals added to the box, e.g. by AddKeyValue(), that the script references.
+// The globals shadowed by the definitions of the script are not counted.
+func (s *Starbox) UsedGlobals(script string) ([]string, error) {
+	free, err := freeNames(script)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	used := make([]string, 0, len(free))
+	for _, name := range free {
+		if _, ok := s.globals[name]; ok {
+			used = append(used, name)
+		}
+	}
+	return used, nil
+}
+
+// freeNames parses and resolves the given script, and returns the sorted names it references but doesn't define, including the universal builtins.
+// It parses with all the language features, so the names of any valid script can be found.
+func freeNames(script string) ([]string, error) {
+	opts := &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true, Recursion: true}
+	f, err := opts.Parse("box.star", script, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// the globals defined by the script are resolved before asking for predeclared ones, and the predeclared ones shadow the universal ones
+	names := make(map[string]struct{})
+	isPredeclared := func(name string) bool {
+		names[name] = struct{}{}
+		return true
+	}
+	if err = resolve.File(f, isPredeclared, func(string) bool { return false }); err != nil {
+		return nil, err
+	}
+	return mapSetStrings(names), nil
+}
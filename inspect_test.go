@@ -0,0 +1,326 @@
+package starbox_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/1set/starbox"
+	"github.com/1set/starlet"
+)
+
+// TestRunPeek tests the following:
+// 1. Run a script with RunPeek and get the inspector.
+// 2. Evaluate expressions against the state after the run.
+// 3. Check the inspector expires after a subsequent run.
+func TestRunPeek(t *testing.T) {
+	b := starbox.New("test")
+	b.AddNamedModules("base64")
+	out, ins, err := b.RunPeek(hereDoc(`
+		x = 10
+		def double(n):
+			return n * 2
+		names = ["a", "b"]
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["x"] != int64(10) {
+		t.Errorf("expect x=10, got %v", out["x"])
+	}
+
+	tests := []struct {
+		expr    string
+		want    interface{}
+		wantErr bool
+	}{
+		{`x`, int64(10), false},
+		{`double(x) + 1`, int64(21), false},
+		{`len(names)`, int64(2), false},
+		{`base64.encode("hi")`, "aGk=", false},
+		{`missing`, nil, true},
+		{`y = 1`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ins.Eval(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("eval(%q) expect error %v, got %v", tt.expr, tt.wantErr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("eval(%q) expect %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	// run again to expire the inspector
+	if _, err := b.Run(`x = 20`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if _, err := ins.Eval(`x`); !errors.Is(err, starbox.ErrInspectorExpired) {
+		t.Errorf("expect expired error, got %v", err)
+	}
+}
+
+// TestRunPeek_Concurrent tests the expressions evaluated concurrently by the inspector are serialized, so the shared values are mutated safely.
+func TestRunPeek_Concurrent(t *testing.T) {
+	b := starbox.New("test")
+	b.AddKeyValue("l", []interface{}{})
+	_, in, err := b.RunPeek(`x = 1`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := in.Eval(`l.append(x)`); err != nil {
+				t.Errorf("expect nil, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, err := in.Eval(`len(l)`); err != nil || v != int64(n) {
+		t.Errorf("expect %d, got %v, %v", n, v, err)
+	}
+}
+
+// TestRunPeek_Error tests the inspector is available for the partial state of failed runs.
+func TestRunPeek_Error(t *testing.T) {
+	b := starbox.New("test")
+	_, ins, err := b.RunPeek(`a = 1; b = a // 0`)
+	if err == nil {
+		t.Error("expect error, got nil")
+		return
+	}
+	if ins == nil {
+		t.Error("expect inspector, got nil")
+		return
+	}
+	if _, err := ins.Eval(`b`); err == nil {
+		t.Error("expect error for undefined b, got nil")
+	}
+
+	// reset to expire the inspector
+	_, ins, err = b.RunPeek(`c = 3`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if v, err := ins.Eval(`c * 2`); err != nil || v != int64(6) {
+		t.Errorf("expect 6, got %v, %v", v, err)
+	}
+	b.Reset()
+	if _, err := ins.Eval(`c`); !errors.Is(err, starbox.ErrInspectorExpired) {
+		t.Errorf("expect expired error, got %v", err)
+	}
+}
+
+// TestEval tests the following:
+// 1. Evaluate expressions with globals and modules before any run.
+// 2. Evaluate expressions with the results of a run.
+// 3. Check statements and invalid expressions are rejected.
+func TestEval(t *testing.T) {
+	b := starbox.New("test")
+	b.AddKeyValue("a", 10)
+	b.AddNamedModules("math")
+	b.AddModuleScript("data", `d = 5`)
+
+	tests := []struct {
+		expr    string
+		want    interface{}
+		wantErr bool
+	}{
+		{`a * 2 + 1`, int64(21), false},
+		{`math.pow(2, 3)`, float64(8), false},
+		{`"%d items" % a`, "10 items", false},
+		{`[x for x in range(a) if x % 3 == 0]`, []interface{}{int64(0), int64(3), int64(6), int64(9)}, false},
+		{`b = 1`, nil, true},
+		{`undefined + 1`, nil, true},
+		{`1 +`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := b.Eval(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("eval(%q) expect error %v, got %v", tt.expr, tt.wantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("eval(%q) expect %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	// not marked as executed, so the setters still work
+	b.AddKeyValue("e", 2)
+	if v, err := b.Eval(`a * e`); err != nil || v != int64(20) {
+		t.Errorf("expect 20, got %v, %v", v, err)
+	}
+	if st := b.GetLastStats(); st.Duration != 0 || st.Modules != nil {
+		t.Errorf("expect no stats of runs, got %+v", st)
+	}
+
+	// reuse the environment with results
+	if _, err := b.Run(`load("data.star", "d"); c = a + d`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if v, err := b.Eval(`c * a`); err != nil || v != int64(150) {
+		t.Errorf("expect 150, got %v, %v", v, err)
+	}
+}
+
+// TestRunExpr tests the following:
+// 1. Run scripts with setup statements and a final expression, and check the value of the expression.
+// 2. Check the globals defined by the setup statements are kept.
+// 3. Check nil is returned if the last statement is not an expression, and errors for invalid scripts.
+func TestRunExpr(t *testing.T) {
+	tests := []struct {
+		script  string
+		want    interface{}
+		wantErr bool
+	}{
+		{`1 + 2`, int64(3), false},
+		{"x = 3\ny = 4\nx * y", int64(12), false},
+		{`x = 3; x * 2  # double`, int64(6), false},
+		{"def f(n):\n    return n + a\n\nf(\n    1,\n)\n", int64(11), false},
+		{"s = '你好'; s + \"!\"", "你好!", false},
+		{"l = [1]\nl.append(2)", nil, false},
+		{"x = 1", nil, false},
+		{"", nil, false},
+		{"x = 1\nx +", nil, true},
+		{"fail('oops')\n1", nil, true},
+		{"1 + undefined", nil, true},
+	}
+	for _, tt := range tests {
+		b := starbox.New("test")
+		b.AddKeyValue("a", 10)
+		got, err := b.RunExpr(tt.script)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("RunExpr(%q) expect error %v, got %v", tt.script, tt.wantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("RunExpr(%q) expect %v, got %v", tt.script, tt.want, got)
+		}
+	}
+
+	// globals are kept, and the whole script is recorded
+	b := starbox.New("test")
+	script := "x = 5\nx * 2"
+	if v, err := b.RunExpr(script); err != nil || v != int64(10) {
+		t.Errorf("expect 10, got %v, %v", v, err)
+		return
+	}
+	if v, err := b.RunExpr(`x + 1`); err != nil || v != int64(6) {
+		t.Errorf("expect 6, got %v, %v", v, err)
+	}
+	if s := string(b.GetScript()); s != `x + 1` {
+		t.Errorf("expect script recorded, got %q", s)
+	}
+}
+
+// TestScriptInputs tests the following:
+// 1. Find the inputs of scripts with globals, modules, locals, loads and builtins.
+// 2. Check the script is not executed.
+// 3. Check the results of previous runs are excluded.
+// 4. Check the errors of invalid scripts.
+func TestScriptInputs(t *testing.T) {
+	b := starbox.New("test")
+	b.AddKeyValue("base", 100)
+	b.AddNamedModules("math")
+	b.AddModuleScript("data", `size = 10`)
+	b.SetArgs(nil)
+	tests := []struct {
+		script string
+		want   []string
+	}{
+		{`a = 1`, []string{}},
+		{`a = base + math.pi + len(argv)`, []string{}},
+		{`a = width * height`, []string{"height", "width"}},
+		{`a = x; x = 1`, []string{"x"}},
+		{"def f():\n    return y\ny = 1", []string{}},
+		{hereDoc(`
+			load("data", "size")
+			def f(n):
+				m = n * factor
+				return [k for k in range(m) if k > limit]
+			r = f(size) + extra + extra
+			print(r)
+		`), []string{"extra", "factor", "limit"}},
+		{`fail("never runs: " + str(reason))`, []string{"reason"}},
+	}
+	for i, tt := range tests {
+		got, err := b.ScriptInputs(tt.script)
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("[%d] expect %v, got %v", i, tt.want, got)
+		}
+	}
+
+	// results of previous runs
+	if _, err := b.Run(`width = 10`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if got, err := b.ScriptInputs(`a = width * height`); err != nil || !reflect.DeepEqual(got, []string{"height"}) {
+		t.Errorf("expect [height], got %v, %v", got, err)
+	}
+
+	// invalid scripts
+	for _, script := range []string{`a = `, `def f(x, x): pass`} {
+		if _, err := b.ScriptInputs(script); err == nil {
+			t.Errorf("expect error for %q, got nil", script)
+		}
+	}
+}
+
+// TestUsedGlobals tests the following:
+// 1. Add globals to the box.
+// 2. Find the used globals of scripts, including the shadowed ones and the ones used in functions.
+// 3. Check the errors of invalid scripts.
+func TestUsedGlobals(t *testing.T) {
+	b := starbox.New("test")
+	b.AddKeyValues(starlet.StringAnyMap{
+		"host":    "localhost",
+		"port":    8080,
+		"secret":  "s3cr3t",
+		"timeout": 30,
+		"len":     "shadow",
+	})
+	b.AddNamedModules("math")
+	tests := []struct {
+		script string
+		want   []string
+	}{
+		{`a = 1`, []string{}},
+		{`url = host + ":" + str(port)`, []string{"host", "port"}},
+		{`port = 1; b = port + math.floor(1.5)`, []string{}},
+		{hereDoc(`
+			def f():
+				return timeout * 2
+			n = len
+		`), []string{"len", "timeout"}},
+	}
+	for i, tt := range tests {
+		got, err := b.UsedGlobals(tt.script)
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("[%d] expect %v, got %v", i, tt.want, got)
+		}
+	}
+	if _, err := b.UsedGlobals(`a = `); err == nil {
+		t.Errorf("expect error for invalid script, got nil")
+	}
+}
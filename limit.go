@@ -0,0 +1,144 @@
+package starbox
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+var (
+	// ErrCallDepthExceeded is the error for a run that nests function calls deeper than the limit set by SetMaxCallDepth().
+	ErrCallDepthExceeded = errors.New("maximum call depth exceeded")
+)
+
+const (
+	// callDepthFuncName is the name of the hidden builtin checking the call depth before each call of the script.
+	callDepthFuncName = "__call_depth__"
+)
+
+// SetMaxCallDepth enables recursive functions in scripts, and limits the depth of nested function calls to the given number, so deep recursion fails early with ErrCallDepthExceeded before it blows the stack.
+// The depth is checked at each call in the script, i.e. the callee of each call expression is passed through a hidden builtin first, and the top-level code of the script is not counted.
+// It doesn't touch the step counter or the hooks of the thread, so it works with the max execution steps set by the thread configurator, and the columns in the error positions of the lines with calls may be shifted.
+// Recursion is only enabled for the script being run, the module scripts loaded by load() are compiled by the machine without it, so the recursive functions defined there still fail.
+// Zero or negative means recursion is not allowed, and it's the default.
+// It panics if called after execution.
+func (s *Starbox) SetMaxCallDepth(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set max call depth") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set max call depth after execution")
+	}
+	s.markChanged()
+	if n < 0 {
+		n = 0
+	}
+	s.maxDepth = n
+}
+
+// callDepthBuiltin returns the hidden builtin which returns the given callee as is, or fails with ErrCallDepthExceeded if calling it exceeds the limit.
+func callDepthBuiltin(limit int) *starlark.Builtin {
+	return starlark.NewBuiltin(callDepthFuncName, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		if len(args) != 1 || len(kwargs) > 0 {
+			return nil, fmt.Errorf("%s: got %d arguments, want 1", b.Name(), len(args)+len(kwargs))
+		}
+		// the frame of this builtin takes the place of the callee, and the frame of the top-level code is not counted
+		if d := thread.CallStackDepth() - 1; d > limit {
+			return nil, fmt.Errorf("%w: %d", ErrCallDepthExceeded, limit)
+		}
+		return args[0], nil
+	})
+}
+
+// depthScript returns the script content with the call depth checks for SetMaxCallDepth(), or the content as is if there is no limit.
+// For the script file in the filesystem, i.e. the content is nil, the content is read from the filesystem, and the invalid scripts are left to the run to report the errors.
+func (s *Starbox) depthScript(name string, content []byte, fsys fs.FS) []byte {
+	if s.maxDepth <= 0 {
+		return content
+	}
+	src := content
+	if src == nil && fsys != nil {
+		bs, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return content
+		}
+		src = bs
+	}
+	res, err := instrumentCalls(name, src)
+	if err != nil {
+		return content
+	}
+	return res
+}
+
+// instrumentCalls rewrites the callee of each call expression in the script into a call of the hidden builtin, e.g. f(x) into __call_depth__(f)(x), so the depth is checked just before the call.
+// The lines of the script are kept, so the line numbers in errors and backtraces are not changed.
+func instrumentCalls(name string, src []byte) ([]byte, error) {
+	opts := &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, GlobalReassign: true, Recursion: true}
+	f, err := opts.Parse(name, src, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect the insertions at both ends of the callees
+	type insertion struct {
+		offset int
+		open   bool
+	}
+	script := string(src)
+	var ins []insertion
+	syntax.Walk(f, func(n syntax.Node) bool {
+		if call, ok := n.(*syntax.CallExpr); ok {
+			// the end of the span is not reliable for some expressions like indexing, so the callee is closed at the left parenthesis of the call
+			start, _ := call.Fn.Span()
+			ins = append(ins, insertion{byteOffset(script, start), true}, insertion{byteOffset(script, call.Lparen), false})
+		}
+		return true
+	})
+	if len(ins) == 0 {
+		return src, nil
+	}
+
+	// the closing parentheses go before the opening ones at the same offset
+	sort.SliceStable(ins, func(i, j int) bool {
+		if ins[i].offset != ins[j].offset {
+			return ins[i].offset < ins[j].offset
+		}
+		return !ins[i].open && ins[j].open
+	})
+	var sb strings.Builder
+	last := 0
+	for _, in := range ins {
+		sb.WriteString(script[last:in.offset])
+		last = in.offset
+		if in.open {
+			sb.WriteString(callDepthFuncName + "(")
+		} else {
+			sb.WriteString(")")
+		}
+	}
+	sb.WriteString(script[last:])
+	return []byte(sb.String()), nil
+}
+
+// byteOffset returns the byte offset of the given position in the script, the column of the position is counted in runes.
+func byteOffset(script string, pos syntax.Position) int {
+	offset := 0
+	for line := int32(1); line < pos.Line; line++ {
+		offset += strings.IndexByte(script[offset:], '\n') + 1
+	}
+	for col := int32(1); col < pos.Col; col++ {
+		_, size := utf8.DecodeRuneInString(script[offset:])
+		offset += size
+	}
+	return offset
+}
@@ -0,0 +1,104 @@
+package starbox_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/1set/starbox"
+	"go.starlark.net/starlark"
+)
+
+// TestSetMaxCallDepth tests the following:
+// 1. Create a new Starbox instance with a max call depth.
+// 2. Run recursive functions within and beyond the limit.
+// 3. Check the recursion beyond the limit fails with ErrCallDepthExceeded, and recursion is not allowed by default.
+// 4. Check the recursion is not enabled for the module scripts, and the step limit of the thread configurator still works.
+// 5. Check the calls of lambdas are limited, and the script is kept as is.
+func TestSetMaxCallDepth(t *testing.T) {
+	script := hereDoc(`
+		def depth(n):
+			if n == 0:
+				return 0
+			return 1 + depth(n - 1)
+		r = depth(num)
+	`)
+
+	b := starbox.New("test")
+	b.SetMaxCallDepth(50)
+	out, err := b.CreateRunConfig().Script(script).KeyValue("num", 40).Execute()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["r"] != int64(40) {
+		t.Errorf("expect r=40, got %v", out["r"])
+	}
+
+	b2 := starbox.New("test2")
+	b2.SetMaxCallDepth(50)
+	_, err = b2.CreateRunConfig().Script(script).KeyValue("num", 100000).Execute()
+	if err == nil || !strings.Contains(err.Error(), "maximum call depth exceeded") {
+		t.Errorf("expect max call depth error, got %v", err)
+	}
+	if !errors.Is(err, starbox.ErrCallDepthExceeded) {
+		t.Errorf("expect ErrCallDepthExceeded, got %v", err)
+	}
+	if out, err := b2.CreateRunConfig().Script(script).KeyValue("num", 10).Execute(); err != nil || out["r"] != int64(10) {
+		t.Errorf("expect the next run within the limit to succeed, got %v, %v", out, err)
+	}
+
+	b3 := starbox.New("test3")
+	_, err = b3.CreateRunConfig().Script(script).KeyValue("num", 3).Execute()
+	if err == nil || !strings.Contains(err.Error(), "called recursively") {
+		t.Errorf("expect recursion error, got %v", err)
+	}
+
+	// module scripts are loaded without recursion
+	b4 := starbox.New("test4")
+	b4.SetMaxCallDepth(50)
+	b4.AddModuleScript("rec", script)
+	_, err = b4.CreateRunConfig().Script(`load("rec", "depth"); r = depth(3)`).KeyValue("num", 3).Execute()
+	if err == nil || !strings.Contains(err.Error(), "called recursively") {
+		t.Errorf("expect recursion error in module, got %v", err)
+	}
+
+	// the step limit of the thread configurator works with the call depth limit
+	var called bool
+	b5 := starbox.New("test5")
+	b5.SetMaxCallDepth(50)
+	b5.SetThreadConfigurator(func(th *starlark.Thread) {
+		th.SetMaxExecutionSteps(100000)
+		th.OnMaxSteps = func(th *starlark.Thread) {
+			called = true
+			th.Cancel("too many steps")
+		}
+	})
+	if _, err := b5.CreateRunConfig().Script(script).KeyValue("num", 100000).Execute(); !errors.Is(err, starbox.ErrCallDepthExceeded) {
+		t.Errorf("expect ErrCallDepthExceeded with the configurator, got %v", err)
+	}
+	if called {
+		t.Error("expect the configurator hook not called")
+	}
+	if _, err := b5.Run(`for i in range(1000000): pass`); err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("expect step limit error, got %v", err)
+	}
+	if !called {
+		t.Error("expect the configurator hook called")
+	}
+
+	// calls of lambdas and methods are checked as well, and the script is kept as is
+	b6 := starbox.New("test6")
+	b6.SetMaxCallDepth(10)
+	lambda := `f = lambda n: 0 if n == 0 else 1 + [f][0](n - 1); r = f(num)`
+	out, err = b6.CreateRunConfig().Script(lambda).KeyValue("num", 5).Execute()
+	if err != nil || out["r"] != int64(5) {
+		t.Errorf("expect r=5, got %v, %v", out, err)
+	}
+	if es := lambda; string(b6.GetScript()) != es {
+		t.Errorf("expect script %q, got %q", es, b6.GetScript())
+	}
+	if _, err = b6.CreateRunConfig().Script(lambda).KeyValue("num", 20).Execute(); !errors.Is(err, starbox.ErrCallDepthExceeded) {
+		t.Errorf("expect ErrCallDepthExceeded for lambda, got %v", err)
+	}
+}
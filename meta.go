@@ -0,0 +1,66 @@
+package starbox
+
+import (
+	"fmt"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+const (
+	metaModuleName = "meta"
+)
+
+// metaModule is the Starlark module providing access to the metadata of the box at run time, it can be added by AddNamedModules("meta").
+// Unlike ordinary modules, its attributes are computed on each access, so they reflect the live state of the box:
+//
+//	meta.box_name  # name of the box
+//	meta.run_index  # number of runs of the box, including the current one
+//	meta.steps()  # number of execution steps of the current thread so far
+type metaModule struct {
+	box *Starbox
+}
+
+var (
+	_ starlark.HasAttrs = (*metaModule)(nil)
+)
+
+// loader returns the module loader for the meta module of the box.
+func (m *metaModule) loader() starlet.ModuleLoader {
+	return func() (starlark.StringDict, error) {
+		return starlark.StringDict{metaModuleName: m}, nil
+	}
+}
+
+func (m *metaModule) String() string        { return fmt.Sprintf("<module %q>", metaModuleName) }
+func (m *metaModule) Type() string          { return "module" }
+func (m *metaModule) Freeze()               {}
+func (m *metaModule) Truth() starlark.Bool  { return starlark.True }
+func (m *metaModule) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", m.Type()) }
+
+// Attr returns the live value of the attribute with the given name.
+// It's called during execution with the lock of the box held by the run, so it reads the fields directly.
+func (m *metaModule) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "box_name":
+		return starlark.String(m.box.name), nil
+	case "run_index":
+		return starlark.MakeUint(m.box.execTimes), nil
+	case "steps":
+		return starlark.NewBuiltin("steps", metaSteps), nil
+	}
+	return nil, nil
+}
+
+// AttrNames returns the sorted names of the attributes.
+func (m *metaModule) AttrNames() []string {
+	return []string{"box_name", "run_index", "steps"}
+}
+
+// metaSteps implements meta.steps().
+func metaSteps(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return starlark.MakeUint64(thread.ExecutionSteps()), nil
+}
@@ -0,0 +1,49 @@
+package starbox_test
+
+import (
+	"testing"
+
+	"github.com/1set/starbox"
+)
+
+// TestMetaModule tests the following:
+// 1. Create a new Starbox instance with the meta module added by name, along with a module set.
+// 2. Run scripts several times and check the live metadata of the box.
+func TestMetaModule(t *testing.T) {
+	b := starbox.New("meta-box")
+	b.SetModuleSet(starbox.SafeModuleSet)
+	b.AddNamedModules("meta")
+
+	for i := 1; i <= 3; i++ {
+		out, err := b.Run(hereDoc(`
+			name = meta.box_name
+			idx = meta.run_index
+			s1 = meta.steps()
+			x = [n * n for n in range(100)]
+			s2 = meta.steps()
+			more = s2 > s1
+			attrs = dir(meta)
+		`))
+		if err != nil {
+			t.Errorf("expect nil, got %v", err)
+			return
+		}
+		if out["name"] != "meta-box" {
+			t.Errorf("expect name meta-box, got %v", out["name"])
+		}
+		if out["idx"] != int64(i) {
+			t.Errorf("expect run index %d, got %v", i, out["idx"])
+		}
+		if out["more"] != true {
+			t.Errorf("expect more steps, got %v and %v", out["s1"], out["s2"])
+		}
+	}
+}
+
+// TestMetaModule_Missing tests the meta module is only available when added.
+func TestMetaModule_Missing(t *testing.T) {
+	b := starbox.New("test")
+	if _, err := b.Run(`a = meta.box_name`); err == nil {
+		t.Error("expect error for missing meta module, got nil")
+	}
+}
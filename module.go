@@ -3,9 +3,20 @@ package starbox
 import (
 	"errors"
 	"fmt"
+	"io/fs"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/1set/starlet"
 	slog "github.com/1set/starlet/lib/log"
+	"github.com/psanford/memfs"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 // ModuleSetName defines the name of a module set.
@@ -30,9 +41,53 @@ var (
 		NetworkModuleSet: removeUniques(fullModuleNames, "file", "path", "runtime"),
 		FullModuleSet:    appendUniques(fullModuleNames),
 	}
-	localModuleLoaders = starlet.ModuleLoaderMap{}
+	localModuleLoaders = starlet.ModuleLoaderMap{
+		assertModuleName: loadAssertModule,
+	}
+)
+
+// ModulePriority defines the policy to resolve the name conflicts between starlet builtin modules and custom modules.
+type ModulePriority uint8
+
+const (
+	// PriorityBuiltinWins keeps the starlet builtin module and ignores the custom module with the same name, it's the default policy.
+	PriorityBuiltinWins ModulePriority = iota
+	// PriorityCustomWins keeps the custom module and drops the starlet builtin module with the same name.
+	PriorityCustomWins
+	// PriorityError fails the preparation before execution with ErrModuleConflict on any name conflict.
+	PriorityError
+)
+
+var (
+	// ErrModuleConflict is the error for name conflicts between starlet builtin modules and custom modules with PriorityError.
+	ErrModuleConflict = errors.New("module name conflict")
+)
+
+var (
+	defaultModSet   ModuleSetName
+	defaultModSetMu sync.RWMutex
 )
 
+// SetDefaultModuleSet sets the module set for all the Starbox instances created by New() afterwards, individual boxes can still override it via SetModuleSet().
+// It returns an error and keeps the current default if the module set is unknown. The default is EmptyModuleSet.
+func SetDefaultModuleSet(modSet ModuleSetName) error {
+	if _, err := getModuleSet(modSet); err != nil {
+		return err
+	}
+
+	defaultModSetMu.Lock()
+	defer defaultModSetMu.Unlock()
+	defaultModSet = modSet
+	return nil
+}
+
+// getDefaultModuleSet returns the module set for new Starbox instances.
+func getDefaultModuleSet() ModuleSetName {
+	defaultModSetMu.RLock()
+	defer defaultModSetMu.RUnlock()
+	return defaultModSet
+}
+
 // getModuleSet returns the module names for the given module set name.
 func getModuleSet(modSet ModuleSetName) ([]string, error) {
 	if mods, ok := moduleSets[modSet]; ok {
@@ -44,20 +99,269 @@ func getModuleSet(modSet ModuleSetName) ([]string, error) {
 	return nil, fmt.Errorf("unknown module set: %s", modSet)
 }
 
-func (s *Starbox) extractModLoaders() (preMods starlet.ModuleLoaderList, lazyMods starlet.ModuleLoaderMap, modNames []string, err error) {
-	// extract starlet builtin module loaders
-	starPre, starLazy, starName, err := s.extractStarletModules(s.modSet, s.namedMods)
+// DiffModuleSet returns the sorted unique names of starlet builtin modules in names but not in the base module set, e.g. the extra modules of a box beyond SafeModuleSet for audits.
+// The names not of starlet builtin modules are ignored, and it returns an error if the base module set is unknown.
+func DiffModuleSet(base ModuleSetName, names []string) (added []string, err error) {
+	baseMods, err := getModuleSet(base)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
+	}
+	return removeUniques(intersectStrings(fullModuleNames, names), baseMods...), nil
+}
+
+// ResolveModules resolves all the module loaders like the preparation before execution, and returns the names of the preload and lazyload modules without executing.
+// The preload names are grouped by sources in the order of loading, i.e. starlet builtin modules, custom modules and dynamic modules, and the lazyload names are sorted.
+// It's read-only and safe to call repeatedly, and it's useful for debugging which module wins on name conflicts.
+func (s *Starbox) ResolveModules() (preload []string, lazyload []string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, lazyMods, _, preload, err := s.extractModLoaders()
+	if err != nil {
+		return nil, nil, err
+	}
+	lazyload = make([]string, 0, len(lazyMods))
+	for name := range lazyMods {
+		lazyload = append(lazyload, name)
+	}
+	sort.Strings(lazyload)
+	return preload, lazyload, nil
+}
+
+// ClassifyModule returns the source of the module that scripts would get by loading the given name, i.e. "builtin" for starlet builtin modules and the ones shipped with starbox, "custom" for the ones added by methods like AddModuleLoader(), "dynamic" for the named modules to be resolved by the dynamic module loader, and "script" for the module scripts in the virtual filesystem.
+// It follows the same precedence as the preparation before execution without resolving anything, so ok is false if the name would not be loaded, and the dynamic modules are not checked for existence.
+func (s *Starbox) ClassifyModule(name string) (source string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var overMods []string
+	if s.modPrior == PriorityCustomWins {
+		for n := range s.loadMods {
+			overMods = append(overMods, n)
+		}
+	}
+	nameMods, err := s.namedModuleNames()
+	if err != nil {
+		return "", false
+	}
+	starNames, err := s.starletModuleNames(s.modSet, nameMods, overMods)
+	if err != nil {
+		return "", false
+	}
+	_, isStar := stringsMapSet(starNames)[name]
+	_, isNamed := stringsMapSet(nameMods)[name]
+	switch {
+	case isStar:
+		return "builtin", true
+	case s.loadMods[name] != nil:
+		return "custom", true
+	case (s.dynMods != nil || s.bulkMods != nil) && isNamed:
+		return "dynamic", true
+	case s.hasModuleScript(name):
+		return "script", true
+	}
+	return "", false
+}
+
+// hasModuleScript checks if the module script of the given name exists in the virtual filesystem, with or without the ".star" suffix.
+func (s *Starbox) hasModuleScript(name string) bool {
+	_, err := s.readModuleScript(name)
+	return err == nil
+}
+
+// readModuleScript reads the module script of the given name from the virtual filesystem, with or without the ".star" suffix, the same way as loading it in scripts.
+func (s *Starbox) readModuleScript(name string) ([]byte, error) {
+	fp := name
+	if !strings.HasSuffix(fp, ".star") {
+		fp += ".star"
+	}
+	if s.modFS != nil {
+		// the filesystem set by SetFS() overrides the module scripts, or it's the one built from them before execution
+		return fs.ReadFile(s.modFS, fp)
+	}
+	src, ok := s.scriptMods[fp]
+	if len(s.prefixFS) == 0 {
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: fp, Err: fs.ErrNotExist}
+		}
+		return []byte(src), nil
+	}
+	// the mounted filesystems shadow the module scripts under their prefixes
+	base := memfs.New()
+	if ok {
+		if dir := path.Dir(fp); dir != "." {
+			if err := base.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+		}
+		if err := base.WriteFile(fp, []byte(src), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return fs.ReadFile(newMountFS(base, s.prefixFS), fp)
+}
+
+// ModuleSymbols returns the sorted names that a load() statement of the given module name could import, e.g. for the autocomplete of load() arguments in an editor.
+// The module loaders of starlet builtin modules, custom modules and dynamic modules are resolved like the preparation before execution and then called to collect the names, and the module scripts in the virtual filesystem are parsed without executing to collect the top-level assigned names.
+// Names with a leading underscore are excluded since they can't be loaded. It returns an error wrapping ErrModuleNotFound if the name would not be loaded.
+func (s *Starbox) ModuleSymbols(name string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, lazyMods, _, _, err := s.extractModLoaders()
+	if err != nil {
+		return nil, err
+	}
+	if ld := lazyMods[name]; ld != nil {
+		sd, err := ld()
+		if err != nil {
+			return nil, fmt.Errorf("load module %s: %w", name, err)
+		}
+		return exportedNames(sd.Keys()), nil
+	}
+
+	src, err := s.readModuleScript(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+	}
+	f, err := syntax.LegacyFileOptions().Parse(name, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	isPredeclared := func(n string) bool {
+		return !starlark.Universe.Has(n)
+	}
+	if err := resolve.File(f, isPredeclared, starlark.Universe.Has); err != nil {
+		return nil, err
+	}
+	var names []string
+	if mod, ok := f.Module.(*resolve.Module); ok {
+		for _, b := range mod.Globals {
+			names = append(names, b.First.Name)
+		}
+	}
+	sort.Strings(names)
+	return exportedNames(names), nil
+}
+
+// exportedNames returns the names without the ones with a leading underscore, which are not exported by load().
+func exportedNames(names []string) []string {
+	res := make([]string, 0, len(names))
+	for _, n := range names {
+		if !strings.HasPrefix(n, "_") {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+const (
+	// defaultModulesVarName is the default name of the global variable for the names of loaded modules.
+	defaultModulesVarName = "__modules__"
+)
+
+// SetModulesVarName sets the name of the global variable injected before execution for the names of loaded modules, the default is "__modules__".
+// An empty name disables the injection entirely.
+// It panics if called after execution.
+func (s *Starbox) SetModulesVarName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("set modules var name") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot set modules var name after execution")
+	}
+	s.markChanged()
+	s.modsVar = name
+}
+
+// EnableModuleIntrospection injects a global dict __module_members__ before execution, mapping each loaded module name to the sorted names of its members.
+// It's off by default, since each module is loaded once more to collect its members during the preparation.
+// It panics if called after execution.
+func (s *Starbox) EnableModuleIntrospection() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("enable module introspection") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot enable module introspection after execution")
+	}
+	s.markChanged()
+	s.modIntro = true
+}
+
+// moduleMembers loads the given modules and returns a frozen dict mapping each module name to the sorted names of its members.
+// For modules which wrap the members in a module or struct value of the same name, the attributes of the value are listed instead.
+func moduleMembers(lazyMods starlet.ModuleLoaderMap) (*starlark.Dict, error) {
+	names := make([]string, 0, len(lazyMods))
+	for name := range lazyMods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	d := starlark.NewDict(len(names))
+	for _, name := range names {
+		sd, err := lazyMods[name]()
+		if err != nil {
+			return nil, fmt.Errorf("load module %s: %w", name, err)
+		}
+		var members []string
+		if v, ok := sd[name].(starlark.HasAttrs); ok && len(sd) == 1 {
+			members = append(members, v.AttrNames()...)
+			sort.Strings(members)
+		} else {
+			members = sd.Keys()
+		}
+		if err := d.SetKey(starlark.String(name), starlarkStringList(members)); err != nil {
+			return nil, err
+		}
+	}
+	d.Freeze()
+	return d, nil
+}
+
+// extractModLoaders resolves the module loaders from all sources, and returns the merged loaders, the sorted unique module names, and the module names of preload loaders grouped by sources.
+func (s *Starbox) extractModLoaders() (preMods starlet.ModuleLoaderList, lazyMods starlet.ModuleLoaderMap, modNames []string, preNames []string, err error) {
+	// extract starlet builtin module loaders, without the ones overridden by custom modules if needed
+	var overMods []string
+	if s.modPrior == PriorityCustomWins {
+		for name := range s.loadMods {
+			overMods = append(overMods, name)
+		}
+	}
+	nameMods, err := s.namedModuleNames()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	starPre, starLazy, starName, err := s.extractStarletModules(s.modSet, nameMods, overMods)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// check name conflicts if needed
+	if s.modPrior == PriorityError {
+		var conflicts []string
+		for _, name := range starName {
+			if _, ok := s.loadMods[name]; ok {
+				conflicts = append(conflicts, name)
+			}
+		}
+		if len(conflicts) > 0 {
+			return nil, nil, nil, nil, fmt.Errorf("%w: %s", ErrModuleConflict, strings.Join(conflicts, ", "))
+		}
 	}
 
 	// extract custom module loaders
 	cusPre, cusLazy, cusName := extractLocalModules(s.loadMods, stringsMapSet(starName))
 
 	// extract dynamic module loaders
-	dynPre, dynLazy, dynName, err := extractDynamicModules(s.dynMods, s.namedMods, stringsMapSet(starName, cusName))
+	dynPre, dynLazy, dynName, err := extractDynamicModules(withLoadTimeout(s.dynMods, s.loadTimeout), s.bulkMods, nameMods, stringsMapSet(starName, cusName), s.parMods)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, nil, nil, nil, err
 	}
 
 	// merge all module loaders
@@ -71,25 +375,45 @@ func (s *Starbox) extractModLoaders() (preMods starlet.ModuleLoaderList, lazyMod
 	}
 	nameSet := stringsMapSet(starName, cusName, dynName)
 	modNames = mapSetStrings(nameSet)
+	preNames = make([]string, 0, len(starName)+len(cusName)+len(dynName))
+	for _, names := range [][]string{starName, cusName, dynName} {
+		preNames = append(preNames, names...)
+	}
 
 	// all done
 	return
 }
 
-// extractStarletModules extracts starlet builtin module loaders from the given module set and additional module names.
-func (s *Starbox) extractStarletModules(setName ModuleSetName, nameMods []string) (preMods starlet.ModuleLoaderList, lazyMods starlet.ModuleLoaderMap, modNames []string, err error) {
-	// get starlet modules by set name
-	if modNames, err = getModuleSet(setName); err != nil {
-		return nil, nil, nil, err
+// namedModuleNames returns the module names added by name, with the glob patterns expanded against all starlet builtin module names.
+func (s *Starbox) namedModuleNames() ([]string, error) {
+	if len(s.globMods) == 0 {
+		return s.namedMods, nil
 	}
+	names := append([]string(nil), s.namedMods...)
+	for _, p := range s.globMods {
+		var matched []string
+		for _, name := range fullModuleNames {
+			if ok, _ := path.Match(p, name); ok {
+				matched = append(matched, name)
+			}
+		}
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("%w: no module matches %q", ErrModuleNotFound, p)
+		}
+		names = appendUniques(names, matched...)
+	}
+	return names, nil
+}
 
-	// append additional starlet module by individual names
-	addNames := intersectStrings(fullModuleNames, nameMods)
-	modNames = appendUniques(modNames, addNames...)
+// extractStarletModules extracts starlet builtin module loaders from the given module set and additional module names, except the excluded module names.
+func (s *Starbox) extractStarletModules(setName ModuleSetName, nameMods []string, exclude []string) (preMods starlet.ModuleLoaderList, lazyMods starlet.ModuleLoaderMap, modNames []string, err error) {
+	if modNames, err = s.starletModuleNames(setName, nameMods, exclude); err != nil {
+		return nil, nil, nil, err
+	}
 
 	// convert starlet builtin module names to module loaders
 	if len(modNames) > 0 {
-		// replace user log module with the custom one
+		// replace user log module and seeded random module with the custom ones, and use local modules of starbox
 		var (
 			leftNames   = make([]string, 0, len(modNames))
 			repPreMods  = make(starlet.ModuleLoaderList, 0, 1)
@@ -100,6 +424,13 @@ func (s *Starbox) extractStarletModules(setName ModuleSetName, nameMods []string
 				ld := slog.NewModule(s.userLog).LoadModule
 				repPreMods = append(repPreMods, ld)
 				repLazyMods[name] = ld
+			} else if name == randomModuleName && s.seeded {
+				ld := seededRandomLoader(s.randSeed)
+				repPreMods = append(repPreMods, ld)
+				repLazyMods[name] = ld
+			} else if ld, ok := s.localModuleLoader(name); ok {
+				repPreMods = append(repPreMods, ld)
+				repLazyMods[name] = ld
 			} else {
 				leftNames = append(leftNames, name)
 			}
@@ -113,7 +444,7 @@ func (s *Starbox) extractStarletModules(setName ModuleSetName, nameMods []string
 			return nil, nil, nil, err
 		}
 
-		// append custom log module if exists
+		// append custom log module and local modules if exists
 		if len(repPreMods) > 0 {
 			preMods = append(preMods, repPreMods...)
 			lazyMods.Merge(repLazyMods)
@@ -122,6 +453,38 @@ func (s *Starbox) extractStarletModules(setName ModuleSetName, nameMods []string
 	return
 }
 
+// starletModuleNames returns the names of starlet builtin modules and local modules of starbox from the given module set and additional module names, except the excluded module names.
+func (s *Starbox) starletModuleNames(setName ModuleSetName, nameMods []string, exclude []string) (modNames []string, err error) {
+	// get starlet modules by set name, or the customized one
+	if s.modSetMods != nil {
+		modNames = s.modSetMods
+	} else if modNames, err = getModuleSet(setName); err != nil {
+		return nil, err
+	}
+
+	// append additional starlet module and local module by individual names
+	addNames := intersectStrings(fullModuleNames, nameMods)
+	modNames = appendUniques(modNames, addNames...)
+	for _, name := range nameMods {
+		if _, ok := s.localModuleLoader(name); ok {
+			modNames = appendUniques(modNames, name)
+		}
+	}
+	if len(exclude) > 0 {
+		modNames = removeUniques(modNames, exclude...)
+	}
+	return modNames, nil
+}
+
+// localModuleLoader returns the loader of the module shipped with starbox by name, including the ones bound to the box like the meta module.
+func (s *Starbox) localModuleLoader(name string) (starlet.ModuleLoader, bool) {
+	if name == metaModuleName {
+		return (&metaModule{box: s}).loader(), true
+	}
+	ld, ok := localModuleLoaders[name]
+	return ld, ok
+}
+
 // extractLocalModules extracts custom module loaders.
 func extractLocalModules(loadMods starlet.ModuleLoaderMap, existMods map[string]struct{}) (preMods starlet.ModuleLoaderList, lazyMods starlet.ModuleLoaderMap, modNames []string) {
 	// no custom module loaders
@@ -129,10 +492,16 @@ func extractLocalModules(loadMods starlet.ModuleLoaderMap, existMods map[string]
 		return
 	}
 
-	// extract all custom module loaders
+	// extract all custom module loaders in the order of names
+	names := make([]string, 0, len(loadMods))
+	for name := range loadMods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 	preMods = make(starlet.ModuleLoaderList, 0, len(loadMods))
 	lazyMods = make(starlet.ModuleLoaderMap, len(loadMods))
-	for name, loader := range loadMods {
+	for _, name := range names {
+		loader := loadMods[name]
 		// skip loaded modules, i.e. avoid conflicts with starlet builtin modules
 		if _, ok := existMods[name]; ok {
 			continue
@@ -147,42 +516,174 @@ func extractLocalModules(loadMods starlet.ModuleLoaderMap, existMods map[string]
 var (
 	// ErrModuleNotFound is the error for module cannot be found by name.
 	ErrModuleNotFound = errors.New("module not found")
+	// ErrModuleLoadTimeout is the error for dynamic module loader that doesn't return in the time set by SetModuleLoadTimeout().
+	ErrModuleLoadTimeout = errors.New("module load timeout")
 )
 
+// withLoadTimeout wraps the dynamic module loader to return ErrModuleLoadTimeout with the module name if a lookup doesn't return in the given duration.
+// The lookup that timed out keeps running in the background until it returns, since the loader can't be cancelled.
+func withLoadTimeout(metaLoad DynamicModuleLoader, d time.Duration) DynamicModuleLoader {
+	if metaLoad == nil || d <= 0 {
+		return metaLoad
+	}
+	type result struct {
+		loader starlet.ModuleLoader
+		err    error
+	}
+	return func(name string) (starlet.ModuleLoader, error) {
+		ch := make(chan result, 1)
+		go func() {
+			loader, err := metaLoad(name)
+			ch <- result{loader, err}
+		}()
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case r := <-ch:
+			return r.loader, r.err
+		case <-timer.C:
+			return nil, fmt.Errorf("%w: %s after %v", ErrModuleLoadTimeout, name, d)
+		}
+	}
+}
+
 // extractDynamicModules extracts dynamic module loaders by module names.
-func extractDynamicModules(metaLoad DynamicModuleLoader, nameMods []string, existMods map[string]struct{}) (preMods starlet.ModuleLoaderList, lazyMods starlet.ModuleLoaderMap, modNames []string, err error) {
+// If bulkLoad is set, it's called once with all the unresolved names instead of metaLoad.
+// Otherwise, if parallel is true, the loaders are resolved concurrently with a bounded worker pool, and the results are merged in the order of names.
+func extractDynamicModules(metaLoad DynamicModuleLoader, bulkLoad BulkDynamicModuleLoader, nameMods []string, existMods map[string]struct{}, parallel bool) (preMods starlet.ModuleLoaderList, lazyMods starlet.ModuleLoaderMap, modNames []string, err error) {
 	// initialize
 	preMods = make(starlet.ModuleLoaderList, 0, len(nameMods))
 	lazyMods = make(starlet.ModuleLoaderMap, len(nameMods))
 
-	// get dynamic module loaders by name
+	// skip loaded modules, i.e. dynamic modules acts as a complement to static modules
+	pendNames := make([]string, 0, len(nameMods))
 	for _, name := range nameMods {
-		// skip loaded modules, i.e. dynamic modules acts as a complement to static modules
-		if _, ok := existMods[name]; ok {
-			continue
+		if _, ok := existMods[name]; !ok {
+			pendNames = append(pendNames, name)
 		}
+	}
+	if len(pendNames) == 0 {
+		return
+	}
 
-		// if no meta loader for unknown module name, return error
-		if metaLoad == nil {
-			err = ErrModuleNotFound
-			return
-		}
+	// if no meta loader for unknown module name, return error
+	if metaLoad == nil && bulkLoad == nil {
+		err = ErrModuleNotFound
+		return
+	}
 
-		// try to load module by name, return error if failed or not found
-		var loader starlet.ModuleLoader
-		loader, err = metaLoad(name)
+	// try to load module by name, return error if failed or not found
+	loadByName := func(name string) (starlet.ModuleLoader, error) {
+		loader, err := metaLoad(name)
 		if err != nil {
-			return
+			return nil, err
 		}
 		if loader == nil {
-			err = fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+			return nil, fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+		}
+		return loader, nil
+	}
+
+	// get dynamic module loaders by name
+	loaders := make([]starlet.ModuleLoader, len(pendNames))
+	if bulkLoad != nil {
+		// resolve all the names in one lookup, and missing names are not found
+		var found map[string]starlet.ModuleLoader
+		if found, err = bulkLoad(append([]string(nil), pendNames...)); err != nil {
 			return
 		}
+		for i, name := range pendNames {
+			if loaders[i] = found[name]; loaders[i] == nil {
+				err = fmt.Errorf("%w: %s", ErrModuleNotFound, name)
+				return
+			}
+		}
+	} else if parallel && len(pendNames) > 1 {
+		errs := make([]error, len(pendNames))
+		parallelDo(len(pendNames), runtime.NumCPU(), func(i int) {
+			loaders[i], errs[i] = loadByName(pendNames[i])
+		})
+		// return the first error in the order of names
+		for _, e := range errs {
+			if e != nil {
+				err = e
+				return
+			}
+		}
+	} else {
+		for i, name := range pendNames {
+			if loaders[i], err = loadByName(name); err != nil {
+				return
+			}
+		}
+	}
 
-		// for valid loader
-		preMods = append(preMods, loader)
-		lazyMods[name] = loader
+	// for valid loaders
+	for i, name := range pendNames {
+		preMods = append(preMods, loaders[i])
+		lazyMods[name] = loaders[i]
 		modNames = append(modNames, name)
 	}
 	return
 }
+
+// parallelDo calls the given function for each index from 0 to n-1 concurrently with the given number of workers, and waits for all to finish.
+func parallelDo(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// mountFS is a filesystem that serves the files of the mounted filesystems under their prefixes, and the rest from the base filesystem.
+type mountFS struct {
+	base   fs.FS
+	mounts map[string]fs.FS
+	keys   []string
+}
+
+// newMountFS creates a mountFS with the given base and mounted filesystems, the longest matching prefix wins.
+func newMountFS(base fs.FS, mounts map[string]fs.FS) *mountFS {
+	m := &mountFS{base: base, mounts: make(map[string]fs.FS, len(mounts))}
+	for k, v := range mounts {
+		m.mounts[k] = v
+		m.keys = append(m.keys, k)
+	}
+	sort.Slice(m.keys, func(i, j int) bool {
+		return len(m.keys[i]) > len(m.keys[j])
+	})
+	return m
+}
+
+// Open opens the named file from the mounted filesystem whose prefix matches the name, or from the base filesystem.
+func (m *mountFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	for _, prefix := range m.keys {
+		if name == prefix {
+			return m.mounts[prefix].Open(".")
+		}
+		if strings.HasPrefix(name, prefix+"/") {
+			return m.mounts[prefix].Open(name[len(prefix)+1:])
+		}
+	}
+	return m.base.Open(name)
+}
@@ -0,0 +1,316 @@
+package starbox
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+var (
+	// ErrKeyNotFound is the error for accessing a key that doesn't exist in the output of the last run.
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+// OutputTypeError is the error for accessing a value in the output of the last run with a wrong type.
+type OutputTypeError struct {
+	Key   string
+	Want  string
+	Value interface{}
+}
+
+// Error returns the error message.
+func (e OutputTypeError) Error() string {
+	return fmt.Sprintf("key %s is %s, not %s", e.Key, describeType(e.Value), e.Want)
+}
+
+// GetInt returns the integer value of the given key in the converted output of the last run.
+func (s *Starbox) GetInt(key string) (int64, error) {
+	v, err := s.getOutput(key)
+	if err != nil {
+		return 0, err
+	}
+	switch t := v.(type) {
+	case int64:
+		return t, nil
+	case int:
+		return int64(t), nil
+	default:
+		return 0, OutputTypeError{Key: key, Want: "int", Value: v}
+	}
+}
+
+// GetString returns the string value of the given key in the converted output of the last run.
+func (s *Starbox) GetString(key string) (string, error) {
+	v, err := s.getOutput(key)
+	if err != nil {
+		return "", err
+	}
+	if t, ok := v.(string); ok {
+		return t, nil
+	}
+	return "", OutputTypeError{Key: key, Want: "string", Value: v}
+}
+
+// GetFloat returns the float value of the given key in the converted output of the last run, integers are converted into floats.
+func (s *Starbox) GetFloat(key string) (float64, error) {
+	v, err := s.getOutput(key)
+	if err != nil {
+		return 0, err
+	}
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case int64:
+		return float64(t), nil
+	case int:
+		return float64(t), nil
+	default:
+		return 0, OutputTypeError{Key: key, Want: "float", Value: v}
+	}
+}
+
+// GetBool returns the boolean value of the given key in the converted output of the last run.
+func (s *Starbox) GetBool(key string) (bool, error) {
+	v, err := s.getOutput(key)
+	if err != nil {
+		return false, err
+	}
+	if t, ok := v.(bool); ok {
+		return t, nil
+	}
+	return false, OutputTypeError{Key: key, Want: "bool", Value: v}
+}
+
+// GetStringSlice returns the list of strings of the given key in the converted output of the last run, it works for both lists and tuples.
+func (s *Starbox) GetStringSlice(key string) ([]string, error) {
+	v, err := s.getOutput(key)
+	if err != nil {
+		return nil, err
+	}
+	switch t := v.(type) {
+	case []string:
+		return t, nil
+	case []interface{}:
+		ss := make([]string, len(t))
+		for i, e := range t {
+			str, ok := e.(string)
+			if !ok {
+				return nil, OutputTypeError{Key: fmt.Sprintf("%s[%d]", key, i), Want: "string", Value: e}
+			}
+			ss[i] = str
+		}
+		return ss, nil
+	default:
+		return nil, OutputTypeError{Key: key, Want: "list of strings", Value: v}
+	}
+}
+
+// OutputJSONTyped returns the output of the last run as a JSON object, where each value carries its Starlark type alongside the value like {"type":"int","value":42}, so the types can be reconstructed losslessly by clients.
+// The elements of lists, tuples and sets are typed values in arrays, and the entries of dicts are arrays of {"key":...,"value":...} objects with typed keys and values.
+// Ints beyond the safe range of float64 are encoded as decimal strings, non-finite floats as "nan", "+inf" or "-inf", bytes as base64 strings, and the values of other types like functions or structs as their string representations.
+// It returns ErrNotExecuted if the box has not been executed, or an error if any value contains itself.
+func (s *Starbox) OutputJSONTyped() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasExec || s.mac == nil {
+		return nil, ErrNotExecuted
+	}
+	res := make(map[string]typedValue, len(s.lastRes))
+	for name, v := range s.lastRes {
+		tv, err := newTypedValue(v, make(map[starlark.Value]struct{}))
+		if err != nil {
+			return nil, fmt.Errorf("encode %s: %w", name, err)
+		}
+		res[name] = tv
+	}
+	return json.Marshal(res)
+}
+
+// typedValue is a Starlark value with its type for OutputJSONTyped().
+type typedValue struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// typedEntry is an entry of a Starlark dict for OutputJSONTyped().
+type typedEntry struct {
+	Key   typedValue `json:"key"`
+	Value typedValue `json:"value"`
+}
+
+// maxSafeInt is the largest integer that can be represented exactly in float64, as Number.MAX_SAFE_INTEGER in JavaScript.
+const maxSafeInt = 1<<53 - 1
+
+// newTypedValue converts the given Starlark value into a typedValue recursively, seen holds the containers on the current path to detect cycles.
+func newTypedValue(v starlark.Value, seen map[starlark.Value]struct{}) (typedValue, error) {
+	tv := typedValue{Type: v.Type()}
+	switch x := v.(type) {
+	case starlark.NoneType:
+		tv.Value = nil
+	case starlark.Bool:
+		tv.Value = bool(x)
+	case starlark.Int:
+		if i, ok := x.Int64(); ok && i >= -maxSafeInt && i <= maxSafeInt {
+			tv.Value = i
+		} else {
+			tv.Value = x.String()
+		}
+	case starlark.Float:
+		if f := float64(x); math.IsNaN(f) || math.IsInf(f, 0) {
+			tv.Value = x.String()
+		} else {
+			tv.Value = f
+		}
+	case starlark.String:
+		tv.Value = string(x)
+	case starlark.Bytes:
+		tv.Value = []byte(x)
+	case starlark.Tuple, *starlark.List, *starlark.Set, *starlark.Dict:
+		if _, isTuple := x.(starlark.Tuple); !isTuple {
+			if _, ok := seen[x]; ok {
+				return tv, errors.New("value contains itself")
+			}
+			seen[x] = struct{}{}
+			defer delete(seen, x)
+		}
+		if d, ok := x.(*starlark.Dict); ok {
+			entries := make([]typedEntry, 0, d.Len())
+			for _, item := range d.Items() {
+				k, err := newTypedValue(item[0], seen)
+				if err != nil {
+					return tv, err
+				}
+				ev, err := newTypedValue(item[1], seen)
+				if err != nil {
+					return tv, err
+				}
+				entries = append(entries, typedEntry{Key: k, Value: ev})
+			}
+			tv.Value = entries
+			break
+		}
+		elems := make([]typedValue, 0)
+		iter := x.(starlark.Iterable).Iterate()
+		defer iter.Done()
+		var e starlark.Value
+		for iter.Next(&e) {
+			ev, err := newTypedValue(e, seen)
+			if err != nil {
+				return tv, err
+			}
+			elems = append(elems, ev)
+		}
+		tv.Value = elems
+	default:
+		tv.Value = v.String()
+	}
+	return tv, nil
+}
+
+// getOutput returns the value of the given key in the converted output of the last run.
+func (s *Starbox) getOutput(key string) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasExec {
+		return nil, ErrNotExecuted
+	}
+	v, ok := s.lastOut[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return v, nil
+}
+
+// describeType returns the Starlark-like type name of the converted value for error messages.
+func describeType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "None"
+	case bool:
+		return "bool"
+	case int, int64, uint64:
+		return "int"
+	case float64:
+		return "float"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	case []interface{}:
+		return "list"
+	case map[interface{}]interface{}, starlet.StringAnyMap:
+		return "dict"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// resultTypesOnce guards the registration of registerResultTypes().
+var resultTypesOnce sync.Once
+
+// registerResultTypes registers the types of the converted output values with gob once, it's called by EncodeResult() and DecodeResult() instead of at import, so the programs not using them keep the gob registry untouched.
+func registerResultTypes() {
+	resultTypesOnce.Do(func() {
+		for _, v := range []interface{}{
+			[]interface{}{},
+			map[string]interface{}{},
+			map[interface{}]interface{}{},
+			map[interface{}]bool{},
+			new(big.Int),
+			time.Time{},
+			time.Duration(0),
+		} {
+			gob.Register(v)
+		}
+	})
+}
+
+// EncodeResult encodes the converted output of a run into bytes with gob, so it can be cached and restored by DecodeResult() later.
+// Besides the basic types, it supports the lists, dicts and sets converted from Starlark values, big ints, times and durations, and other types should be registered by gob.Register() before encoding.
+// It returns an error naming the key if any value can't be encoded, e.g. functions or modules.
+func EncodeResult(out starlet.StringAnyMap) ([]byte, error) {
+	registerResultTypes()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(map[string]interface{}(out)); err != nil {
+		// find the first key of the value that can't be encoded
+		keys := make([]string, 0, len(out))
+		for k := range out {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if e := gob.NewEncoder(io.Discard).Encode(map[string]interface{}{k: out[k]}); e != nil {
+				return nil, fmt.Errorf("encode result %s: %w", k, e)
+			}
+		}
+		return nil, fmt.Errorf("encode result: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeResult decodes the bytes encoded by EncodeResult() into the output of a run, and the values are restored with their types.
+// It returns an error if the bytes are malformed or contain unregistered types.
+func DecodeResult(data []byte) (starlet.StringAnyMap, error) {
+	registerResultTypes()
+	var out map[string]interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode result: %w", err)
+	}
+	if out == nil {
+		out = make(map[string]interface{})
+	}
+	return out, nil
+}
@@ -0,0 +1,212 @@
+package starbox_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/1set/starbox"
+)
+
+// TestTypedGetters tests the following:
+// 1. Check the getters return ErrNotExecuted before the first run.
+// 2. Run a script with values of various types.
+// 3. Check the typed getters return the values, or errors for missing keys and wrong types.
+func TestTypedGetters(t *testing.T) {
+	b := starbox.New("test")
+	if _, err := b.GetInt("a"); !errors.Is(err, starbox.ErrNotExecuted) {
+		t.Errorf("expect not executed error, got %v", err)
+	}
+
+	_, err := b.Run(hereDoc(`
+		i = 42
+		s = "aloha"
+		f = 3.14
+		t = True
+		l = ["a", "b"]
+		tp = ("c",)
+		mixed = ["a", 1]
+		n = None
+	`))
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+
+	if v, err := b.GetInt("i"); err != nil || v != 42 {
+		t.Errorf("expect 42, got %v, %v", v, err)
+	}
+	if v, err := b.GetString("s"); err != nil || v != "aloha" {
+		t.Errorf("expect aloha, got %v, %v", v, err)
+	}
+	if v, err := b.GetFloat("f"); err != nil || v != 3.14 {
+		t.Errorf("expect 3.14, got %v, %v", v, err)
+	}
+	if v, err := b.GetFloat("i"); err != nil || v != 42 {
+		t.Errorf("expect 42.0, got %v, %v", v, err)
+	}
+	if v, err := b.GetBool("t"); err != nil || !v {
+		t.Errorf("expect true, got %v, %v", v, err)
+	}
+	if v, err := b.GetStringSlice("l"); err != nil || !reflect.DeepEqual(v, []string{"a", "b"}) {
+		t.Errorf("expect [a b], got %v, %v", v, err)
+	}
+	if v, err := b.GetStringSlice("tp"); err != nil || !reflect.DeepEqual(v, []string{"c"}) {
+		t.Errorf("expect [c], got %v, %v", v, err)
+	}
+
+	tests := []struct {
+		name string
+		fn   func() error
+		msg  string
+	}{
+		{"int of string", func() error { _, e := b.GetInt("s"); return e }, "key s is string, not int"},
+		{"string of int", func() error { _, e := b.GetString("i"); return e }, "key i is int, not string"},
+		{"float of bool", func() error { _, e := b.GetFloat("t"); return e }, "key t is bool, not float"},
+		{"bool of none", func() error { _, e := b.GetBool("n"); return e }, "key n is None, not bool"},
+		{"slice of float", func() error { _, e := b.GetStringSlice("f"); return e }, "key f is float, not list of strings"},
+		{"slice of mixed", func() error { _, e := b.GetStringSlice("mixed"); return e }, "key mixed[1] is int, not string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fn()
+			var te starbox.OutputTypeError
+			if !errors.As(err, &te) {
+				t.Errorf("expect type error, got %v", err)
+				return
+			}
+			if err.Error() != tt.msg {
+				t.Errorf("expect %q, got %q", tt.msg, err.Error())
+			}
+		})
+	}
+
+	if _, err := b.GetString("missing"); !errors.Is(err, starbox.ErrKeyNotFound) {
+		t.Errorf("expect key not found error, got %v", err)
+	}
+}
+
+// TestOutputJSONTyped tests the following:
+// 1. Check it returns ErrNotExecuted before the first run.
+// 2. Run a script with values of various types.
+// 3. Check the JSON output carries the Starlark types with the values.
+// 4. Check the error for a value containing itself.
+func TestOutputJSONTyped(t *testing.T) {
+	b := starbox.New("test")
+	if _, err := b.OutputJSONTyped(); !errors.Is(err, starbox.ErrNotExecuted) {
+		t.Errorf("expect ErrNotExecuted, got %v", err)
+	}
+	if _, err := b.Run(hereDoc(`
+		n = None
+		i = 42
+		big = 1 << 60
+		f = 2.0
+		inf = float("inf")
+		s = "hi"
+		by = b"ab"
+		t = (1, "a")
+		d = {1: [True]}
+		def fn(): pass
+	`)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	bs, err := b.OutputJSONTyped()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(bs, &got); err != nil {
+		t.Errorf("invalid json %s: %v", bs, err)
+		return
+	}
+	var es map[string]interface{}
+	_ = json.Unmarshal([]byte(`{
+		"n": {"type": "NoneType", "value": null},
+		"i": {"type": "int", "value": 42},
+		"big": {"type": "int", "value": "1152921504606846976"},
+		"f": {"type": "float", "value": 2},
+		"inf": {"type": "float", "value": "+inf"},
+		"s": {"type": "string", "value": "hi"},
+		"by": {"type": "bytes", "value": "YWI="},
+		"t": {"type": "tuple", "value": [{"type": "int", "value": 1}, {"type": "string", "value": "a"}]},
+		"d": {"type": "dict", "value": [{"key": {"type": "int", "value": 1}, "value": {"type": "list", "value": [{"type": "bool", "value": true}]}}]},
+		"fn": {"type": "function", "value": "<function fn>"}
+	}`), &es)
+	if !reflect.DeepEqual(got, es) {
+		t.Errorf("expect %v, got %v", es, got)
+	}
+
+	b = starbox.New("test")
+	if _, err := b.Run(`l = [1]; l.append(l)`); err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if _, err := b.OutputJSONTyped(); err == nil {
+		t.Errorf("expect error for value containing itself, got nil")
+	}
+}
+
+// TestEncodeDecodeResult tests the following:
+// 1. Run a script with values of various types, encode the output and decode it back.
+// 2. Check the decoded output is deeply equal to the original one.
+// 3. Encode the output with unsupported values, and expect an error naming the key.
+// 4. Decode malformed bytes, and expect an error.
+func TestEncodeDecodeResult(t *testing.T) {
+	b := starbox.New("test")
+	out, err := b.Run(hereDoc(`
+		n = None
+		i = 42
+		bi = 1 << 70
+		f = 3.14
+		s = "aloha"
+		by = b"\x00ab"
+		t = True
+		l = [1, "a", None, [2.5]]
+		tp = (1, 2)
+		d = {"a": 1, 2: ["b"]}
+		st = set([1, 2])
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	bs, err := starbox.EncodeResult(out)
+	if err != nil {
+		t.Errorf("unexpected encode error: %v", err)
+		return
+	}
+	res, err := starbox.DecodeResult(bs)
+	if err != nil {
+		t.Errorf("unexpected decode error: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(res, out) {
+		t.Errorf("expect %v, got %v", out, res)
+	}
+
+	// empty result
+	if bs, err := starbox.EncodeResult(nil); err != nil {
+		t.Errorf("unexpected encode error: %v", err)
+	} else if res, err := starbox.DecodeResult(bs); err != nil || res == nil || len(res) != 0 {
+		t.Errorf("expect empty result, got %v, %v", res, err)
+	}
+
+	// unsupported values
+	out, err = starbox.New("test").Run("a = 1\ndef f(): pass")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if _, err := starbox.EncodeResult(out); err == nil || !strings.Contains(err.Error(), "encode result f: ") {
+		t.Errorf("expect encode error for f, got %v", err)
+	}
+
+	// malformed bytes
+	if _, err := starbox.DecodeResult([]byte("not gob")); err == nil {
+		t.Errorf("expect decode error, got nil")
+	}
+}
@@ -0,0 +1,113 @@
+package starbox
+
+import (
+	"go.starlark.net/starlark"
+)
+
+// BoxPool is a pool of reusable Starbox instances created by the same factory function, it's safe for concurrent use.
+// It amortizes the construction of boxes and machines across runs, e.g. requests of a server.
+type BoxPool struct {
+	factory func() *Starbox
+	boxes   chan *Starbox
+}
+
+// NewBoxPool creates a new BoxPool with the given factory function and the maximum number of idle boxes to keep.
+// The factory function should return a new configured Starbox instance each time, and the size less than 1 is treated as 1.
+func NewBoxPool(factory func() *Starbox, size int) *BoxPool {
+	if size < 1 {
+		size = 1
+	}
+	return &BoxPool{
+		factory: factory,
+		boxes:   make(chan *Starbox, size),
+	}
+}
+
+// Get returns an idle Starbox instance from the pool, or creates a new one with the factory function if the pool is empty.
+// The state of the box is recorded, so Put() can tell whether the box is changed by the borrower.
+func (p *BoxPool) Get() *Starbox {
+	var b *Starbox
+	select {
+	case b = <-p.boxes:
+	default:
+		b = p.factory()
+	}
+	if b != nil {
+		b.lease()
+	}
+	return b
+}
+
+// Put resets the given Starbox instance and returns it to the pool for reuse.
+// Reset() clears the runtime state of the box, while keeps the configured modules and key-values of the factory.
+// The box is discarded instead if it's not as the factory configured anymore, i.e. it's frozen or closed, any setter or adder is called after Get(), or the contents or the change hooks of its memories are changed, so the borrowers never see the changes of each other.
+// The boxes with an emit channel or a print channel are discarded as well, since the channels are closed after the run and the consumers of the next user can't receive from them.
+// And so are the boxes not taken by Get() and the boxes exceeding the size of the pool.
+func (p *BoxPool) Put(b *Starbox) {
+	if b == nil || !b.recycle() {
+		return
+	}
+	select {
+	case p.boxes <- b:
+	default:
+		// the pool is full, discard it
+	}
+}
+
+// poolLease is the state of a box recorded when it's taken from the pool.
+type poolLease struct {
+	version  uint64
+	memories map[string]starlark.Value
+	hooks    map[string]int
+}
+
+// lease records the version of the settings, and the snapshots of the contents and the number of change hooks of the memories.
+func (s *Starbox) lease() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := &poolLease{version: s.version, memories: make(map[string]starlark.Value), hooks: make(map[string]int)}
+	for name, v := range s.globals {
+		if sd, ok := sharedDictOf(v); ok {
+			if d, err := sd.CloneDict(); err == nil {
+				l.memories[name], _ = copyStarlarkValue(d)
+			}
+		}
+		if m, ok := v.(*Memory); ok {
+			l.hooks[name] = m.hookCount()
+		}
+	}
+	s.leased = l
+}
+
+// recycle resets the box for the pool and returns true if it's unchanged since lease(), or returns false if it should be discarded. The checks and the reset are done with the lock held.
+func (s *Starbox) recycle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.leased
+	s.leased = nil
+	if l == nil || s.frozen || s.closed || s.emitter != nil || s.printer != nil || s.version != l.version {
+		return false
+	}
+	for name, v := range s.globals {
+		if sd, ok := sharedDictOf(v); ok {
+			snap, found := l.memories[name]
+			if !found {
+				return false
+			}
+			d, err := sd.CloneDict()
+			if err != nil {
+				return false
+			}
+			if eq, err := starlark.Equal(snap, d); err != nil || !eq {
+				return false
+			}
+		}
+		if m, ok := v.(*Memory); ok && m.hookCount() != l.hooks[name] {
+			return false
+		}
+	}
+	s.reset()
+	return true
+}
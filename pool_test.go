@@ -0,0 +1,208 @@
+package starbox_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/1set/starbox"
+	"go.starlark.net/starlark"
+)
+
+// TestBoxPool tests the following:
+// 1. Create a pool with a factory that configures modules and key-values.
+// 2. Get a box, run a script and put it back.
+// 3. Get the box again and check the runtime globals are cleared while the configuration remains.
+func TestBoxPool(t *testing.T) {
+	created := 0
+	pool := starbox.NewBoxPool(func() *starbox.Starbox {
+		created++
+		b := starbox.New("pooled")
+		b.SetModuleSet(starbox.SafeModuleSet)
+		b.AddKeyValue("base", 100)
+		return b
+	}, 1)
+
+	b1 := pool.Get()
+	out, err := b1.Run(`x = base + 1; s = json.encode(x)`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["s"] != "101" {
+		t.Errorf("expect s=101, got %v", out["s"])
+	}
+	pool.Put(b1)
+
+	b2 := pool.Get()
+	if b2 != b1 {
+		t.Error("expect the same box from pool")
+	}
+	if created != 1 {
+		t.Errorf("expect 1 box created, got %d", created)
+	}
+	if _, err := b2.Run(`y = x`); err == nil {
+		t.Error("expect error for cleared global, got nil")
+	}
+	b3 := pool.Get()
+	out, err = b3.Run(`y = base * 2; s = json.encode(y)`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["s"] != "200" {
+		t.Errorf("expect s=200, got %v", out["s"])
+	}
+	if created != 2 {
+		t.Errorf("expect 2 boxes created, got %d", created)
+	}
+
+	// discard frozen, closed and extra boxes
+	b2.Freeze()
+	pool.Put(b2)
+	_ = b3.Close()
+	pool.Put(b3)
+	pool.Put(nil)
+	if b4 := pool.Get(); b4 == b2 || b4 == b3 {
+		t.Error("expect a new box from pool")
+	}
+}
+
+// TestBoxPool_RunState tests the following:
+// 1. Put the boxes with an emit channel or a print channel, and check they are discarded.
+// 2. Put a box with warnings, and check the warnings are cleared for the next user.
+func TestBoxPool_RunState(t *testing.T) {
+	for _, name := range []string{"emit", "print"} {
+		pool := starbox.NewBoxPool(func() *starbox.Starbox {
+			b := starbox.New("pooled")
+			if name == "emit" {
+				b.AddEmitChannel(make(chan interface{}, 1))
+			} else {
+				b.PrintChannel(1)
+			}
+			return b
+		}, 1)
+		b1 := pool.Get()
+		if _, err := b1.Run(`x = 1`); err != nil {
+			t.Errorf("%s: expect nil, got %v", name, err)
+			return
+		}
+		pool.Put(b1)
+		if b2 := pool.Get(); b2 == b1 {
+			t.Errorf("%s: expect a new box from pool", name)
+		}
+	}
+
+	pool := starbox.NewBoxPool(func() *starbox.Starbox {
+		b := starbox.New("pooled")
+		b.SetPrintAsWarnings(true)
+		return b
+	}, 1)
+	b1 := pool.Get()
+	if _, err := b1.Run(`print("low disk")`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	pool.Put(b1)
+	b2 := pool.Get()
+	if b2 != b1 {
+		t.Error("expect the same box from pool")
+	}
+	if ws := b2.GetWarnings(); ws != nil {
+		t.Errorf("expect no warnings after put, got %v", ws)
+	}
+}
+
+// TestBoxPool_Concurrent tests the pool works with concurrent Get and Put.
+func TestBoxPool_Concurrent(t *testing.T) {
+	pool := starbox.NewBoxPool(func() *starbox.Starbox {
+		b := starbox.New("pooled")
+		b.AddKeyValue("n", 2)
+		return b
+	}, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := pool.Get()
+			defer pool.Put(b)
+			out, err := b.Run(`m = n * n`)
+			if err != nil {
+				t.Errorf("expect nil, got %v", err)
+				return
+			}
+			if out["m"] != int64(4) {
+				t.Errorf("expect m=4, got %v", out["m"])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestBoxPool_Changed tests the following:
+// 1. Get boxes from a pool, and change their settings or memories in different ways.
+// 2. Put them back, and check the changed ones are discarded while the unchanged one is reused.
+func TestBoxPool_Changed(t *testing.T) {
+	var mem *starbox.Memory
+	pool := starbox.NewBoxPool(func() *starbox.Starbox {
+		b := starbox.New("pooled")
+		b.AddKeyValue("n", 2)
+		mem = b.CreateObservedMemory("mem")
+		return b
+	}, 1)
+
+	tests := []struct {
+		name   string
+		change func(b *starbox.Starbox) error
+		reused bool
+	}{
+		{"unchanged", func(b *starbox.Starbox) error {
+			_, err := b.Run(`m = n * mem.get("x", 1)`)
+			return err
+		}, true},
+		{"key-value", func(b *starbox.Starbox) error {
+			b.AddKeyValue("secret", "abc")
+			return nil
+		}, false},
+		{"thread local", func(b *starbox.Starbox) error {
+			b.SetThreadLocal("user", "abc")
+			return nil
+		}, false},
+		{"exit handler", func(b *starbox.Starbox) error {
+			b.SetExitHandler(func(int) {})
+			return nil
+		}, false},
+		{"memory added", func(b *starbox.Starbox) error {
+			b.CreateMemory("other")
+			return nil
+		}, false},
+		{"memory content", func(b *starbox.Starbox) error {
+			_, err := b.Run(`mem["x"] = 3`)
+			return err
+		}, false},
+		{"memory hook", func(b *starbox.Starbox) error {
+			mem.OnChange(func(string, starlark.Value, starlark.Value) {})
+			return nil
+		}, false},
+	}
+	for _, tt := range tests {
+		b := pool.Get()
+		if err := tt.change(b); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			return
+		}
+		pool.Put(b)
+		if b2 := pool.Get(); (b2 == b) != tt.reused {
+			t.Errorf("%s: expect reused %v, got %v", tt.name, tt.reused, b2 == b)
+		} else if b2 != b {
+			pool.Put(b2)
+		}
+	}
+
+	// the boxes not taken from the pool are discarded
+	b := starbox.New("outsider")
+	pool.Put(b)
+	if b2 := pool.Get(); b2 == b {
+		t.Error("expect the box not taken from the pool discarded")
+	}
+}
@@ -0,0 +1,74 @@
+package starbox
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/1set/starlet"
+	"go.starlark.net/starlark"
+)
+
+// BuiltinRegistry is a set of named builtin functions shared across boxes, it's safe for concurrent use.
+// It centralizes the common builtins, so each box can inherit all of them by UseRegistry() instead of repeating AddBuiltin().
+type BuiltinRegistry struct {
+	mu    sync.RWMutex
+	funcs map[string]StarlarkFunc
+}
+
+// NewBuiltinRegistry creates a new empty BuiltinRegistry.
+func NewBuiltinRegistry() *BuiltinRegistry {
+	return &BuiltinRegistry{funcs: make(map[string]StarlarkFunc)}
+}
+
+// Register adds a builtin function with name to the registry, and the existing one with the same name will be overwritten.
+// It doesn't affect the boxes which have already used the registry.
+func (r *BuiltinRegistry) Register(name string, fn StarlarkFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.funcs == nil {
+		r.funcs = make(map[string]StarlarkFunc)
+	}
+	r.funcs[name] = fn
+}
+
+// Names returns the sorted names of the registered builtin functions.
+func (r *BuiltinRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.funcs))
+	for name := range r.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UseRegistry adds all the builtin functions of the registry to the global environment before execution, as if AddBuiltin() is called for each of them.
+// The builtins are copied when it's called, so the later registrations don't affect the box, and the existing globals with the same names will be overwritten, while a subsequent AddBuiltin() overrides the registry entries.
+// It does nothing if the registry is nil. It panics if called after execution.
+func (s *Starbox) UseRegistry(r *BuiltinRegistry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rejectChange("use registry") {
+		return
+	}
+	if s.hasExec {
+		s.logger().DPanic("cannot use registry after execution")
+	}
+	s.markChanged()
+	if r == nil {
+		return
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s.globals == nil {
+		s.globals = make(starlet.StringAnyMap, len(r.funcs))
+	}
+	for name, fn := range r.funcs {
+		s.globals[name] = starlark.NewBuiltin(name, fn)
+	}
+}
@@ -0,0 +1,64 @@
+package starbox_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/1set/starbox"
+	"go.starlark.net/starlark"
+)
+
+// TestBuiltinRegistry tests the following:
+// 1. Register builtins into a registry, and use it in multiple boxes.
+// 2. Override a registry entry with AddBuiltin() in a box, and check the other box is not affected.
+// 3. Register a builtin after using the registry, and check it's not added to the box.
+func TestBuiltinRegistry(t *testing.T) {
+	constFunc := func(v string) starbox.StarlarkFunc {
+		return func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return starlark.String(v), nil
+		}
+	}
+	r := starbox.NewBuiltinRegistry()
+	r.Register("hello", constFunc("hello"))
+	r.Register("bye", constFunc("bye"))
+	if es := []string{"bye", "hello"}; !reflect.DeepEqual(r.Names(), es) {
+		t.Errorf("expect names %v, got %v", es, r.Names())
+	}
+
+	b1 := starbox.New("test1")
+	b1.UseRegistry(r)
+	b1.AddBuiltin("hello", constFunc("aloha"))
+	b2 := starbox.New("test2")
+	b2.UseRegistry(nil)
+	b2.UseRegistry(r)
+	r.Register("later", constFunc("later"))
+
+	out, err := b1.Run(`res = [hello(), bye()]`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{"aloha", "bye"}; !reflect.DeepEqual(out["res"], es) {
+		t.Errorf("expect %v, got %v", es, out["res"])
+	}
+	out, err = b2.Run(`res = [hello(), bye()]`)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	if es := []interface{}{"hello", "bye"}; !reflect.DeepEqual(out["res"], es) {
+		t.Errorf("expect %v, got %v", es, out["res"])
+	}
+	if _, err := b2.Run(`later()`); err == nil {
+		t.Errorf("expect error for builtin registered later, got nil")
+	}
+
+	// zero value registry
+	var zr starbox.BuiltinRegistry
+	zr.Register("zero", constFunc("zero"))
+	b3 := starbox.New("test3")
+	b3.UseRegistry(&zr)
+	if out, err := b3.Run(`res = zero()`); err != nil || out["res"] != "zero" {
+		t.Errorf("unexpected result: %v, %v", out, err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"strings"
 	"time"
 
@@ -21,6 +23,8 @@ type RunnerConfig struct {
 	box      *Starbox
 	fileName string
 	script   []byte
+	reader   io.Reader
+	fsys     fs.FS
 	ctx      context.Context
 	timeout  time.Duration
 	condREPL InspectCondFunc
@@ -39,6 +43,12 @@ func (c *RunnerConfig) String() string {
 	if len(c.script) > 0 {
 		fields = append(fields, fmt.Sprintf("script:%d", len(c.script)))
 	}
+	if c.reader != nil {
+		fields = append(fields, "reader:true")
+	}
+	if c.fsys != nil {
+		fields = append(fields, "fs:true")
+	}
 	if c.ctx != nil && c.ctx != context.Background() {
 		fields = append(fields, fmt.Sprintf("ctx:%v", c.ctx))
 	}
@@ -84,6 +94,23 @@ func (c *RunnerConfig) Script(content string) *RunnerConfig {
 	return &n
 }
 
+// Reader sets the reader of the script content for the execution, the content is read at Execute() time and overrides the content set by Script().
+// The reader is consumed by the first Execute(), so later executions of the same config read nothing from it unless a fresh reader is set again.
+func (c *RunnerConfig) Reader(r io.Reader) *RunnerConfig {
+	n := *c
+	n.reader = r
+	return &n
+}
+
+// FS sets the filesystem for the script and the modules to load of the execution, it's passed to the underlying machine for that execution only.
+// It takes precedence over the filesystem of the box set by SetFS() or built from the script modules for that execution, and the box falls back to its own filesystem for executions without it.
+// Since the loaded modules are cached by name for the lifetime of the box, a module loaded from one filesystem is reused by later executions with another filesystem.
+func (c *RunnerConfig) FS(fsys fs.FS) *RunnerConfig {
+	n := *c
+	n.fsys = fsys
+	return &n
+}
+
 // Context sets the context for the execution.
 func (c *RunnerConfig) Context(ctx context.Context) *RunnerConfig {
 	n := *c
@@ -144,13 +171,136 @@ func (c *RunnerConfig) Starbox(b *Starbox) *RunnerConfig {
 	return &n
 }
 
+// RunOption defines a function to set an option of RunnerConfig, it works with RunnerConfig.With().
+type RunOption func(*RunnerConfig)
+
+// With applies all the given options to a single copy of the RunnerConfig, and returns the copy.
+// It's the functional-options variant of the fluent setters, which copy the config for each call.
+func (c *RunnerConfig) With(opts ...RunOption) *RunnerConfig {
+	n := *c
+	if len(n.extras) > 0 {
+		n.extras = n.extras.Clone()
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&n)
+		}
+	}
+	return &n
+}
+
+// WithStarbox returns a RunOption to set the Starbox instance for the execution.
+func WithStarbox(b *Starbox) RunOption {
+	return func(c *RunnerConfig) {
+		c.box = b
+	}
+}
+
+// WithFileName returns a RunOption to set the script file name for the execution.
+func WithFileName(name string) RunOption {
+	return func(c *RunnerConfig) {
+		c.fileName = name
+	}
+}
+
+// WithScript returns a RunOption to set the script content for the execution.
+func WithScript(content string) RunOption {
+	return func(c *RunnerConfig) {
+		c.script = []byte(content)
+	}
+}
+
+// WithReader returns a RunOption to set the reader of the script content for the execution, like Reader().
+func WithReader(r io.Reader) RunOption {
+	return func(c *RunnerConfig) {
+		c.reader = r
+	}
+}
+
+// WithFS returns a RunOption to set the filesystem for the script and the modules to load of the execution, like FS().
+func WithFS(fsys fs.FS) RunOption {
+	return func(c *RunnerConfig) {
+		c.fsys = fsys
+	}
+}
+
+// WithContext returns a RunOption to set the context for the execution.
+func WithContext(ctx context.Context) RunOption {
+	return func(c *RunnerConfig) {
+		c.ctx = ctx
+	}
+}
+
+// WithTimeout returns a RunOption to set the timeout for the execution.
+func WithTimeout(timeout time.Duration) RunOption {
+	return func(c *RunnerConfig) {
+		c.timeout = timeout
+	}
+}
+
+// WithInspect returns a RunOption to set the inspection mode for the execution, like Inspect().
+func WithInspect(force bool) RunOption {
+	return func(c *RunnerConfig) {
+		c.condREPL = func(starlet.StringAnyMap, error) bool {
+			return force
+		}
+	}
+}
+
+// WithInspectCond returns a RunOption to set the inspection mode with a condition function for the execution, like InspectCond().
+func WithInspectCond(cond InspectCondFunc) RunOption {
+	return func(c *RunnerConfig) {
+		c.condREPL = cond
+	}
+}
+
+// WithKeyValue returns a RunOption to set the key-value pair for the execution.
+func WithKeyValue(key string, value interface{}) RunOption {
+	return func(c *RunnerConfig) {
+		if c.extras == nil {
+			c.extras = make(starlet.StringAnyMap)
+		}
+		c.extras[key] = value
+	}
+}
+
+// WithKeyValueMap returns a RunOption to merge the key-value pairs for the execution.
+func WithKeyValueMap(extras starlet.StringAnyMap) RunOption {
+	return func(c *RunnerConfig) {
+		if c.extras == nil {
+			c.extras = make(starlet.StringAnyMap)
+		}
+		c.extras.Merge(extras)
+	}
+}
+
 // Execute executes the box with the given configuration.
 func (c *RunnerConfig) Execute() (starlet.StringAnyMap, error) {
+	out, _, err := c.execute()
+	return out, err
+}
+
+// ExecuteStats executes the box with the given configuration, and returns the converted output with the metrics of the run like Starbox.RunStats().
+func (c *RunnerConfig) ExecuteStats() (starlet.StringAnyMap, RunStats, error) {
+	return c.execute()
+}
+
+// execute executes the box with the given configuration, and returns the output with the metrics of the run.
+func (c *RunnerConfig) execute() (starlet.StringAnyMap, RunStats, error) {
 	// config and box
 	cfg := *c
 	b := cfg.box
 	if b == nil {
-		return nil, ErrNoStarbox
+		return nil, RunStats{}, ErrNoStarbox
+	}
+
+	// read the script content from the reader
+	if cfg.reader != nil {
+		script, err := io.ReadAll(cfg.reader)
+		if err != nil {
+			return nil, RunStats{}, fmt.Errorf("read script: %w", err)
+		}
+		cfg.script = script
 	}
 
 	// prepare variables
@@ -178,24 +328,38 @@ func (c *RunnerConfig) Execute() (starlet.StringAnyMap, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	if b.closed {
+		return nil, RunStats{}, ErrClosed
+	}
+
 	// if it's the first run, set the environment
 	if !b.hasExec {
 		if err := b.prepareEnv(); err != nil {
-			return nil, err
+			return nil, RunStats{}, err
 		}
 	}
 
-	// set script things
-	b.mac.SetScript(cfg.fileName, cfg.script, b.modFS)
+	// set script things, the filesystem of the config wins over the box's for this run
+	fsys := b.modFS
+	if cfg.fsys != nil {
+		fsys = cfg.fsys
+	}
+	content, err := b.filterScript(cfg.fileName, cfg.script, fsys)
+	if err != nil {
+		return nil, RunStats{}, err
+	}
+	b.setScript(cfg.fileName, content, fsys)
 
 	// finally, run the script
-	b.hasExec = true
-	b.execTimes++
-	out, err := b.mac.RunWithContext(cfg.ctx, cfg.extras)
+	b.runCtx = cfg.ctx
+	out, err := b.runMachine(func() (starlet.StringAnyMap, error) {
+		return b.mac.RunWithContext(cfg.ctx, convertInputs(cfg.extras, b.timeMode))
+	})
+	stats := b.lastStats
 
 	// repl
 	if cfg.condREPL != nil && cfg.condREPL(out, err) {
 		b.mac.REPL()
 	}
-	return out, err
+	return out, stats, err
 }
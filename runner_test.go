@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/1set/starbox"
@@ -260,3 +261,146 @@ func TestRunnerConfig_Inspect(t *testing.T) {
 		return
 	}
 }
+
+func TestRunnerConfig_Reader(t *testing.T) {
+	b := starbox.New("aloha")
+	cfg := b.CreateRunConfig().Script(`x = 1`).Reader(strings.NewReader(`x = 2 * y`)).KeyValue("y", 21)
+	if s := cfg.String(); !strings.Contains(s, "reader:true") {
+		t.Errorf("expect reader in string, got %s", s)
+	}
+	res, err := cfg.Execute()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if res["x"] != int64(42) {
+		t.Errorf("expect x=42, got %v", res["x"])
+	}
+
+	// the reader is consumed
+	if res, err := cfg.Execute(); err == nil && res["x"] == int64(42) {
+		t.Errorf("expect consumed reader, got %v", res)
+	}
+
+	// read error
+	readErr := errors.New("connection reset")
+	b2 := starbox.New("hello")
+	if _, err := b2.CreateRunConfig().With(starbox.WithReader(iotest.ErrReader(readErr))).Execute(); !errors.Is(err, readErr) {
+		t.Errorf("expect read error, got %v", err)
+	}
+}
+
+func TestRunnerConfig_With(t *testing.T) {
+	b := starbox.New("aloha")
+	base := starbox.NewRunConfig().With(
+		starbox.WithStarbox(b),
+		starbox.WithFileName("with.star"),
+		starbox.WithKeyValue("a", 10),
+		starbox.WithTimeout(5*time.Second),
+		nil,
+	)
+	cfg := base.With(
+		starbox.WithScript(`r = a + b + c`),
+		starbox.WithContext(context.TODO()),
+		starbox.WithKeyValue("b", 20),
+		starbox.WithKeyValueMap(starlet.StringAnyMap{"c": 30}),
+		starbox.WithInspect(false),
+		starbox.WithInspectCond(func(_ starlet.StringAnyMap, e error) bool { return false }),
+	)
+	t.Logf("config: %v", cfg)
+
+	res, err := cfg.Execute()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if res["r"] != int64(60) {
+		t.Errorf("expect r=60, got %v", res["r"])
+		return
+	}
+
+	// the base config is not changed
+	if es := "extras:map[a:10]"; !strings.Contains(base.String(), es) {
+		t.Errorf("expect %q in base config, got %v", es, base)
+	}
+}
+
+func TestRunnerConfig_FS(t *testing.T) {
+	newFS := func(files map[string]string) *memfs.FS {
+		fs := memfs.New()
+		for name, content := range files {
+			if err := fs.WriteFile(name, []byte(content), 0644); err != nil {
+				t.Fatalf("write file %s: %v", name, err)
+			}
+		}
+		return fs
+	}
+	boxFS := newFS(map[string]string{"base.star": `v = "box"`})
+	runFS := newFS(map[string]string{"extra.star": `v = "run"`, "main.star": `load("extra.star", "v"); r = v`})
+
+	b := starbox.New("test")
+	b.SetFS(boxFS)
+	cfg := b.CreateRunConfig()
+	t.Logf("config: %v", cfg.FS(runFS))
+
+	// the filesystem of the config wins for the run
+	res, err := cfg.FS(runFS).Script(`load("extra.star", "v"); r = v`).Execute()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+	} else if res["r"] != "run" {
+		t.Errorf("expect r=run, got %v", res["r"])
+	}
+
+	// script from the filesystem of the config
+	res, err = cfg.With(starbox.WithFS(runFS), starbox.WithFileName("main.star")).Execute()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+	} else if res["r"] != "run" {
+		t.Errorf("expect r=run, got %v", res["r"])
+	}
+
+	// the box falls back to its own filesystem
+	res, err = cfg.Script(`load("base.star", "v"); r = v`).Execute()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+	} else if res["r"] != "box" {
+		t.Errorf("expect r=box, got %v", res["r"])
+	}
+
+	// modules of the box filesystem are not visible to the run with its own filesystem
+	b2 := starbox.New("test")
+	b2.SetFS(boxFS)
+	if _, err := b2.CreateRunConfig().FS(runFS).Script(`load("base.star", "v")`).Execute(); err == nil {
+		t.Errorf("expect error for module outside the run filesystem, got nil")
+	}
+
+	// the filesystem of the config doesn't stay for later plain runs
+	b3 := starbox.New("test")
+	b3.SetFS(boxFS)
+	if _, err := b3.CreateRunConfig().FS(runFS).Script(`load("extra.star", "v")`).Execute(); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	}
+	if out, err := b3.Run(`load("base.star", "v"); r = v`); err != nil {
+		t.Errorf("expect nil, got %v", err)
+	} else if out["r"] != "box" {
+		t.Errorf("expect r=box, got %v", out["r"])
+	}
+}
+
+var sinkConfig *starbox.RunnerConfig
+
+func BenchmarkRunnerConfig_Chain(b *testing.B) {
+	box := starbox.New("aloha")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sinkConfig = box.CreateRunConfig().FileName("a.star").Script(`a = 1`).Context(context.TODO()).Timeout(time.Second).KeyValue("a", 1)
+	}
+}
+
+func BenchmarkRunnerConfig_With(b *testing.B) {
+	box := starbox.New("aloha")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sinkConfig = box.CreateRunConfig().With(starbox.WithFileName("a.star"), starbox.WithScript(`a = 1`), starbox.WithContext(context.TODO()), starbox.WithTimeout(time.Second), starbox.WithKeyValue("a", 1))
+	}
+}
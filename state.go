@@ -0,0 +1,105 @@
+package starbox
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// State is a snapshot of the result globals of a box, which can be serialized into JSON and restored into another box by ImportState().
+// Each value is kept as the Starlark source of a literal, so the Starlark-native types like tuples, sets and bytes survive the round trip.
+type State struct {
+	Globals map[string]string `json:"globals"`
+}
+
+// ExportState takes a snapshot of the result globals of the last run as the raw Starlark values without conversion.
+// Only None, bools, numbers, strings, bytes and the lists, tuples, dicts and sets of them can be exported, and it returns an error for any other value like functions or modules, or a value containing itself.
+// It returns ErrNotExecuted if the box has not been executed.
+func (s *Starbox) ExportState() (*State, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasExec || s.mac == nil {
+		return nil, ErrNotExecuted
+	}
+	names := make([]string, 0, len(s.lastRes))
+	for name := range s.lastRes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	st := &State{Globals: make(map[string]string, len(names))}
+	for _, name := range names {
+		v := s.lastRes[name]
+		if err := checkStateValue(v, make(map[starlark.Value]struct{})); err != nil {
+			return nil, fmt.Errorf("export state %s: %w", name, err)
+		}
+		st.Globals[name] = v.String()
+	}
+	return st, nil
+}
+
+// ImportState restores the globals of the given state into the global environment before execution, like AddStarlarkValues().
+// It returns an error if the state is nil or any value of it is invalid, and nothing is imported in that case.
+// It panics if called after execution.
+func (s *Starbox) ImportState(st *State) error {
+	if st == nil {
+		return errors.New("nil state")
+	}
+	values := make(starlark.StringDict, len(st.Globals))
+	thread := &starlark.Thread{Name: "state"}
+	for name, src := range st.Globals {
+		v, err := starlark.EvalOptions(stateFileOptions, thread, name, src, statePredeclared)
+		if err != nil {
+			return fmt.Errorf("import state %s: %w", name, err)
+		}
+		values[name] = v
+	}
+	s.AddStarlarkValues(values)
+	return nil
+}
+
+var (
+	stateFileOptions = &syntax.FileOptions{Set: true}
+	statePredeclared = starlark.StringDict{
+		"inf": starlark.Float(math.Inf(1)),
+		"nan": starlark.Float(math.NaN()),
+	}
+)
+
+// checkStateValue checks if the given value can be exported as a Starlark literal, seen holds the containers on the current path to detect cycles.
+func checkStateValue(v starlark.Value, seen map[starlark.Value]struct{}) error {
+	switch x := v.(type) {
+	case starlark.NoneType, starlark.Bool, starlark.Int, starlark.Float, starlark.String, starlark.Bytes:
+		return nil
+	case *starlark.List, starlark.Tuple, *starlark.Dict, *starlark.Set:
+		if _, isTuple := x.(starlark.Tuple); !isTuple {
+			if _, ok := seen[x]; ok {
+				return errors.New("value contains itself")
+			}
+			seen[x] = struct{}{}
+			defer delete(seen, x)
+		}
+		iter := x.(starlark.Iterable).Iterate()
+		defer iter.Done()
+		var e starlark.Value
+		for iter.Next(&e) {
+			if err := checkStateValue(e, seen); err != nil {
+				return err
+			}
+			if d, ok := x.(*starlark.Dict); ok {
+				dv, _, _ := d.Get(e)
+				if err := checkStateValue(dv, seen); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+}
@@ -0,0 +1,106 @@
+package starbox_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/1set/starbox"
+)
+
+// TestExportImportState tests the following:
+// 1. Export the state before any run, and expect an error.
+// 2. Run a script with various Starlark values, export the state and serialize it into JSON.
+// 3. Import the state into a fresh box, and check the values are restored with their types.
+// 4. Export the state with unsupported values, and expect errors.
+func TestExportImportState(t *testing.T) {
+	b := starbox.New("test")
+	if _, err := b.ExportState(); err != starbox.ErrNotExecuted {
+		t.Errorf("expect ErrNotExecuted, got %v", err)
+	}
+	if err := b.ImportState(nil); err == nil {
+		t.Errorf("expect error for nil state, got nil")
+	}
+
+	_, err := b.Run(hereDoc(`
+		n = None
+		i = 1 << 70
+		f = float("inf")
+		s = "hi\n\"there\""
+		by = b"\x00ab"
+		t = (1, [2, 3], {"k": (4,)})
+		st = set([1, 2])
+		e = []
+	`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+		return
+	}
+	st, err := b.ExportState()
+	if err != nil {
+		t.Errorf("unexpected export error: %v", err)
+		return
+	}
+	bs, err := json.Marshal(st)
+	if err != nil {
+		t.Errorf("unexpected marshal error: %v", err)
+		return
+	}
+	var nst starbox.State
+	if err := json.Unmarshal(bs, &nst); err != nil {
+		t.Errorf("unexpected unmarshal error: %v", err)
+		return
+	}
+
+	nb := starbox.New("restore")
+	if err := nb.ImportState(&nst); err != nil {
+		t.Errorf("unexpected import error: %v", err)
+		return
+	}
+	out, err := nb.Run(hereDoc(`
+		res = [
+			n == None,
+			i == 1 << 70,
+			f > 1e308,
+			s == "hi\n\"there\"",
+			by == b"\x00ab",
+			type(t) == "tuple" and t[1] == [2, 3] and t[2]["k"] == (4,),
+			type(st) == "set" and 2 in st,
+			e == [],
+		]
+		e.append(1)
+	`))
+	if err != nil {
+		t.Errorf("unexpected run error: %v", err)
+		return
+	}
+	if res, ok := out["res"].([]interface{}); !ok || len(res) != 8 {
+		t.Errorf("unexpected result: %v", out["res"])
+	} else {
+		for i, r := range res {
+			if r != true {
+				t.Errorf("expect value %d restored, got %v", i, r)
+			}
+		}
+	}
+
+	// invalid state
+	if err := starbox.New("test").ImportState(&starbox.State{Globals: map[string]string{"x": "[1,"}}); err == nil {
+		t.Errorf("expect error for invalid state, got nil")
+	}
+
+	// unsupported values
+	for _, script := range []string{
+		`def f(): pass`,
+		`l = [1]; l.append(l)`,
+		`d = {"a": [len]}`,
+	} {
+		b := starbox.New("test")
+		if _, err := b.Run(script); err != nil {
+			t.Errorf("unexpected error for %q: %v", script, err)
+			continue
+		}
+		if _, err := b.ExportState(); err == nil {
+			t.Errorf("expect export error for %q, got nil", script)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package starbox
+
+import (
+	"time"
+
+	"github.com/1set/starlet"
+)
+
+// RunStats contains the metrics of a single run.
+type RunStats struct {
+	// Steps is the number of Starlark execution steps of the run.
+	Steps uint64
+	// Duration is the time spent on the script execution, excluding the preparation of the environment.
+	Duration time.Duration
+	// Modules is the sorted names of the modules loaded for the run.
+	Modules []string
+}
+
+// RunStats executes a script and returns the converted output with the metrics of the run.
+func (s *Starbox) RunStats(script string) (starlet.StringAnyMap, RunStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// prepare environment
+	if err := s.prepareScriptEnv(script); err != nil {
+		return nil, RunStats{}, err
+	}
+
+	// run
+	out, err := s.runMachine(s.mac.Run)
+	return out, s.lastStats, err
+}
+
+// GetLastStats returns the metrics of the last run, or zero value if the box has not been executed.
+func (s *Starbox) GetLastStats() RunStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.lastStats
+}
+
+// statsRecorder measures the metrics of a run.
+type statsRecorder struct {
+	steps uint64
+	start time.Time
+}
+
+// startStats starts measuring the metrics of the run with the current state of the box, it should be called just before the script execution.
+func (s *Starbox) startStats() *statsRecorder {
+	r := &statsRecorder{start: time.Now()}
+	if th := s.mac.GetStarlarkThread(); th != nil {
+		r.steps = th.ExecutionSteps()
+	}
+	return r
+}
+
+// finish returns the metrics of the run which just finished.
+func (r *statsRecorder) finish(s *Starbox) RunStats {
+	st := RunStats{
+		Duration: time.Since(r.start),
+		Modules:  append([]string(nil), s.modNames...),
+	}
+	if th := s.mac.GetStarlarkThread(); th != nil {
+		if steps := th.ExecutionSteps(); steps >= r.steps {
+			st.Steps = steps - r.steps
+		} else {
+			st.Steps = steps
+		}
+	}
+	return st
+}
@@ -0,0 +1,79 @@
+package starbox_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1set/starbox"
+)
+
+// TestRunStats tests the following:
+// 1. Create a new Starbox instance with modules.
+// 2. Run scripts of different sizes and check the metrics of each run.
+func TestRunStats(t *testing.T) {
+	b := starbox.New("test")
+	b.AddNamedModules("base64", "math")
+
+	out, st, err := b.RunStats(`a = 1`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["a"] != int64(1) {
+		t.Errorf("expect a=1, got %v", out["a"])
+	}
+	if st.Steps == 0 || st.Duration <= 0 {
+		t.Errorf("expect non-zero steps and duration, got %+v", st)
+	}
+	if es := []string{"base64", "math"}; !reflect.DeepEqual(es, st.Modules) {
+		t.Errorf("expect modules %v, got %v", es, st.Modules)
+	}
+
+	// the steps are counted for each run
+	small := st.Steps
+	_, st2, err := b.RunStats(`x = [i * i for i in range(1000)]`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if st2.Steps < 1000 || st2.Steps < small {
+		t.Errorf("expect more steps, got %d and %d", small, st2.Steps)
+	}
+	_, st3, err := b.RunStats(`b = 2`)
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if st3.Steps >= st2.Steps {
+		t.Errorf("expect steps of the run only, got %d after %d", st3.Steps, st2.Steps)
+	}
+	if got := b.GetLastStats(); !reflect.DeepEqual(got, st3) {
+		t.Errorf("expect last stats %+v, got %+v", st3, got)
+	}
+}
+
+// TestExecuteStats tests the metrics of the run executed by RunnerConfig, and the duration only covers the script execution.
+func TestExecuteStats(t *testing.T) {
+	b := starbox.New("test")
+	b.SetModuleSet(starbox.SafeModuleSet)
+	out, st, err := b.CreateRunConfig().Script(`sleep(0.05); a = 1`).ExecuteStats()
+	if err != nil {
+		t.Errorf("expect nil, got %v", err)
+		return
+	}
+	if out["a"] != int64(1) {
+		t.Errorf("expect a=1, got %v", out["a"])
+	}
+	if st.Duration < 50*time.Millisecond || st.Duration > time.Second {
+		t.Errorf("expect duration around 50ms, got %v", st.Duration)
+	}
+	if st.Steps == 0 || len(st.Modules) == 0 {
+		t.Errorf("expect steps and modules, got %+v", st)
+	}
+
+	// failed before execution
+	if _, st, err := starbox.NewRunConfig().ExecuteStats(); err != starbox.ErrNoStarbox || st.Steps != 0 {
+		t.Errorf("expect no starbox error and empty stats, got %v, %+v", err, st)
+	}
+}
@@ -13,17 +13,21 @@
 //   - NetworkModuleSet: Safe modules plus network modules.
 //   - FullModuleSet: All available modules.
 //
+// Use SetDefaultModuleSet(modSet ModuleSetName) to change the module set of all the boxes created afterwards.
+//
 // Custom Modules:
 //
 //   - AddModuleLoader(moduleName string, moduleLoader starlet.ModuleLoader): Adds a custom module loader. Members can be accessed in the script via load("module_name", "member_name") or member_name.
 //   - AddModuleFunctions(name string, funcs FuncMap): Adds a module of custom functions. Functions can be accessed in the script via load("module_name", "func_name") or module_name.func_name.
 //   - AddModuleData(moduleName string, moduleData starlark.StringDict): Adds a module of custom data. Data can be accessed in the script via load("module_name", "key") or module_name.key.
+//   - AddModuleDataJSON(moduleName string, jsonData []byte): Adds a module of custom data from a JSON object. Data can be accessed in the script via load("module_name", "key") or module_name.key.
 //   - AddStructFunctions(name string, funcs FuncMap): Adds a struct of custom functions. Functions can be accessed in the script via load("struct_name", "func_name") or struct_name.func_name.
 //   - AddStructData(structName string, structData starlark.StringDict): Adds a struct of custom data. Data can be accessed in the script via load("struct_name", "key") or struct_name.key.
 //
 // Dynamic Modules:
 //
 //   - SetDynamicModuleLoader(loader DynamicModuleLoader): Sets a dynamic module loader function, which returns module loaders based on their names before execution. These module names should be defined using AddNamedModules or AddModulesByName.
+//   - SetBulkDynamicModuleLoader(loader BulkDynamicModuleLoader): Sets a dynamic module loader function, which returns module loaders for all the unresolved names in one lookup before execution, and takes precedence over the per-name loader.
 //
 // # Module Loading Priority
 //
@@ -32,6 +36,8 @@
 //   2. Custom modules added by users, preloaded Starlet modules with the same names would not be overwritten.
 //   3. Dynamically loaded modules based on their names just before execution.
 //   4. If a module name is not found in any of the built-in, custom, or dynamic modules, an error is returned.
+//
+// Use SetModulePriority(policy ModulePriority) to let custom modules override the built-in ones with the same names, or fail on such conflicts.
 package starbox
 
 import (
@@ -49,3 +55,21 @@ func init() {
 func SetLog(l *zap.SugaredLogger) {
 	log = l
 }
+
+// SetBoxLogger sets the logger for the internal messages of the box, e.g. the panic messages of setters after execution, instead of the package logger set by SetLog().
+// It's useful to route logs with box-specific fields like tenant, and nil resets it to the package logger.
+// Unlike other setters, it can be called at any time, even after execution or on a frozen box.
+func (s *Starbox) SetBoxLogger(l *zap.SugaredLogger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.boxLog = l
+}
+
+// logger returns the logger for the internal messages of the box, it falls back to the package logger if not set.
+func (s *Starbox) logger() *zap.SugaredLogger {
+	if s.boxLog != nil {
+		return s.boxLog
+	}
+	return log
+}